@@ -0,0 +1,105 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression applied to batches, as offered in a Hello and picked in the
+// HelloAck
+const (
+	CompressionNone = ""
+	CompressionZstd = "zstd"
+	CompressionSnappy = "snappy"
+)
+
+// ParseCompression checks a compression name given on the command line,
+// taking "none" to mean CompressionNone.
+func ParseCompression(name string) (string, error) {
+	switch name {
+	case "none", CompressionNone:
+		return CompressionNone, nil
+	case CompressionZstd, CompressionSnappy:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown compression %q, expected none, zstd or snappy", name)
+}
+
+// pickCompression returns the first of the offered compressions this build
+// supports, or CompressionNone.
+func pickCompression(offered []string) string {
+	for _, name := range offered {
+		if name == CompressionZstd || name == CompressionSnappy {
+			return name
+		}
+	}
+	return CompressionNone
+}
+
+type codec interface {
+	// compress appends the compressed src to dst
+	compress(dst []byte, src []byte) []byte
+	// decompress appends the decompressed src to dst
+	decompress(dst []byte, src []byte) ([]byte, error)
+}
+
+// newCodec returns the codec for the named compression, refusing to
+// decompress more than max_size bytes, or nil for CompressionNone.
+func newCodec(name string, max_size int) (codec, error) {
+	switch name {
+	case CompressionNone:
+		return nil, nil
+	case CompressionZstd:
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(max_size)))
+		if err != nil {
+			return nil, err
+		}
+		return &zstdCodec{encoder: encoder, decoder: decoder}, nil
+	case CompressionSnappy:
+		return snappyCodec{max_size: max_size}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", name)
+}
+
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func (c *zstdCodec) compress(dst []byte, src []byte) []byte {
+	return c.encoder.EncodeAll(src, dst)
+}
+
+func (c *zstdCodec) decompress(dst []byte, src []byte) ([]byte, error) {
+	return c.decoder.DecodeAll(src, dst)
+}
+
+type snappyCodec struct {
+	max_size int
+}
+
+func (snappyCodec) compress(dst []byte, src []byte) []byte {
+	// snappy.Encode only reuses dst's capacity, it doesn't append
+	return append(dst, snappy.Encode(nil, src)...)
+}
+
+func (c snappyCodec) decompress(dst []byte, src []byte) ([]byte, error) {
+	size, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if size > c.max_size {
+		return nil, fmt.Errorf("%d bytes decompressed is too large", size)
+	}
+	decoded, err := snappy.Decode(nil, src)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, decoded...), nil
+}
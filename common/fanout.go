@@ -0,0 +1,197 @@
+package common
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+)
+
+// A Partitioner picks which of shards indexers a page belongs to.
+type Partitioner func(page *PageData, shards int) int
+
+// PartitionByTitle spreads pages over shards by a hash of their title. A
+// moved page's new title usually hashes to another shard than the one
+// holding it, so it suits indexes that are built once.
+func PartitionByTitle(page *PageData, shards int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(page.Title))
+	return int(hash.Sum32() % uint32(shards))
+}
+
+// PartitionByID spreads pages over shards by their page ID, which survives
+// moves, so later updates reach the shard holding the page. Pages without an
+// ID, such as crawled ones, fall back to PartitionByTitle.
+func PartitionByID(page *PageData, shards int) int {
+	if page.ID == 0 {
+		return PartitionByTitle(page, shards)
+	}
+	return int(uint64(page.ID) % uint64(shards))
+}
+
+// ParsePartitioner returns the partitioner called name, "id" or "title".
+func ParsePartitioner(name string) (Partitioner, error) {
+	switch name {
+	case "id":
+		return PartitionByID, nil
+	case "title":
+		return PartitionByTitle, nil
+	}
+	return nil, fmt.Errorf("unknown partitioner %q, expected id or title", name)
+}
+
+// Fanout splits a stream of sequenced messages over a Producer per shard.
+// Pages go to the shard their Partitioner picks. Deletions and moves only
+// name a title, so they go to every shard and are ignored by those without
+// the page, as is anything sent with Notify.
+//
+// Messages are numbered across the whole stream, and a message counts as
+// acknowledged once every shard it went to has acknowledged it.
+type Fanout struct {
+	shards []*Producer
+	partition Partitioner
+	on_ack func(uint64)
+
+	// send_mu keeps Send calls in sequence order, and is never held while
+	// waiting on mu
+	send_mu sync.Mutex
+	last uint64
+
+	mu sync.Mutex
+	// acked is the highest sequence number acknowledged by each shard
+	acked []uint64
+	// routes holds the shard sequence numbers of each unacknowledged message,
+	// in order, from sequence number first onwards
+	routes [][]shardSeq
+	first uint64
+}
+
+type shardSeq struct {
+	shard int
+	seq uint64
+}
+
+// NewFanout connects to a consumer per dial function, as NewProducer does.
+// on_ack, if not nil, is called with each newly acknowledged sequence number
+// of the whole stream, and must not call back into the fanout.
+func NewFanout(dials []func() (net.Conn, error), hello Hello, window int, partition Partitioner, on_ack func(uint64)) (*Fanout, error) {
+	f := &Fanout{
+		partition: partition,
+		on_ack: on_ack,
+		acked: make([]uint64, len(dials)),
+		first: 1,
+	}
+	for i, dial := range dials {
+		shard := i
+		producer, err := NewProducer(dial, hello, window, func(seq uint64) {
+			f.acknowledge(shard, seq)
+		})
+		if err != nil {
+			for _, p := range f.shards {
+				p.Abort()
+			}
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		f.shards = append(f.shards, producer)
+	}
+	return f, nil
+}
+
+// Send sends v as a message of type t to the shards it belongs to, returning
+// its sequence number.
+func (f *Fanout) Send(t MessageType, v any) (uint64, error) {
+	f.send_mu.Lock()
+	defer f.send_mu.Unlock()
+
+	targets := f.targets(t, v)
+	route := make([]shardSeq, 0, len(targets))
+	for _, shard := range targets {
+		seq, err := f.shards[shard].Send(t, v)
+		if err != nil {
+			return 0, fmt.Errorf("shard %d: %w", shard, err)
+		}
+		route = append(route, shardSeq{shard: shard, seq: seq})
+	}
+	f.last++
+
+	f.mu.Lock()
+	f.routes = append(f.routes, route)
+	f.advance()
+	f.mu.Unlock()
+	return f.last, nil
+}
+
+// Notify sends an unsequenced message to every shard.
+func (f *Fanout) Notify(t MessageType, v any) {
+	for _, shard := range f.shards {
+		shard.Notify(t, v)
+	}
+}
+
+// Close ends the stream to every shard, waiting for each to acknowledge
+// everything sent to it.
+func (f *Fanout) Close() error {
+	var errs []error
+	for i, shard := range f.shards {
+		if err := shard.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", i, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+// Last returns the sequence number of the last message sent.
+func (f *Fanout) Last() uint64 {
+	f.send_mu.Lock()
+	defer f.send_mu.Unlock()
+	return f.last
+}
+
+func (f *Fanout) targets(t MessageType, v any) []int {
+	if len(f.shards) == 1 {
+		return []int{0}
+	}
+	if page, ok := v.(*PageData); ok && t == MsgPage && page.Op != OpMove {
+		return []int{f.partition(page, len(f.shards))}
+	}
+	all := make([]int, len(f.shards))
+	for i := range all {
+		all[i] = i
+	}
+	return all
+}
+
+// acknowledge is called by shard's Producer with its lock held.
+func (f *Fanout) acknowledge(shard int, seq uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.acked[shard] = seq
+	f.advance()
+}
+
+// advance drops the messages every shard has acknowledged from the front of
+// routes. f.mu must be held.
+func (f *Fanout) advance() {
+	var acked uint64 = 0
+	for len(f.routes) > 0 && f.delivered(f.routes[0]) {
+		f.routes[0] = nil
+		f.routes = f.routes[1:]
+		acked = f.first
+		f.first++
+	}
+	if acked != 0 && f.on_ack != nil {
+		f.on_ack(acked)
+	}
+}
+
+func (f *Fanout) delivered(route []shardSeq) bool {
+	for _, s := range route {
+		if f.acked[s.shard] < s.seq {
+			return false
+		}
+	}
+	return true
+}
@@ -1,3 +1,10 @@
 module common
 
 go 1.24.5
+
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+)
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
@@ -0,0 +1,285 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrRefused is returned when the consumer turns a stream down, which
+// reconnecting won't fix.
+var ErrRefused = errors.New("consumer refused stream")
+
+// How long a Producer keeps trying to reconnect before giving up
+const reconnectTimeout = 1 * time.Minute
+
+// How often buffered messages are pushed out when they are sent slowly
+const flushInterval = 100 * time.Millisecond
+
+// Producer sends a stream of sequenced messages with at-least-once delivery.
+// Every message is kept until the consumer acknowledges it, Send blocks once
+// window messages are waiting on acknowledgement, and if the connection is
+// lost the producer reconnects and resends them.
+type Producer struct {
+	dial func() (net.Conn, error)
+	hello Hello
+	window int
+	on_ack func(uint64)
+
+	mu sync.Mutex
+	cond *sync.Cond
+	conn net.Conn
+	encoder *Encoder
+	// generation counts connections, so the ack reader of a lost one can
+	// tell that it has been replaced
+	generation int
+	broken bool
+	closed bool
+	last uint64
+	acked uint64
+	unacked []pendingMessage
+}
+
+type pendingMessage struct {
+	seq uint64
+	t MessageType
+	v any
+}
+
+// NewProducer connects to a consumer with dial. on_ack, if not nil, is called
+// with each newly acknowledged sequence number while the producer's lock is
+// held, so it must not call back into the producer.
+func NewProducer(dial func() (net.Conn, error), hello Hello, window int, on_ack func(uint64)) (*Producer, error) {
+	if hello.Stream == "" {
+		hello.Stream = newStreamID(hello.Producer)
+	}
+	p := &Producer{dial: dial, hello: hello, window: max(window, 1), on_ack: on_ack}
+	p.cond = sync.NewCond(&p.mu)
+
+	p.mu.Lock()
+	err := p.connect()
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	go p.flushLoop()
+	return p, nil
+}
+
+// Send queues v to be sent as a message of type t, returning its sequence
+// number. v must not be modified afterwards, as it may have to be resent.
+func (p *Producer) Send(t MessageType, v any) (uint64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.unacked) >= p.window {
+		// Make sure the consumer has everything it needs to acknowledge
+		if !p.broken {
+			if err := p.encoder.Flush(); err != nil {
+				p.broken = true
+			}
+		}
+		if p.broken {
+			if err := p.reconnect(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		p.cond.Wait()
+	}
+
+	p.last++
+	p.unacked = append(p.unacked, pendingMessage{seq: p.last, t: t, v: v})
+	if !p.broken {
+		if err := p.encoder.Encode(t, p.last, v); err == nil {
+			return p.last, nil
+		}
+		p.broken = true
+	}
+	// Reconnecting resends the message along with the rest
+	return p.last, p.reconnect()
+}
+
+// Notify sends an unsequenced message, which is dropped if the connection is
+// down.
+func (p *Producer) Notify(t MessageType, v any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.broken {
+		return
+	}
+	if err := p.encoder.Encode(t, 0, v); err != nil {
+		p.broken = true
+	}
+}
+
+// Close ends the stream and waits for the consumer to acknowledge everything
+// sent on it before disconnecting.
+func (p *Producer) Close() error {
+	if _, err := p.Send(MsgEnd, &End{Messages: int64(p.Last())}); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.broken {
+		if err := p.encoder.Flush(); err != nil {
+			p.broken = true
+		}
+	}
+	for p.acked < p.last {
+		if p.broken {
+			if err := p.reconnect(); err != nil {
+				return err
+			}
+			continue
+		}
+		p.cond.Wait()
+	}
+	p.closed = true
+	p.generation++
+	return p.conn.Close()
+}
+
+// Abort drops the connection without ending the stream.
+func (p *Producer) Abort() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.generation++
+	p.conn.Close()
+}
+
+// Last returns the sequence number of the last message sent.
+func (p *Producer) Last() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last
+}
+
+// connect opens a new connection and resends every unacknowledged message on
+// it. p.mu must be held.
+func (p *Producer) connect() error {
+	conn, err := p.dial()
+	if err != nil {
+		return err
+	}
+	p.hello.Resumed = p.last > 0
+	ack, encoder, decoder, err := Dial(conn, p.hello)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.conn = conn
+	p.encoder = encoder
+	p.broken = false
+	p.generation++
+	p.acknowledge(ack.Acked)
+	for _, m := range p.unacked {
+		if err := encoder.Encode(m.t, m.seq, m.v); err != nil {
+			p.broken = true
+			return err
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		p.broken = true
+		return err
+	}
+	go p.readAcks(decoder, p.generation)
+	return nil
+}
+
+// reconnect replaces a lost connection, retrying with backoff for up to
+// reconnectTimeout. p.mu must be held, and is released while waiting.
+func (p *Producer) reconnect() error {
+	deadline := time.Now().Add(reconnectTimeout)
+	delay := 100 * time.Millisecond
+	for {
+		p.conn.Close()
+		err := p.connect()
+		if err == nil {
+			log.Printf("%s: reconnected, resent %d unacknowledged messages", p.hello.Producer, len(p.unacked))
+			return nil
+		}
+		if errors.Is(err, ErrRefused) || time.Now().After(deadline) {
+			return fmt.Errorf("reconnecting with %d unacknowledged messages: %w", len(p.unacked), err)
+		}
+		log.Printf("%s: connection lost, retrying in %s: %v", p.hello.Producer, delay, err)
+
+		p.mu.Unlock()
+		time.Sleep(delay)
+		p.mu.Lock()
+		delay = min(delay * 2, 5 * time.Second)
+	}
+}
+
+// acknowledge drops the messages up to and including seq. p.mu must be held.
+func (p *Producer) acknowledge(seq uint64) {
+	if seq <= p.acked {
+		return
+	}
+	i := 0
+	for i < len(p.unacked) && p.unacked[i].seq <= seq {
+		i++
+	}
+	// Let the dropped messages be garbage collected
+	clear(p.unacked[:i])
+	p.unacked = p.unacked[i:]
+	p.acked = seq
+	if p.on_ack != nil {
+		p.on_ack(seq)
+	}
+}
+
+func (p *Producer) readAcks(decoder *Decoder, generation int) {
+	for {
+		message, err := decoder.Decode()
+		p.mu.Lock()
+		if generation != p.generation {
+			p.mu.Unlock()
+			return
+		}
+		if err != nil {
+			p.broken = true
+			p.cond.Broadcast()
+			p.mu.Unlock()
+			return
+		}
+		if message.Type == MsgAck {
+			p.acknowledge(message.Ack.Seq)
+			p.cond.Broadcast()
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *Producer) flushLoop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		if !p.broken {
+			if err := p.encoder.Flush(); err != nil {
+				p.broken = true
+				p.cond.Broadcast()
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+func newStreamID(producer string) string {
+	var id [8]byte
+	rand.Read(id[:])
+	return producer + "-" + hex.EncodeToString(id[:])
+}
@@ -0,0 +1,230 @@
+package common
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// WikiProfile holds everything about the wiki being processed that differs
+// between MediaWiki installations and languages. A profile is usually built
+// from the dump's siteinfo with ProfileFromSiteInfo, and can be adjusted with
+// a JSON file of the same shape via LoadProfile and Merge.
+type WikiProfile struct {
+	// Name is the wiki's database name, e.g. "enwiki" or "frwiktionary"
+	Name string
+	Language string
+	// URLBase is prepended to a page's URL title to link to it
+	URLBase string
+	MainPage string
+	// API is the wiki's api.php endpoint, used to look up namespaces when the
+	// profile has none
+	API string
+	// Case is "first-letter" if titles have their first letter capitalised,
+	// or "case-sensitive" (Wiktionary) if not
+	Case string
+	// RedirectWords are the magic words starting a redirect, e.g. "#REDIRECT"
+	RedirectWords []string
+	Namespaces []Namespace
+	// NamespaceAliases maps a namespace key to alternative names for it,
+	// e.g. "Image" for the File namespace
+	NamespaceAliases map[int][]string
+	// Stopwords is the path of the stopword list for the wiki's language
+	Stopwords string
+	// FoldAccents makes terms match whatever their accents, so "Zurich"
+	// finds "Zürich"
+	FoldAccents bool
+	// Stemmer names the stemmer terms are reduced with, "none" to keep them
+	// whole, or if empty the Snowball stemmer for Language if there is one
+	Stemmer string
+}
+
+// Keys of the namespaces that need special handling when cleaning pages
+const (
+	NamespaceMain = 0
+	NamespaceFile = 6
+	NamespaceCategory = 14
+)
+
+// redirectWords lists the localised redirect magic words for common wiki
+// languages. "#REDIRECT" is accepted by every wiki, whatever its language.
+var redirectWords = map[string][]string{
+	"de": {"#WEITERLEITUNG"},
+	"es": {"#REDIRECCIÓN"},
+	"fr": {"#REDIRECTION"},
+	"it": {"#RINVIA", "#RINVIO"},
+	"ja": {"#転送"},
+	"nl": {"#DOORVERWIJZING"},
+	"pl": {"#PATRZ", "#PRZEKIERUJ", "#TAM"},
+	"pt": {"#REDIRECIONAMENTO", "#REDIRECIONA"},
+	"ru": {"#ПЕРЕНАПРАВЛЕНИЕ", "#ПЕРЕНАПР"},
+	"sv": {"#OMDIRIGERING"},
+}
+
+// namespaceAliases lists aliases that are not part of a dump's siteinfo but
+// are still in common use in page text.
+var namespaceAliases = map[string]map[int][]string{
+	"en": {NamespaceFile: {"Image"}},
+	"de": {NamespaceFile: {"Bild", "Image"}},
+	"fr": {NamespaceFile: {"Image"}},
+}
+
+// Database names of Wikimedia projects are the project's language code,
+// with underscores for hyphens, followed by the project
+var reProjectDBName = regexp.MustCompile(`^([a-z]{2,3}(?:_[a-z]+)*)(?:wiki|wiktionary|wikibooks|wikinews|wikiquote|wikisource|wikiversity|wikivoyage)$`)
+
+// EnglishWikipedia is the profile used when nothing else is given.
+func EnglishWikipedia() *WikiProfile {
+	return &WikiProfile{
+		Name: "enwiki",
+		Language: "en",
+		URLBase: "https://en.wikipedia.org/wiki/",
+		MainPage: "https://en.wikipedia.org/wiki/Main_Page",
+		API: "https://en.wikipedia.org/w/api.php",
+		Case: "first-letter",
+		RedirectWords: []string{"#REDIRECT"},
+		NamespaceAliases: namespaceAliases["en"],
+		Stopwords: "./data/stopwords",
+	}
+}
+
+// ProfileFromSiteInfo builds a profile for the wiki a dump was taken from.
+func ProfileFromSiteInfo(site *SiteInfo) *WikiProfile {
+	language := languageFromDBName(site.DBName)
+	if language == "" {
+		language = languageFromBase(site.Base)
+	}
+	if language == "" {
+		language = "en"
+	}
+
+	url_base := site.Base
+	if i := strings.LastIndex(url_base, "/"); i >= 0 {
+		url_base = url_base[:i + 1]
+	}
+	api := ""
+	if parsed, err := url.Parse(site.Base); err == nil && parsed.Host != "" {
+		api = parsed.Scheme + "://" + parsed.Host + "/w/api.php"
+	}
+
+	stopwords := "./data/stopwords"
+	if language != "en" {
+		stopwords = "./data/stopwords." + language
+	}
+
+	return &WikiProfile{
+		Name: site.DBName,
+		Language: language,
+		URLBase: url_base,
+		MainPage: site.Base,
+		API: api,
+		Case: site.Case,
+		RedirectWords: append([]string{"#REDIRECT"}, redirectWords[language]...),
+		Namespaces: site.Namespaces,
+		NamespaceAliases: namespaceAliases[language],
+		Stopwords: stopwords,
+	}
+}
+
+func LoadProfile(path string) (*WikiProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profile WikiProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// Merge overrides the fields of p with those set in other.
+func (p *WikiProfile) Merge(other *WikiProfile) {
+	if other.Name != "" {
+		p.Name = other.Name
+	}
+	if other.Language != "" {
+		p.Language = other.Language
+	}
+	if other.URLBase != "" {
+		p.URLBase = other.URLBase
+	}
+	if other.MainPage != "" {
+		p.MainPage = other.MainPage
+	}
+	if other.API != "" {
+		p.API = other.API
+	}
+	if other.Case != "" {
+		p.Case = other.Case
+	}
+	if len(other.RedirectWords) > 0 {
+		p.RedirectWords = other.RedirectWords
+	}
+	if len(other.Namespaces) > 0 {
+		p.Namespaces = other.Namespaces
+	}
+	if len(other.NamespaceAliases) > 0 {
+		p.NamespaceAliases = other.NamespaceAliases
+	}
+	if other.Stopwords != "" {
+		p.Stopwords = other.Stopwords
+	}
+	if other.FoldAccents {
+		p.FoldAccents = true
+	}
+	if other.Stemmer != "" {
+		p.Stemmer = other.Stemmer
+	}
+}
+
+// NamespaceNames returns every name and alias of the namespace with key.
+func (p *WikiProfile) NamespaceNames(key int) []string {
+	names := make([]string, 0)
+	for _, ns := range p.Namespaces {
+		if ns.Key == key && ns.Name != "" {
+			names = append(names, ns.Name)
+		}
+	}
+	return append(names, p.NamespaceAliases[key]...)
+}
+
+// AllNamespaceNames returns every name and alias of every namespace other
+// than the main (article) namespace.
+func (p *WikiProfile) AllNamespaceNames() []string {
+	names := make([]string, 0, len(p.Namespaces))
+	for _, ns := range p.Namespaces {
+		if ns.Key != NamespaceMain && ns.Name != "" {
+			names = append(names, ns.Name)
+		}
+	}
+	for key, aliases := range p.NamespaceAliases {
+		if key != NamespaceMain {
+			names = append(names, aliases...)
+		}
+	}
+	return names
+}
+
+func languageFromDBName(db_name string) string {
+	if match := reProjectDBName.FindStringSubmatch(db_name); match != nil {
+		return strings.ReplaceAll(match[1], "_", "-")
+	}
+	return ""
+}
+
+// languageFromBase guesses the language from the subdomain of the main page
+// URL, as in https://de.wikipedia.org/wiki/...
+func languageFromBase(base string) string {
+	parsed, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	label, _, found := strings.Cut(parsed.Hostname(), ".")
+	if !found || len(label) < 2 || len(label) > 3 || label == "www" {
+		return ""
+	}
+	return label
+}
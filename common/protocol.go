@@ -1,7 +1,467 @@
 package common
 
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Operations a PageData can ask the indexer to apply
+const (
+	// OpIndex adds a page to an index being built from a full dump
+	OpIndex = ""
+	// OpUpsert replaces any version of the page already in the index, or adds
+	// it if there is none
+	OpUpsert = "upsert"
+	// OpDelete removes the page from the index
+	OpDelete = "delete"
+	// OpMove renames the page from MovedFrom to Title, keeping its content
+	OpMove = "move"
+)
+
 type PageData struct {
+	Op string
 	Title string
 	URL string
 	Body string
+	ID int64
+	RevisionID int64
+	Timestamp time.Time
+	Contributor string
+	// Redirect is the title of the page this one redirects to, or empty if
+	// it is not a redirect.
+	Redirect string
+	// MovedFrom is the page's previous title when Op is OpMove
+	MovedFrom string
+}
+
+// Stages of the pipeline talk over a stream of frames, each a 4 byte big
+// endian length followed by that many bytes: a 1 byte MessageType, an 8 byte
+// big endian sequence number and a msgpack encoded body. A producer opens
+// with a Hello, which the consumer answers with a HelloAck before anything
+// else is sent.
+//
+// Pages and deletions are numbered from 1 in the order they are sent, and
+// other messages have sequence number 0. The consumer acknowledges the
+// highest sequence number up to which it has durably processed everything,
+// and a producer that reconnects resends whatever was not acknowledged, so
+// the consumer has to drop messages it has already seen.
+//
+// A producer may group messages into a batch, a frame whose body is the
+// frames of the messages one after the other, compressed as agreed in the
+// handshake. Batches have sequence number 0 and the messages in them keep
+// their own.
+
+// ProtocolVersion must be bumped whenever a message changes shape, so stages
+// from mismatched builds refuse to talk instead of mis-decoding each other.
+const ProtocolVersion = 3
+
+// maxFrameSize bounds the memory a corrupt or foreign length can make a
+// Decoder allocate. The largest Wikipedia pages are a few megabytes.
+const maxFrameSize = 256 * 1024 * 1024
+
+const frameHeaderSize = 1 + 8
+
+// maxBatchSize bounds the uncompressed size of a batch, and batchFlushSize is
+// the size at which an Encoder sends one whatever its count. Messages larger
+// than batchFlushSize are sent on their own.
+const (
+	maxBatchSize = 16 * 1024 * 1024
+	batchFlushSize = 4 * 1024 * 1024
+)
+
+type MessageType uint8
+
+const (
+	MsgHello MessageType = iota + 1
+	MsgHelloAck
+	// MsgPage carries a PageData to index, upsert or move
+	MsgPage
+	// MsgDelete carries a PageData naming a page that no longer exists
+	MsgDelete
+	// MsgCheckpoint carries a Checkpoint
+	MsgCheckpoint
+	// MsgEnd carries an End and is the last message of a stream
+	MsgEnd
+	// MsgAck carries an Ack from the consumer
+	MsgAck
+	// MsgBatch carries a group of other messages
+	MsgBatch
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MsgHello:
+		return "hello"
+	case MsgHelloAck:
+		return "hello-ack"
+	case MsgPage:
+		return "page"
+	case MsgDelete:
+		return "delete"
+	case MsgCheckpoint:
+		return "checkpoint"
+	case MsgEnd:
+		return "end"
+	case MsgAck:
+		return "ack"
+	case MsgBatch:
+		return "batch"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+type Hello struct {
+	Version int
+	// Producer names the sending program, e.g. "wxunpacker"
+	Producer string
+	// Stream identifies the sequence of messages being sent. It is unique to
+	// each run of a producer and kept when it reconnects.
+	Stream string
+	// Resumed is set when the producer reconnects to a stream it has already
+	// sent messages on, which the consumer refuses if it doesn't know it
+	Resumed bool
+	// Profile describes the wiki the pages come from, or is nil if the
+	// producer doesn't know
+	Profile *WikiProfile
+	// Compression lists the compressions the producer can apply to batches,
+	// in order of preference
+	Compression []string
+	// Batch is how many messages the producer groups into a batch, with 0 or
+	// 1 meaning it sends each on its own
+	Batch int
+}
+
+type HelloAck struct {
+	Version int
+	// Error is why the consumer refused the stream, or empty if it accepted
+	Error string
+	// Acked is the highest sequence number already acknowledged on the
+	// stream, so a reconnecting producer knows what to resend
+	Acked uint64
+	// Compression is the one of the offered compressions batches are to use,
+	// or empty for none
+	Compression string
+}
+
+// Ack tells the producer that every message up to and including Seq has been
+// durably processed and need not be kept for resending.
+type Ack struct {
+	Seq uint64
+}
+
+// Checkpoint tells the consumer how far through its input the producer is
+// once every page sent before it has been handled.
+type Checkpoint struct {
+	Offset int64
+	PageID int64
+	Title string
+	Pages int64
+}
+
+// End closes a stream, giving the number of sequenced messages in it, the
+// pages and deletes, which is also the last sequence number, so the consumer
+// can tell if any went missing. Checkpoints are unsequenced and not counted.
+type End struct {
+	Messages int64
+}
+
+// Message is a decoded frame. Exactly one of its pointers is set, matching
+// Type.
+type Message struct {
+	Type MessageType
+	Seq uint64
+	Hello *Hello
+	HelloAck *HelloAck
+	Page *PageData
+	Checkpoint *Checkpoint
+	End *End
+	Ack *Ack
+}
+
+// Encoder writes frames to a stream. Frames are buffered until Flush is
+// called or the buffer fills, and if batching until the batch fills.
+type Encoder struct {
+	writer *bufio.Writer
+	body bytes.Buffer
+	encoder *msgpack.Encoder
+
+	batch int
+	codec codec
+	// pending holds the frames of the batch being filled
+	pending []byte
+	pending_count int
+	compressed []byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	e := &Encoder{writer: bufio.NewWriterSize(w, 256*1024)}
+	e.encoder = msgpack.NewEncoder(&e.body)
+	return e
+}
+
+// Encode writes v as the body of a frame of type t with sequence number seq.
+func (e *Encoder) Encode(t MessageType, seq uint64, v any) error {
+	e.body.Reset()
+	var header [4 + frameHeaderSize]byte
+	header[4] = byte(t)
+	binary.BigEndian.PutUint64(header[5:], seq)
+	e.body.Write(header[:])
+	if err := e.encoder.Encode(v); err != nil {
+		return err
+	}
+	frame := e.body.Bytes()
+	if len(frame) - 4 > maxFrameSize {
+		return fmt.Errorf("%s message of %d bytes is too large to send", t, len(frame) - 4)
+	}
+	binary.BigEndian.PutUint32(frame, uint32(len(frame) - 4))
+
+	if e.batch <= 1 && e.codec == nil || len(frame) > batchFlushSize {
+		if err := e.flushBatch(); err != nil {
+			return err
+		}
+		_, err := e.writer.Write(frame)
+		return err
+	}
+	if len(e.pending) + len(frame) > batchFlushSize {
+		if err := e.flushBatch(); err != nil {
+			return err
+		}
+	}
+	e.pending = append(e.pending, frame...)
+	e.pending_count++
+	if e.pending_count >= e.batch {
+		return e.flushBatch()
+	}
+	return nil
+}
+
+// Flush sends any partly filled batch and everything buffered.
+func (e *Encoder) Flush() error {
+	if err := e.flushBatch(); err != nil {
+		return err
+	}
+	return e.writer.Flush()
+}
+
+// setBatching makes the encoder group batch messages into each frame,
+// compressed with the named compression.
+func (e *Encoder) setBatching(batch int, compression string) error {
+	codec, err := newCodec(compression, maxBatchSize)
+	if err != nil {
+		return err
+	}
+	e.batch = batch
+	e.codec = codec
+	return nil
+}
+
+func (e *Encoder) flushBatch() error {
+	if e.pending_count == 0 {
+		return nil
+	}
+	payload := e.pending
+	if e.codec != nil {
+		e.compressed = e.codec.compress(e.compressed[:0], e.pending)
+		payload = e.compressed
+	}
+	e.pending = e.pending[:0]
+	e.pending_count = 0
+
+	var header [4 + frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(frameHeaderSize + len(payload)))
+	header[4] = byte(MsgBatch)
+	if _, err := e.writer.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := e.writer.Write(payload)
+	return err
+}
+
+// Decoder reads frames from a stream, unpacking batches.
+type Decoder struct {
+	reader *bufio.Reader
+	body []byte
+
+	codec codec
+	// batch holds the frames left in the batch being read
+	batch []byte
+	decompressed []byte
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{reader: bufio.NewReaderSize(r, 256*1024)}
+}
+
+// Decode reads the next frame. It returns io.EOF if the stream ended cleanly
+// between frames, and io.ErrUnexpectedEOF if it ended part way through one.
+func (d *Decoder) Decode() (*Message, error) {
+	for len(d.batch) == 0 {
+		var length [4]byte
+		if _, err := io.ReadFull(d.reader, length[:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size < frameHeaderSize || size > maxFrameSize {
+			return nil, fmt.Errorf("invalid frame length %d, is the producer speaking this protocol?", size)
+		}
+
+		if cap(d.body) < int(size) {
+			d.body = make([]byte, size)
+		}
+		body := d.body[:size]
+		if _, err := io.ReadFull(d.reader, body); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if MessageType(body[0]) != MsgBatch {
+			return decodeBody(body)
+		}
+
+		// Read the batch's frames before the next frame replaces body
+		d.batch = body[frameHeaderSize:]
+		if d.codec != nil {
+			decompressed, err := d.codec.decompress(d.decompressed[:0], d.batch)
+			if err != nil {
+				d.batch = nil
+				return nil, fmt.Errorf("decompressing batch: %w", err)
+			}
+			d.decompressed = decompressed
+			d.batch = decompressed
+		}
+	}
+
+	body, rest, err := splitFrame(d.batch)
+	if err != nil {
+		d.batch = nil
+		return nil, fmt.Errorf("batch: %w", err)
+	}
+	d.batch = rest
+	return decodeBody(body)
+}
+
+// splitFrame returns the body of the first of the frames in buf, which
+// mustn't be batches, and the frames after it.
+func splitFrame(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 4 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	size := binary.BigEndian.Uint32(buf)
+	if size < frameHeaderSize || uint64(size) > uint64(len(buf) - 4) {
+		return nil, nil, fmt.Errorf("invalid frame length %d", size)
+	}
+	body := buf[4:4 + size]
+	if MessageType(body[0]) == MsgBatch {
+		return nil, nil, fmt.Errorf("nested batch")
+	}
+	return body, buf[4 + size:], nil
+}
+
+// decodeBody decodes the body of a frame, after its length.
+func decodeBody(body []byte) (*Message, error) {
+	message := &Message{Type: MessageType(body[0]), Seq: binary.BigEndian.Uint64(body[1:frameHeaderSize])}
+	var v any
+	switch message.Type {
+	case MsgHello:
+		message.Hello = &Hello{}
+		v = message.Hello
+	case MsgHelloAck:
+		message.HelloAck = &HelloAck{}
+		v = message.HelloAck
+	case MsgPage, MsgDelete:
+		message.Page = &PageData{}
+		v = message.Page
+	case MsgCheckpoint:
+		message.Checkpoint = &Checkpoint{}
+		v = message.Checkpoint
+	case MsgEnd:
+		message.End = &End{}
+		v = message.End
+	case MsgAck:
+		message.Ack = &Ack{}
+		v = message.Ack
+	default:
+		return nil, fmt.Errorf("unknown message type %d", body[0])
+	}
+	if err := msgpack.Unmarshal(body[frameHeaderSize:], v); err != nil {
+		return nil, fmt.Errorf("decoding %s message: %w", message.Type, err)
+	}
+	return message, nil
+}
+
+// Dial opens the stream from a producer, sending hello and waiting for the
+// consumer to accept it. The returned Encoder batches messages as hello asks,
+// with the compression the consumer picked.
+func Dial(conn io.ReadWriter, hello Hello) (*HelloAck, *Encoder, *Decoder, error) {
+	hello.Version = ProtocolVersion
+	encoder := NewEncoder(conn)
+	decoder := NewDecoder(conn)
+	if err := encoder.Encode(MsgHello, 0, &hello); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	message, err := decoder.Decode()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("waiting for hello-ack: %w", err)
+	}
+	if message.Type != MsgHelloAck {
+		return nil, nil, nil, fmt.Errorf("expected hello-ack, got %s", message.Type)
+	}
+	if message.HelloAck.Error != "" {
+		return nil, nil, nil, fmt.Errorf("%w: %s", ErrRefused, message.HelloAck.Error)
+	}
+	if err := encoder.setBatching(hello.Batch, message.HelloAck.Compression); err != nil {
+		return nil, nil, nil, err
+	}
+	return message.HelloAck, encoder, decoder, nil
+}
+
+// Accept opens the stream on the consumer's side, refusing producers that
+// speak another version of the protocol. acked is called with the producer's
+// hello to find the highest sequence number already acknowledged on its
+// stream, and the producer is refused if it returns an error.
+func Accept(conn io.ReadWriter, acked func(*Hello) (uint64, error)) (*Hello, *Encoder, *Decoder, error) {
+	encoder := NewEncoder(conn)
+	decoder := NewDecoder(conn)
+	message, err := decoder.Decode()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("waiting for hello: %w", err)
+	}
+	if message.Type != MsgHello {
+		return nil, nil, nil, fmt.Errorf("expected hello, got %s", message.Type)
+	}
+
+	hello := message.Hello
+	ack := HelloAck{Version: ProtocolVersion}
+	if hello.Version != ProtocolVersion {
+		ack.Error = fmt.Sprintf("protocol version %d is not supported, expected %d", hello.Version, ProtocolVersion)
+	} else if seq, err := acked(hello); err != nil {
+		ack.Error = err.Error()
+	} else {
+		ack.Acked = seq
+		ack.Compression = pickCompression(hello.Compression)
+	}
+	if err := encoder.Encode(MsgHelloAck, 0, &ack); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, nil, nil, err
+	}
+	if ack.Error != "" {
+		return nil, nil, nil, fmt.Errorf("%s: %s", hello.Producer, ack.Error)
+	}
+	if decoder.codec, err = newCodec(ack.Compression, maxBatchSize); err != nil {
+		return nil, nil, nil, err
+	}
+	return hello, encoder, decoder, nil
 }
@@ -0,0 +1,349 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A record file freezes a page stream so it can be replayed without the
+// producer. It holds the same frames as a connection: after an 8 byte magic
+// comes the producer's Hello frame, then blocks of the sequenced frames it
+// sent, ending with an End. Each block is a 16 byte header, giving the
+// length of its zstd compressed body, its number of frames and the sequence
+// number of the first, followed by the body. The block headers let a reader
+// seek to any sequence number without decompressing what comes before it.
+
+const recordMagic = "WXRECORD"
+
+const recordBlockHeaderSize = 4 + 4 + 8
+
+// recordBlockSize is the uncompressed size at which a block is written out, so
+// blocks are at most a frame larger.
+const recordBlockSize = 1024 * 1024
+
+// ErrIncomplete is returned when a record file ends without an End, as when
+// its writer didn't finish.
+var ErrIncomplete = errors.New("record file ends without an end of stream")
+
+// RecordWriter writes a record file. It can stand in for a Producer, with
+// messages counting as acknowledged once the block holding them is synced to
+// disk.
+type RecordWriter struct {
+	file *os.File
+	writer *bufio.Writer
+	codec codec
+	on_ack func(uint64)
+
+	block bytes.Buffer
+	frames *Encoder
+	block_count int
+	block_first uint64
+	compressed []byte
+	last uint64
+}
+
+// CreateRecordFile creates the record file at path, recording hello as the
+// producer's. on_ack, if not nil, is called with the sequence number of the
+// last message in each block synced to disk.
+func CreateRecordFile(path string, hello Hello, on_ack func(uint64)) (*RecordWriter, error) {
+	codec, err := newCodec(CompressionZstd, recordBlockSize + maxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &RecordWriter{file: file, writer: bufio.NewWriterSize(file, 256 * 1024), codec: codec, on_ack: on_ack}
+	w.frames = NewEncoder(&w.block)
+
+	hello.Version = ProtocolVersion
+	// Batching only applies to connections
+	hello.Batch = 0
+	hello.Compression = nil
+	header := NewEncoder(w.writer)
+	w.writer.WriteString(recordMagic)
+	if err := header.Encode(MsgHello, 0, &hello); err == nil {
+		err = header.Flush()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Send records v as a message of type t, returning its sequence number.
+func (w *RecordWriter) Send(t MessageType, v any) (uint64, error) {
+	w.last++
+	if w.block_count == 0 {
+		w.block_first = w.last
+	}
+	if err := w.frames.Encode(t, w.last, v); err != nil {
+		return 0, err
+	}
+	if err := w.frames.Flush(); err != nil {
+		return 0, err
+	}
+	w.block_count++
+	if w.block.Len() >= recordBlockSize {
+		return w.last, w.flushBlock()
+	}
+	return w.last, nil
+}
+
+// Notify does nothing, as unsequenced messages only matter to a live
+// consumer.
+func (w *RecordWriter) Notify(t MessageType, v any) {}
+
+// Close ends the stream and closes the file.
+func (w *RecordWriter) Close() error {
+	if _, err := w.Send(MsgEnd, &End{Messages: int64(w.last)}); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.flushBlock(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// Last returns the sequence number of the last message recorded.
+func (w *RecordWriter) Last() uint64 {
+	return w.last
+}
+
+func (w *RecordWriter) flushBlock() error {
+	if w.block_count == 0 {
+		return nil
+	}
+	w.compressed = w.codec.compress(w.compressed[:0], w.block.Bytes())
+	var header [recordBlockHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:], uint32(len(w.compressed)))
+	binary.BigEndian.PutUint32(header[4:], uint32(w.block_count))
+	binary.BigEndian.PutUint64(header[8:], w.block_first)
+	w.writer.Write(header[:])
+	w.writer.Write(w.compressed)
+	w.block.Reset()
+	w.block_count = 0
+
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	if w.on_ack != nil {
+		w.on_ack(w.last)
+	}
+	return nil
+}
+
+// RecordReader reads a record file.
+type RecordReader struct {
+	file *os.File
+	reader *bufio.Reader
+	codec codec
+	hello *Hello
+	// start is the offset of the first block
+	start int64
+
+	compressed []byte
+	block []byte
+	// frames holds the frames left in the block being read
+	frames []byte
+	ended bool
+	blocks []recordBlock
+}
+
+type recordBlock struct {
+	offset int64
+	first uint64
+	count uint32
+}
+
+// OpenRecordFile opens the record file at path, reading the producer's
+// Hello.
+func OpenRecordFile(path string) (*RecordReader, error) {
+	codec, err := newCodec(CompressionZstd, recordBlockSize + maxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &RecordReader{file: file, reader: bufio.NewReaderSize(file, 256 * 1024), codec: codec}
+	if err := r.readHeader(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+func (r *RecordReader) readHeader() error {
+	var head [len(recordMagic) + 4]byte
+	if _, err := io.ReadFull(r.reader, head[:]); err != nil {
+		return err
+	}
+	if string(head[:len(recordMagic)]) != recordMagic {
+		return errors.New("not a record file")
+	}
+	size := binary.BigEndian.Uint32(head[len(recordMagic):])
+	if size < frameHeaderSize || size > maxFrameSize {
+		return fmt.Errorf("invalid header length %d", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, body); err != nil {
+		return err
+	}
+	message, err := decodeBody(body)
+	if err != nil {
+		return err
+	}
+	if message.Type != MsgHello {
+		return fmt.Errorf("expected hello, got %s", message.Type)
+	}
+	if message.Hello.Version != ProtocolVersion {
+		return fmt.Errorf("recorded with protocol version %d, expected %d", message.Hello.Version, ProtocolVersion)
+	}
+	r.hello = message.Hello
+	r.start = int64(len(head)) + int64(size)
+	return nil
+}
+
+// Hello returns the Hello of the producer that made the recording.
+func (r *RecordReader) Hello() *Hello {
+	return r.hello
+}
+
+// Read returns the next recorded message. After the End it returns io.EOF,
+// and if the file ends without one, ErrIncomplete.
+func (r *RecordReader) Read() (*Message, error) {
+	for len(r.frames) == 0 {
+		if r.ended {
+			return nil, io.EOF
+		}
+		if err := r.readBlock(); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrIncomplete
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	body, rest, err := splitFrame(r.frames)
+	if err != nil {
+		return nil, err
+	}
+	r.frames = rest
+	message, err := decodeBody(body)
+	if err != nil {
+		return nil, err
+	}
+	if message.Type == MsgEnd {
+		r.ended = true
+		r.frames = nil
+	}
+	return message, nil
+}
+
+// Seek makes the next Read return the message with sequence number seq, or
+// the End if there are fewer.
+func (r *RecordReader) Seek(seq uint64) error {
+	if r.blocks == nil {
+		if err := r.scanBlocks(); err != nil {
+			return err
+		}
+	}
+	if len(r.blocks) == 0 {
+		return ErrIncomplete
+	}
+	i := 0
+	for i + 1 < len(r.blocks) && r.blocks[i + 1].first <= seq {
+		i++
+	}
+	if _, err := r.file.Seek(r.blocks[i].offset, io.SeekStart); err != nil {
+		return err
+	}
+	r.reader.Reset(r.file)
+	r.ended = false
+	if err := r.readBlock(); err != nil {
+		return err
+	}
+
+	// Skip to seq within the block, leaving at least the last frame
+	for {
+		body, rest, err := splitFrame(r.frames)
+		if err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint64(body[1:frameHeaderSize]) >= seq || len(rest) == 0 {
+			return nil
+		}
+		r.frames = rest
+	}
+}
+
+// scanBlocks finds every complete block in the file from its headers.
+func (r *RecordReader) scanBlocks() error {
+	info, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+	r.blocks = make([]recordBlock, 0)
+	offset := r.start
+	var header [recordBlockHeaderSize]byte
+	for offset + recordBlockHeaderSize <= info.Size() {
+		if _, err := r.file.ReadAt(header[:], offset); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[0:]))
+		if offset + recordBlockHeaderSize + size > info.Size() {
+			break
+		}
+		r.blocks = append(r.blocks, recordBlock{
+			offset: offset,
+			first: binary.BigEndian.Uint64(header[8:]),
+			count: binary.BigEndian.Uint32(header[4:]),
+		})
+		offset += recordBlockHeaderSize + size
+	}
+	return nil
+}
+
+func (r *RecordReader) readBlock() error {
+	var header [recordBlockHeaderSize]byte
+	if _, err := io.ReadFull(r.reader, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[0:])
+	if size > maxFrameSize {
+		return fmt.Errorf("invalid block length %d", size)
+	}
+	if cap(r.compressed) < int(size) {
+		r.compressed = make([]byte, size)
+	}
+	r.compressed = r.compressed[:size]
+	if _, err := io.ReadFull(r.reader, r.compressed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	block, err := r.codec.decompress(r.block[:0], r.compressed)
+	if err != nil {
+		return fmt.Errorf("decompressing block: %w", err)
+	}
+	r.block = block
+	r.frames = block
+	return nil
+}
+
+func (r *RecordReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// SiteInfo is the <siteinfo> block at the start of a MediaWiki XML dump,
+// describing the wiki the dump was taken from.
+type SiteInfo struct {
+	SiteName string `xml:"sitename"`
+	DBName string `xml:"dbname"`
+	Base string `xml:"base"`
+	Generator string `xml:"generator"`
+	Case string `xml:"case"`
+	Namespaces []Namespace `xml:"namespaces>namespace"`
+}
+
+type Namespace struct {
+	Key int `xml:"key,attr"`
+	Case string `xml:"case,attr"`
+	Name string `xml:",chardata"`
+}
+
+// NamespaceNames returns the names of every namespace other than the main
+// (article) namespace, which has no name.
+func (s *SiteInfo) NamespaceNames() []string {
+	names := make([]string, 0, len(s.Namespaces))
+	for _, ns := range s.Namespaces {
+		if ns.Name != "" {
+			names = append(names, ns.Name)
+		}
+	}
+	return names
+}
+
+func LoadSiteInfo(path string) (*SiteInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var site SiteInfo
+	if err := json.Unmarshal(data, &site); err != nil {
+		return nil, err
+	}
+	return &site, nil
+}
+
+func (s *SiteInfo) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
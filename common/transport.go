@@ -0,0 +1,152 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Stages of the pipeline connect over endpoints of the form unix:///path,
+// tcp://host:port or tls://host:port. A bare path is taken to be a unix
+// socket.
+
+// DefaultEndpoint is where wxindexer listens unless told otherwise.
+const DefaultEndpoint = "unix:///tmp/windexIPC.sock"
+
+// TLSFiles names the PEM files securing a tls:// endpoint. On the listening
+// side Cert and Key are required, and setting CA makes it require client
+// certificates signed by it. On the dialing side CA replaces the system roots
+// for verifying the server, and Cert and Key present a client certificate.
+type TLSFiles struct {
+	Cert string
+	Key string
+	CA string
+}
+
+// RegisterFlags adds the -tls-cert, -tls-key and -tls-ca flags to flags.
+func (t *TLSFiles) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&t.Cert, "tls-cert", "", "PEM certificate to present on tls:// endpoints")
+	flags.StringVar(&t.Key, "tls-key", "", "PEM private key for -tls-cert")
+	flags.StringVar(&t.CA, "tls-ca", "", "PEM CA certificates to verify the other end of tls:// endpoints against")
+}
+
+// Listen opens endpoint for producers to connect to.
+func Listen(endpoint string, files TLSFiles) (net.Listener, error) {
+	scheme, address, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case "unix":
+		// Left behind if the last run didn't shut down cleanly
+		os.Remove(address)
+		return net.Listen("unix", address)
+	case "tcp":
+		return net.Listen("tcp", address)
+	}
+
+	config, err := files.serverConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", address, config)
+}
+
+// Dialer returns a function connecting to endpoint, checking it and loading
+// any certificates up front so mistakes show before the first connection.
+func Dialer(endpoint string, files TLSFiles) (func() (net.Conn, error), error) {
+	scheme, address, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case "unix", "tcp":
+		return func() (net.Conn, error) {
+			return net.Dial(scheme, address)
+		}, nil
+	}
+
+	config, err := files.clientConfig(address)
+	if err != nil {
+		return nil, err
+	}
+	return func() (net.Conn, error) {
+		conn, err := tls.Dial("tcp", address, config)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}, nil
+}
+
+func parseEndpoint(endpoint string) (string, string, error) {
+	scheme, address, found := strings.Cut(endpoint, "://")
+	if !found {
+		return "unix", endpoint, nil
+	}
+	switch scheme {
+	case "unix", "tcp", "tls":
+	default:
+		return "", "", fmt.Errorf("endpoint %q: unknown scheme %q, expected unix, tcp or tls", endpoint, scheme)
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("endpoint %q: missing address", endpoint)
+	}
+	return scheme, address, nil
+}
+
+func (t TLSFiles) serverConfig() (*tls.Config, error) {
+	if t.Cert == "" || t.Key == "" {
+		return nil, errors.New("listening on a tls:// endpoint requires -tls-cert and -tls-key")
+	}
+	certificate, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if t.CA != "" {
+		if config.ClientCAs, err = loadCertPool(t.CA); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func (t TLSFiles) clientConfig(address string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if t.CA != "" {
+		if config.RootCAs, err = loadCertPool(t.CA); err != nil {
+			return nil, err
+		}
+	}
+	if t.Cert != "" || t.Key != "" {
+		certificate, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"fmt"
 	"sync"
@@ -8,7 +9,10 @@ import (
 	"container/heap"
 	"context"
 	"strings"
+	"net"
+	"net/url"
 
+	"common"
 	"wxcrawler/containers"
 	"wxcrawler/validators"
 )
@@ -20,23 +24,65 @@ type Result struct {
 }
 
 func main() {
-	startURLs := []string {
-		"https://en.wikipedia.org/wiki/Web_crawler",
-		"https://en.wikipedia.org/wiki/Presidency_of_John_Tyler",
-		"https://en.wikipedia.org/wiki/Wintjiya_Napaltjarri",
-		"https://en.wikipedia.org/wiki/Asiana_Airlines_Flight_214",
-		"https://en.wikipedia.org/wiki/Ludwig_Ahgren",
-		"https://en.wikipedia.org/wiki/14th_Dalai_Lama",
-		"https://en.wikipedia.org/wiki/Butts_for_Tour_Buses",
+	siteinfo := flag.String("siteinfo", "", "siteinfo file from `wxunpacker siteinfo`, selects the wiki's profile instead of English Wikipedia")
+	profile_path := flag.String("profile", "", "JSON profile file overriding fields of the wiki's profile")
+	addr := flag.String("addr", "", "comma separated wxindexer endpoints (unix:///path, tcp://host:port or tls://host:port) to index crawled pages on, one per shard")
+	var tls_files common.TLSFiles
+	tls_files.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	profile := common.EnglishWikipedia()
+	if *siteinfo != "" {
+		site, err := common.LoadSiteInfo(*siteinfo)
+		if err != nil {
+			log.Fatalf("Failed to load siteinfo: %v\n", err)
+		}
+		profile = common.ProfileFromSiteInfo(site)
+	}
+	if *profile_path != "" {
+		overrides, err := common.LoadProfile(*profile_path)
+		if err != nil {
+			log.Fatalf("Failed to load profile: %v\n", err)
+		}
+		profile.Merge(overrides)
+	}
+
+	// Start from the URLs given as arguments, or the wiki's main page
+	startURLs := flag.Args()
+	if len(startURLs) == 0 && profile.Name == "enwiki" {
+		startURLs = []string {
+			"https://en.wikipedia.org/wiki/Web_crawler",
+			"https://en.wikipedia.org/wiki/Presidency_of_John_Tyler",
+			"https://en.wikipedia.org/wiki/Wintjiya_Napaltjarri",
+			"https://en.wikipedia.org/wiki/Asiana_Airlines_Flight_214",
+			"https://en.wikipedia.org/wiki/Ludwig_Ahgren",
+			"https://en.wikipedia.org/wiki/14th_Dalai_Lama",
+			"https://en.wikipedia.org/wiki/Butts_for_Tour_Buses",
+		}
+	} else if len(startURLs) == 0 {
+		startURLs = []string {profile.MainPage}
 	}
 
-	var wp_vldr validators.Validator
-	var err error
-	wp_vldr, err = validators.NewWikipediaValidator()
+	wp_vldr, err := validators.NewWikipediaValidator(profile)
 	if err != nil {
 		log.Fatalf("Failed to get wikipedia validator: %v\n", err)
 	}
 
+	var page_chan chan common.PageData
+	var sender_done = make(chan struct{})
+	if *addr != "" {
+		var dials []func() (net.Conn, error)
+		for _, endpoint := range strings.Split(*addr, ",") {
+			dial, err := common.Dialer(endpoint, tls_files)
+			if err != nil {
+				log.Fatalf("Failed to set up indexer connection: %v\n", err)
+			}
+			dials = append(dials, dial)
+		}
+		page_chan = make(chan common.PageData, 100)
+		go sendPages(dials, profile, page_chan, sender_done)
+	}
+
 	var urlQueue = make(containers.PriorityQueue, len(startURLs))
 	for i, url := range startURLs {
 		urlQueue[i] = &containers.Item {
@@ -91,6 +137,10 @@ func main() {
 						continue
 					}
 
+					if page_chan != nil {
+						page_chan <- pageData(result, profile)
+					}
+
 					for link := range *result.Links {
 						seenLock.Lock()
 						if seen.Contains(link) {
@@ -120,4 +170,42 @@ func main() {
 	}()
 
 	wg.Wait()
+	if page_chan != nil {
+		close(page_chan)
+		<- sender_done
+	}
+}
+
+// sendPages streams crawled pages to wxindexer until pages is closed.
+// Crawled pages have no page ID, so they are split between shards by title.
+func sendPages(dials []func() (net.Conn, error), profile *common.WikiProfile, pages <- chan common.PageData, done chan <- struct{}) {
+	defer close(done)
+	producer, err := common.NewFanout(dials, common.Hello{Producer: "wxcrawler", Profile: profile}, 256, common.PartitionByTitle, nil)
+	if err != nil {
+		log.Fatalf("Failed to connect to indexer: %v\n", err)
+	}
+
+	for page := range pages {
+		if _, err := producer.Send(common.MsgPage, &page); err != nil {
+			log.Fatalf("Failed to send page to indexer: %v\n", err)
+		}
+	}
+	if err := producer.Close(); err != nil {
+		log.Fatalf("Failed to end stream to indexer: %v\n", err)
+	}
+}
+
+// pageData converts a scraped page for the indexer, taking its title from the
+// URL. Crawled pages have no page ID.
+func pageData(result Result, profile *common.WikiProfile) common.PageData {
+	url_title := strings.TrimPrefix(result.FromURL, profile.URLBase)
+	title := url_title
+	if unescaped, err := url.PathUnescape(url_title); err == nil {
+		title = unescaped
+	}
+	return common.PageData{
+		Title: strings.ReplaceAll(title, "_", " "),
+		URL: url_title,
+		Body: result.Text,
+	}
 }
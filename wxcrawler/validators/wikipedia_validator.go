@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"encoding/json"
 
+	"common"
 	"wxcrawler/containers"
 )
 
@@ -14,14 +15,25 @@ type WikipediaValidator struct {
 	Valid_prefix string
 }
 
-func NewWikipediaValidator() (Validator, error) {
+// NewWikipediaValidator accepts links to articles on the wiki described by
+// profile. If the profile has no namespaces, the ones to reject are fetched
+// from the wiki's API.
+func NewWikipediaValidator(profile *common.WikiProfile) (Validator, error) {
 	var v WikipediaValidator
-	var err error
-	v.Invalid_namespaces, err = get_invalid_namespaces()
-	if err != nil {
-		return nil, fmt.Errorf("Error getting invalid namespaces: %v", err)
+	v.Invalid_namespaces = containers.NewSet()
+	if len(profile.Namespaces) == 0 {
+		names, err := get_invalid_namespaces(profile.API)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting invalid namespaces: %v", err)
+		}
+		for _, name := range names {
+			v.Invalid_namespaces.Add(normalizeNamespace(name))
+		}
 	}
-	v.Valid_prefix = "https://en.wikipedia.org/wiki/"
+	for _, name := range profile.AllNamespaceNames() {
+		v.Invalid_namespaces.Add(normalizeNamespace(name))
+	}
+	v.Valid_prefix = profile.URLBase
 	return &v, nil
 }
 
@@ -33,7 +45,7 @@ func (v *WikipediaValidator) Validate(link string) bool {
 	page_name := strings.TrimPrefix(link, v.Valid_prefix)
 	parts := strings.Split(page_name, ":")
 	if len(parts) > 1 {
-		if v.Invalid_namespaces.Contains(parts[0]) {
+		if v.Invalid_namespaces.Contains(normalizeNamespace(parts[0])) {
 			return false
 		}
 	}
@@ -41,12 +53,18 @@ func (v *WikipediaValidator) Validate(link string) bool {
 	return true
 }
 
-func get_invalid_namespaces() (*containers.Set, error) {
-	url := "https://en.wikipedia.org/w/api.php?action=query&meta=siteinfo&siprop=namespaces&format=json"
+// normalizeNamespace puts a namespace name in the form used for lookups, as
+// namespace names are case insensitive and URLs use underscores for spaces.
+func normalizeNamespace(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", " "))
+}
+
+func get_invalid_namespaces(api string) ([]string, error) {
+	url := api + "?action=query&meta=siteinfo&siprop=namespaces&format=json"
 
 	resp, err := http.Get(url)
 	if err != nil {
-		return nil, fmt.Errorf("Error fetching wikipedia namespaces: %v", err)
+		return nil, fmt.Errorf("Error fetching wiki namespaces: %v", err)
 	}
 	defer resp.Body.Close()
 
@@ -65,11 +83,11 @@ func get_invalid_namespaces() (*containers.Set, error) {
 		return nil, fmt.Errorf("Expected 'namespaces' key in namespaces JSON: %v", err)
 	}
 
-	invalid_namespaces := containers.NewSet()
+	invalid_namespaces := make([]string, 0, len(namespaces))
 	for _, namespace := range namespaces {
 		if nsMap, ok := namespace.(map[string]any); ok {
 			if name, exists := nsMap["*"]; exists && name != "" {
-				invalid_namespaces.Add(name.(string))
+				invalid_namespaces = append(invalid_namespaces, name.(string))
 				fmt.Printf("Found invalid namespace: %s\n", name)
 			}
 		}
@@ -0,0 +1,100 @@
+package analyzer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+
+	"common"
+	"wxindexer/containers"
+	"wxindexer/tokenizer"
+)
+
+// Analyzer turns text into the terms that are counted and looked up:
+// tokenizing it, dropping stopwords and stemming what's left, so "running"
+// and "runs" are both "run". Queries have to be analyzed by an Analyzer with
+// the same ID as the one that built the index they are run against.
+type Analyzer struct {
+	tokenizer *tokenizer.Tokenizer
+	stopwords *containers.Set[string]
+	stemmer Stemmer
+	stemmer_name string
+	stopwords_id string
+}
+
+// New builds the analyzer for the wiki described by profile, using the
+// stemmer it names or the default one for its language.
+func New(profile *common.WikiProfile, stopwords *containers.Set[string]) (*Analyzer, error) {
+	name, stemmer, err := lookupStemmer(profile.Stemmer, profile.Language)
+	if err != nil {
+		return nil, err
+	}
+	tok := tokenizer.New(profile)
+
+	// Stopwords are matched against tokens, before stemming
+	normalized := containers.NewSet[string]()
+	for word := range *stopwords {
+		if token := tok.Normalize(word); token != "" {
+			normalized.Add(token)
+		}
+	}
+
+	return &Analyzer{
+		tokenizer: tok,
+		stopwords: normalized,
+		stemmer: stemmer,
+		stemmer_name: name,
+		stopwords_id: stopwordsID(normalized),
+	}, nil
+}
+
+// stopwordsID identifies a stopword list by a hash of its words, or is
+// "none" for an empty list.
+func stopwordsID(stopwords *containers.Set[string]) string {
+	if len(*stopwords) == 0 {
+		return "none"
+	}
+	words := make([]string, 0, len(*stopwords))
+	for word := range *stopwords {
+		words = append(words, word)
+	}
+	slices.Sort(words)
+	sum := sha256.Sum256([]byte(strings.Join(words, "\n")))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Terms returns the terms of text in order.
+func (a *Analyzer) Terms(text string) []string {
+	tokens := a.tokenizer.Tokens(text)
+	terms := tokens[:0]
+	for _, token := range tokens {
+		if !a.stopwords.Contains(token) {
+			terms = append(terms, a.stemmer.Stem(token))
+		}
+	}
+	return terms
+}
+
+// Positions returns the terms of text in order along with the position of
+// each, which counts the stopwords left out so phrases don't match across
+// them.
+func (a *Analyzer) Positions(text string) ([]string, []int) {
+	tokens := a.tokenizer.Tokens(text)
+	terms := tokens[:0]
+	positions := make([]int, 0, len(tokens))
+	for i, token := range tokens {
+		if !a.stopwords.Contains(token) {
+			terms = append(terms, a.stemmer.Stem(token))
+			positions = append(positions, i)
+		}
+	}
+	return terms, positions
+}
+
+// ID identifies how the analyzer turns text into terms, e.g.
+// "unicode/english/stop=1f2e3d4c" for its tokenizer, stemmer and stopword
+// list. Indexes record the ID of the analyzer that built them.
+func (a *Analyzer) ID() string {
+	return a.tokenizer.Name() + "/" + a.stemmer_name + "/stop=" + a.stopwords_id
+}
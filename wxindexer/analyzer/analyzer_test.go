@@ -0,0 +1,79 @@
+package analyzer
+
+import (
+	"reflect"
+	"testing"
+
+	"common"
+	"wxindexer/containers"
+)
+
+func newTestAnalyzer(t *testing.T, profile *common.WikiProfile, stopwords []string) *Analyzer {
+	a, err := New(profile, containers.SetFromSlice(stopwords))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestStopwordsNormalized(t *testing.T) {
+	// Stopwords are tokenized like text, so they match however the list
+	// writes them, and ones that are only punctuation are dropped
+	a := newTestAnalyzer(t, common.EnglishWikipedia(), []string{"The", "A", "...", "Einstein's"})
+	terms, positions := a.Positions("The walruses and a seal saw EINSTEIN running")
+	if want := []string{"walrus", "and", "seal", "saw", "run"}; !reflect.DeepEqual(terms, want) {
+		t.Errorf("Positions gave terms %q, want %q", terms, want)
+	}
+	if want := []int{1, 2, 4, 5, 7}; !reflect.DeepEqual(positions, want) {
+		t.Errorf("Positions gave positions %v, want %v", positions, want)
+	}
+	if terms := a.Terms("the A einstein's"); len(terms) != 0 {
+		t.Errorf("Terms kept %q", terms)
+	}
+}
+
+func TestID(t *testing.T) {
+	english := common.EnglishWikipedia()
+	id := newTestAnalyzer(t, english, []string{"the", "a", "einstein"}).ID()
+	if want := "unicode/english/stop=c38b54c4"; id != want {
+		t.Errorf("ID() = %q, want %q", id, want)
+	}
+
+	// Lists that normalize to the same stopwords, in any order, are the same
+	for _, stopwords := range [][]string{
+		{"einstein", "a", "the"},
+		{"The", "A", "Einstein's", "...", "the"},
+	} {
+		if other := newTestAnalyzer(t, english, stopwords).ID(); other != id {
+			t.Errorf("stopwords %q gave ID %q, want %q", stopwords, other, id)
+		}
+	}
+
+	tests := []struct {
+		name string
+		profile *common.WikiProfile
+		stopwords []string
+		want string
+	}{
+		{"no stopwords", english, nil, "unicode/english/stop=none"},
+		{"only punctuation", english, []string{"..."}, "unicode/english/stop=none"},
+		{"other stopwords", english, []string{"the", "a"}, "unicode/english/stop=" + stopwordsID(containers.SetFromSlice([]string{"a", "the"}))},
+		{"stemmer named", &common.WikiProfile{Language: "en", Stemmer: "porter"}, nil, "unicode/porter/stop=none"},
+		{"language without a stemmer", &common.WikiProfile{Language: "ja"}, nil, "unicode/none/stop=none"},
+		{"folded accents", &common.WikiProfile{Language: "fr", FoldAccents: true}, nil, "unicode+fold-accents/french/stop=none"},
+	}
+	for _, test := range tests {
+		if got := newTestAnalyzer(t, test.profile, test.stopwords).ID(); got != test.want {
+			t.Errorf("%s: ID() = %q, want %q", test.name, got, test.want)
+		}
+	}
+	if other := newTestAnalyzer(t, english, []string{"the", "a"}).ID(); other == id {
+		t.Errorf("different stopwords gave the same ID %q", id)
+	}
+}
+
+func TestUnknownStemmer(t *testing.T) {
+	if _, err := New(&common.WikiProfile{Stemmer: "klingon"}, containers.NewSet[string]()); err == nil {
+		t.Errorf("New accepted an unknown stemmer")
+	}
+}
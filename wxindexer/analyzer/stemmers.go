@@ -0,0 +1,135 @@
+package analyzer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/blevesearch/snowballstem"
+	"github.com/blevesearch/snowballstem/arabic"
+	"github.com/blevesearch/snowballstem/danish"
+	"github.com/blevesearch/snowballstem/dutch"
+	"github.com/blevesearch/snowballstem/english"
+	"github.com/blevesearch/snowballstem/finnish"
+	"github.com/blevesearch/snowballstem/french"
+	"github.com/blevesearch/snowballstem/german"
+	"github.com/blevesearch/snowballstem/hungarian"
+	"github.com/blevesearch/snowballstem/italian"
+	"github.com/blevesearch/snowballstem/norwegian"
+	"github.com/blevesearch/snowballstem/porter"
+	"github.com/blevesearch/snowballstem/portuguese"
+	"github.com/blevesearch/snowballstem/romanian"
+	"github.com/blevesearch/snowballstem/russian"
+	"github.com/blevesearch/snowballstem/spanish"
+	"github.com/blevesearch/snowballstem/swedish"
+	"github.com/blevesearch/snowballstem/turkish"
+)
+
+// A Stemmer reduces a term to its stem. It must be safe for concurrent use.
+type Stemmer interface {
+	Stem(term string) string
+}
+
+// StemmerNone leaves terms as they are.
+const StemmerNone = "none"
+
+type noStemmer struct{}
+
+func (noStemmer) Stem(term string) string {
+	return term
+}
+
+// snowballStemmer runs one of the Snowball project's stemmers.
+type snowballStemmer func(*snowballstem.Env) bool
+
+func (s snowballStemmer) Stem(term string) string {
+	env := snowballstem.NewEnv(term)
+	s(env)
+	return env.Current()
+}
+
+var (
+	stemmers_mu sync.RWMutex
+	stemmers = map[string]Stemmer{
+		StemmerNone: noStemmer{},
+		// english is Porter2, porter the original algorithm
+		"english": snowballStemmer(english.Stem),
+		"porter": snowballStemmer(porter.Stem),
+		"arabic": snowballStemmer(arabic.Stem),
+		"danish": snowballStemmer(danish.Stem),
+		"dutch": snowballStemmer(dutch.Stem),
+		"finnish": snowballStemmer(finnish.Stem),
+		"french": snowballStemmer(french.Stem),
+		"german": snowballStemmer(german.Stem),
+		"hungarian": snowballStemmer(hungarian.Stem),
+		"italian": snowballStemmer(italian.Stem),
+		"norwegian": snowballStemmer(norwegian.Stem),
+		"portuguese": snowballStemmer(portuguese.Stem),
+		"romanian": snowballStemmer(romanian.Stem),
+		"russian": snowballStemmer(russian.Stem),
+		"spanish": snowballStemmer(spanish.Stem),
+		"swedish": snowballStemmer(swedish.Stem),
+		"turkish": snowballStemmer(turkish.Stem),
+	}
+)
+
+// languageStemmers names the stemmer used by default for a wiki's language.
+// Wikis in other languages aren't stemmed unless their profile picks a
+// stemmer.
+var languageStemmers = map[string]string{
+	"en": "english",
+	"ar": "arabic",
+	"da": "danish",
+	"nl": "dutch",
+	"fi": "finnish",
+	"fr": "french",
+	"de": "german",
+	"hu": "hungarian",
+	"it": "italian",
+	"no": "norwegian",
+	"nb": "norwegian",
+	"pt": "portuguese",
+	"ro": "romanian",
+	"ru": "russian",
+	"es": "spanish",
+	"sv": "swedish",
+	"tr": "turkish",
+}
+
+// Register makes stemmer available under name, replacing any registered
+// before.
+func Register(name string, stemmer Stemmer) {
+	stemmers_mu.Lock()
+	defer stemmers_mu.Unlock()
+	stemmers[name] = stemmer
+}
+
+// StemmerNames returns the names of the registered stemmers.
+func StemmerNames() []string {
+	stemmers_mu.RLock()
+	defer stemmers_mu.RUnlock()
+	names := make([]string, 0, len(stemmers))
+	for name := range stemmers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupStemmer returns the stemmer called name, or if name is "" the
+// default one for language, along with the name it goes by.
+func lookupStemmer(name string, language string) (string, Stemmer, error) {
+	if name == "" {
+		name = languageStemmers[language]
+		if name == "" {
+			name = StemmerNone
+		}
+	}
+	stemmers_mu.RLock()
+	defer stemmers_mu.RUnlock()
+	stemmer, found := stemmers[name]
+	if !found {
+		return "", nil, fmt.Errorf("unknown stemmer %q", name)
+	}
+	return name, stemmer, nil
+}
@@ -5,5 +5,5 @@ import (
 )
 
 type Cleaner interface {
-	Clean(text string) containers.Doc
+	Clean(title string, text string) containers.Doc
 }
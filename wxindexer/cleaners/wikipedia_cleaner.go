@@ -4,115 +4,248 @@ import (
 	"regexp"
 	"strings"
 	"fmt"
+	"html"
 	"net/http"
 	"net/url"
 	"encoding/json"
 	"io"
+	"unicode"
+	"unicode/utf8"
+	"common"
 	"wxindexer/containers"
 )
 
-var (
-	reLinkExtract        = regexp.MustCompile(`\[\[([^\|\]]+)`)
-	reRefTag             = regexp.MustCompile(`(?s)<ref[^>]*?>.*?</ref>`)
-	reSelfClosingRef     = regexp.MustCompile(`(?s)<ref[^>]*/>`)
-	reTemplate           = regexp.MustCompile(`(?s)\{\{.*?\}\}`)
-	reTable              = regexp.MustCompile(`(?s)\{\|.*?\|\}`)
-	reFileLink           = regexp.MustCompile(`\[\[File:[^\]]*\]\]`)
-	reImageLink          = regexp.MustCompile(`\[\[Image:[^\]]*\]\]`)
-	reCategory           = regexp.MustCompile(`\[\[Category:[^\]]*\]\]`)
-	reInternalLink       = regexp.MustCompile(`\[\[([^\|\]]*\|)?([^\]]+)\]\]`)
-	reExternalLink       = regexp.MustCompile(`\[(https?://[^\s\]]+)(\s+[^\]]+)?\]`)
-	reHTMLComment        = regexp.MustCompile(`(?s)<!--.*?-->`)
-	reHTMLTag            = regexp.MustCompile(`</?[a-zA-Z]+.*?>`)
-	reBoldItalic         = regexp.MustCompile(`'''''(.*?)'''''`)
-	reBold               = regexp.MustCompile(`'''(.*?)'''`)
-	reItalic             = regexp.MustCompile(`''(.*?)''`)
-	reQuotes             = regexp.MustCompile(`"(.*?)"`)
-	reNonAlphanumeric    = regexp.MustCompile(`[^a-zA-Z0-9\s]+`)
-	reExtraWhitespace    = regexp.MustCompile(`[ \t]+`)
-	reWhitespaceLines    = regexp.MustCompile(`(?m)^[ \t\r\f\v]+$`)
-	reMultipleNewlines   = regexp.MustCompile(`\n`)
-	reRedirect 			 = regexp.MustCompile(`^#REDIRECT \[\[(.*?)\]\]`)
-	invalidPrefixes      = get_invalid_namespaces()
-)
+// hiddenTags hold content that isn't prose, such as formulas and the
+// rendered list of references.
+var hiddenTags = map[string]bool{
+	"math": true, "chem": true, "ce": true, "score": true, "timeline": true,
+	"graph": true, "templatedata": true, "mapframe": true, "maplink": true,
+	"gallery": true, "imagemap": true, "hiero": true, "inputbox": true,
+	"categorytree": true, "references": true,
+}
 
-type WikipediaCleaner struct {}
+// blockTags separate what comes before and after them, where the text of
+// other tags runs on, as in "H<sub>2</sub>O".
+var blockTags = map[string]bool{
+	"br": true, "hr": true, "p": true, "div": true, "center": true,
+	"blockquote": true, "poem": true, "ul": true, "ol": true, "li": true,
+	"dl": true, "dt": true, "dd": true, "table": true, "caption": true,
+	"tr": true, "th": true, "td": true,
+}
 
-func NewWikipediaCleaner() Cleaner {
-	var c WikipediaCleaner
-	return &c
+type WikipediaCleaner struct {
+	invalidPrefixes *containers.Set[string]
+	reRedirect *regexp.Regexp
+	// hiddenPrefixes are the names of the File and Category namespaces, links
+	// into which show no text
+	hiddenPrefixes *containers.Set[string]
+	// firstLetter is set if the wiki capitalises the first letter of titles
+	firstLetter bool
 }
 
-func (v *WikipediaCleaner) Clean(text string) containers.Doc {
+// NewWikipediaCleaner builds a cleaner for the wiki described by profile. If
+// the profile has no namespaces, they are fetched from the wiki's API and
+// stored in the profile.
+func NewWikipediaCleaner(profile *common.WikiProfile) Cleaner {
+	if len(profile.Namespaces) == 0 {
+		profile.Namespaces = get_namespaces(profile.API)
+	}
 
-	// Check for a redirect page
-	if redirect_text := reRedirect.FindStringSubmatch(text); len(redirect_text) > 1 {
-		redirect_link := url.PathEscape(strings.ReplaceAll(redirect_text[1], " ", "_"))
-		return containers.Doc{Body: nil, Links: nil, Redirect: &redirect_link}
+	invalid_prefixes := containers.NewSet[string]()
+	for _, name := range profile.AllNamespaceNames() {
+		invalid_prefixes.Add(normalizeNamespace(name))
+	}
+	hidden_prefixes := containers.NewSet[string]()
+	for _, name := range profile.NamespaceNames(common.NamespaceFile) {
+		hidden_prefixes.Add(normalizeNamespace(name))
+	}
+	for _, name := range profile.NamespaceNames(common.NamespaceCategory) {
+		hidden_prefixes.Add(normalizeNamespace(name))
 	}
 
-	var links []string
-	linkSet := make(map[string]bool)
+	return &WikipediaCleaner{
+		invalidPrefixes: invalid_prefixes,
+		reRedirect: redirectRegexp(profile.RedirectWords),
+		hiddenPrefixes: hidden_prefixes,
+		firstLetter: profile.Case != "case-sensitive",
+	}
+}
 
-	entity_replacements := map[string]string{
-		"&nbsp;": " ", "&amp;": " ", "&lt;": " ", "&gt;": " ", "&quot;": "",
+// redirectRegexp matches a redirect using any of the wiki's magic words,
+// which MediaWiki treats case insensitively, e.g. "#REDIRECT [[Target]]".
+func redirectRegexp(words []string) *regexp.Regexp {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		quoted = append(quoted, regexp.QuoteMeta(word))
 	}
+	return regexp.MustCompile(`(?i)^\s*(?:` + strings.Join(quoted, "|") + `)\s*:?\s*\[\[(.*?)\]\]`)
+}
 
-	// find and save all links
-	matches := reLinkExtract.FindAllStringSubmatch(text, -1)
-	for _, match := range matches {
-		link := strings.TrimSpace(match[1])
-		parts := strings.Split(link, ":")
-		if link != "" && !linkSet[link] && (len(parts) <= 1 || !invalidPrefixes.Contains(parts[0])){
-			link = url.PathEscape(strings.ReplaceAll(link, " ", "_"))
-			linkSet[link] = true
+// normalizeNamespace puts a namespace name in the form used for lookups, as
+// namespace names are case insensitive and may use underscores for spaces.
+func normalizeNamespace(name string) string {
+	return strings.ToLower(strings.TrimSpace(strings.ReplaceAll(name, "_", " ")))
+}
+
+func (v *WikipediaCleaner) Clean(title string, text string) containers.Doc {
+
+	// Check for a redirect page
+	if redirect_text := v.reRedirect.FindStringSubmatch(text); len(redirect_text) > 1 {
+		redirect_link := v.titleURL(redirect_text[1])
+		fields := map[containers.Field]string{containers.FieldRedirects: title}
+		return containers.Doc{Fields: fields, Links: nil, Redirect: &redirect_link}
+	}
+
+	doc := ParseWikitext(text)
+
+	// Links anywhere on the page count, including those in templates and
+	// references. Their text describes the page they lead to, so it is kept
+	// by link rather than as part of this page.
+	links := make([]string, 0)
+	anchors := make(map[string]*strings.Builder)
+	walkNodes(doc.Children, func(node *Node) {
+		if node.Kind != NodeLink {
+			return
+		}
+		link, ok := v.pageLink(node.Text)
+		if !ok {
+			return
+		}
+		anchor, found := anchors[link]
+		if !found {
+			anchor = &strings.Builder{}
+			anchors[link] = anchor
 			links = append(links, link)
 		}
+		v.writeText(anchor, []*Node{node})
+		anchor.WriteByte('\n')
+	})
+	anchor_text := make(map[string]string, len(anchors))
+	for link, anchor := range anchors {
+		if text := collapseSpace(anchor.String()); text != "" {
+			anchor_text[link] = text
+		}
 	}
 
-	// remove metadata junk
-	text = reRefTag.ReplaceAllString(text, "")
-	text = reSelfClosingRef.ReplaceAllString(text, "")
-	text = reTemplate.ReplaceAllString(text, "")
-	text = reTable.ReplaceAllString(text, "")
-	text = reFileLink.ReplaceAllString(text, "")
-	text = reImageLink.ReplaceAllString(text, "")
-	text = reCategory.ReplaceAllString(text, "")
-	text = reInternalLink.ReplaceAllString(text, "$2")
-	text = reExternalLink.ReplaceAllString(text, "$2")
-	text = reHTMLComment.ReplaceAllString(text, "")
-	text = reHTMLTag.ReplaceAllString(text, "")
+	var headings, lead, body strings.Builder
+	for i, node := range doc.Children {
+		if node.Kind == NodeSection {
+			v.writeSections(&headings, &body, doc.Children[i:])
+			break
+		}
+		v.writeText(&lead, []*Node{node})
+	}
 
-	// remove formatting
-	text = reBoldItalic.ReplaceAllString(text, "$1")
-	text = reBold.ReplaceAllString(text, "$1")
-	text = reItalic.ReplaceAllString(text, "$1")
-	text = reQuotes.ReplaceAllString(text, "$1")
+	// The text is left for the tokenizer to split into terms
+	fields := map[containers.Field]string{
+		containers.FieldTitle: title,
+		containers.FieldHeadings: collapseSpace(headings.String()),
+		containers.FieldLead: collapseSpace(lead.String()),
+		containers.FieldBody: collapseSpace(body.String()),
+	}
+	return containers.Doc{Fields: fields, Links: &links, Anchors: anchor_text, Redirect: nil}
+}
 
-	// Remove unwanted HTML entities
-	for k, v := range entity_replacements {
-		text = strings.ReplaceAll(text, k, v)
+// writeSections writes the headings of sections and the sections within them
+// to headings, and the rest of their text to body.
+func (v *WikipediaCleaner) writeSections(headings *strings.Builder, body *strings.Builder, sections []*Node) {
+	for _, node := range sections {
+		if node.Kind != NodeSection {
+			v.writeText(body, []*Node{node})
+			continue
+		}
+		v.writeText(headings, node.Title)
+		headings.WriteByte('\n')
+		v.writeSections(headings, body, node.Children)
 	}
+}
 
-	// Remove any remaining non-alphanumeric characters
-	text = reNonAlphanumeric.ReplaceAllString(text, "")
+func collapseSpace(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
 
-	// Remove excessive whitespace
-	text = reExtraWhitespace.ReplaceAllString(text, " ")
-	text = reWhitespaceLines.ReplaceAllString(text, "")
-	text = reMultipleNewlines.ReplaceAllString(text, "")
+// pageLink returns the URL of the article a link target points to, if it
+// points to one.
+func (v *WikipediaCleaner) pageLink(target string) (string, bool) {
+	target, _, _ = strings.Cut(target, "#")
+	target = strings.TrimSpace(strings.TrimPrefix(target, ":"))
+	if target == "" {
+		return "", false
+	}
+	if prefix, _, found := strings.Cut(target, ":"); found && v.invalidPrefixes.Contains(normalizeNamespace(prefix)) {
+		return "", false
+	}
+	return v.titleURL(target), true
+}
 
-	// Lowercase everything
-	text = strings.ToLower(text)
+// titleURL returns the URL of the page with title, normalised as MediaWiki
+// does: with runs of spaces and underscores as one, and with the first letter
+// capitalised unless the wiki's titles are case-sensitive.
+func (v *WikipediaCleaner) titleURL(title string) string {
+	title = strings.Join(strings.Fields(strings.ReplaceAll(title, "_", " ")), " ")
+	if v.firstLetter && title != "" {
+		r, size := utf8.DecodeRuneInString(title)
+		title = string(unicode.ToUpper(r)) + title[size:]
+	}
+	return url.PathEscape(strings.ReplaceAll(title, " ", "_"))
+}
 
-	text = strings.TrimSpace(text)
+// writeText writes the text a reader would see of nodes, leaving out
+// templates, references, comments, and files and categories, which are
+// shown apart from the prose.
+func (v *WikipediaCleaner) writeText(out *strings.Builder, nodes []*Node) {
+	for _, node := range nodes {
+		switch node.Kind {
+		case NodeText:
+			out.WriteString(html.UnescapeString(node.Text))
+		case NodeSection:
+			v.writeText(out, node.Title)
+			out.WriteByte('\n')
+			v.writeText(out, node.Children)
+		case NodeParagraph, NodeTable, NodeCell:
+			v.writeText(out, node.Children)
+			out.WriteByte('\n')
+		case NodeLink:
+			// A leading colon links to a file or category instead of
+			// including it
+			prefix, _, found := strings.Cut(node.Text, ":")
+			if found && v.hiddenPrefixes.Contains(normalizeNamespace(prefix)) {
+				continue
+			}
+			if node.Children == nil {
+				out.WriteString(strings.TrimPrefix(node.Text, ":"))
+			} else {
+				v.writeText(out, node.Children)
+			}
+		case NodeExternalLink:
+			v.writeText(out, node.Children)
+		case NodeTag:
+			if hiddenTags[node.Text] {
+				continue
+			}
+			if blockTags[node.Text] {
+				out.WriteByte('\n')
+			}
+			v.writeText(out, node.Children)
+			if blockTags[node.Text] {
+				out.WriteByte('\n')
+			}
+		}
+	}
+}
 
-	return containers.Doc{Body: &text, Links: &links, Redirect: nil}
+// walkNodes calls visit on every node in the trees rooted at nodes.
+func walkNodes(nodes []*Node, visit func(*Node)) {
+	for _, node := range nodes {
+		visit(node)
+		walkNodes(node.Title, visit)
+		walkNodes(node.Children, visit)
+	}
 }
 
-func get_invalid_namespaces() *containers.Set[string] {
-	fmt.Println("wxindexer/cleaner: fetching invalid namespaces")
-	url := "https://en.wikipedia.org/w/api.php?action=query&meta=siteinfo&siprop=namespaces&format=json"
+func get_namespaces(api string) []common.Namespace {
+	fmt.Println("wxindexer/cleaner: fetching namespaces from", api)
+	url := api + "?action=query&meta=siteinfo&siprop=namespaces&format=json"
 
 	client := &http.Client{}
 	req, err := http.NewRequest("GET", url, nil)
@@ -148,14 +281,15 @@ func get_invalid_namespaces() *containers.Set[string] {
 		panic(fmt.Errorf("Expected 'namespaces' key in namespaces JSON: %s", query))
 	}
 
-	invalid_namespaces := containers.NewSet[string]()
+	result := make([]common.Namespace, 0, len(namespaces))
 	for _, namespace := range namespaces {
 		if nsMap, ok := namespace.(map[string]any); ok {
-			if name, exists := nsMap["*"]; exists && name != "" {
-				invalid_namespaces.Add(name.(string))
-			}
+			id, _ := nsMap["id"].(float64)
+			name, _ := nsMap["*"].(string)
+			ns_case, _ := nsMap["case"].(string)
+			result = append(result, common.Namespace{Key: int(id), Case: ns_case, Name: name})
 		}
 	}
 
-	return invalid_namespaces
+	return result
 }
@@ -0,0 +1,201 @@
+package cleaners
+
+import (
+	"reflect"
+	"testing"
+
+	"common"
+	"wxindexer/containers"
+)
+
+// testCleaner returns a cleaner for English Wikipedia with its namespaces
+// given, so none are fetched.
+func testCleaner() Cleaner {
+	return testCleanerWithCase("first-letter")
+}
+
+func testCleanerWithCase(title_case string) Cleaner {
+	profile := common.EnglishWikipedia()
+	profile.Case = title_case
+	profile.Namespaces = []common.Namespace{
+		{Key: 0, Name: ""},
+		{Key: 1, Name: "Talk"},
+		{Key: 6, Name: "File"},
+		{Key: 10, Name: "Template"},
+		{Key: 14, Name: "Category"},
+	}
+	return NewWikipediaCleaner(profile)
+}
+
+func TestWikipediaCleanerClean(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		// fields are compared for the fields given only
+		fields map[containers.Field]string
+		links []string
+		// anchors are compared if given
+		anchors map[string]string
+	}{
+		{
+			name: "lead only",
+			text: "The '''walrus''' is a large\nmarine mammal.\n\nIt eats clams.",
+			fields: map[containers.Field]string{
+				containers.FieldTitle: "Walrus",
+				containers.FieldLead: "The walrus is a large marine mammal. It eats clams.",
+				containers.FieldHeadings: "",
+				containers.FieldBody: "",
+			},
+			links: []string{},
+		},
+		{
+			name: "headings split the lead from the body",
+			text: "Lead text.\n== History ==\nOld.\n=== Early ===\nEarlier.\n== Diet ==\nClams.",
+			fields: map[containers.Field]string{
+				containers.FieldLead: "Lead text.",
+				containers.FieldHeadings: "History Early Diet",
+				containers.FieldBody: "Old. Earlier. Clams.",
+			},
+		},
+		{
+			name: "page starting with a heading has no lead",
+			text: "== Only ==\nBody.",
+			fields: map[containers.Field]string{
+				containers.FieldLead: "",
+				containers.FieldHeadings: "Only",
+				containers.FieldBody: "Body.",
+			},
+		},
+		{
+			name: "templates refs and comments are left out",
+			text: "The walrus{{efn|a note}}<ref>Cited in [[Fay 1982]].</ref> is big.<!-- [[Hidden]] --> <ref name=\"b\" />Yes.{{Pinnipeds}}",
+			fields: map[containers.Field]string{
+				containers.FieldLead: "The walrus is big. Yes.",
+			},
+			links: []string{"Fay_1982"},
+			anchors: map[string]string{"Fay_1982": "Fay 1982"},
+		},
+		{
+			name: "nested templates",
+			text: "Before {{Infobox|image={{Photo|[[Walrus]]}}|size={{convert|1|m}}}} after.",
+			fields: map[containers.Field]string{
+				containers.FieldLead: "Before after.",
+			},
+			links: []string{"Walrus"},
+		},
+		{
+			name: "link labels and trails",
+			text: "[[Walrus|walrus]]es eat [[clam]]s and [[Clam#Food|shellfish]]. [[Walrus]] again.",
+			fields: map[containers.Field]string{
+				containers.FieldLead: "walruses eat clams and shellfish. Walrus again.",
+			},
+			links: []string{"Walrus", "Clam"},
+			anchors: map[string]string{"Walrus": "walruses Walrus", "Clam": "clams shellfish"},
+		},
+		{
+			name: "files categories and other namespaces",
+			text: "Text [[File:Walrus.jpg|thumb|A [[walrus]]]] more [[Image:X.png]] [[Category:Pinnipeds]] [[:Category:Seals]] [[Talk:Walrus|talk]]",
+			fields: map[containers.Field]string{
+				containers.FieldLead: "Text more Category:Seals talk",
+			},
+			links: []string{"Walrus"},
+			anchors: map[string]string{"Walrus": "walrus"},
+		},
+		{
+			name: "link targets are normalised",
+			text: "The [[walrus]] and [[pacific__walrus|its kin]] near [[ Bering  Sea ]], [[Bering_Sea#Fauna|there]].",
+			fields: map[containers.Field]string{
+				containers.FieldLead: "The walrus and its kin near Bering Sea, there.",
+			},
+			links: []string{"Walrus", "Pacific_walrus", "Bering_Sea"},
+			anchors: map[string]string{"Walrus": "walrus", "Pacific_walrus": "its kin", "Bering_Sea": "Bering Sea there"},
+		},
+		{
+			name: "unclosed constructs are text",
+			text: "Start {{unclosed [[Walrus]] and [[broken\n<div>open end",
+			fields: map[containers.Field]string{
+				containers.FieldLead: "Start {{unclosed Walrus and [[broken open end",
+			},
+			links: []string{"Walrus"},
+		},
+		{
+			name: "tables",
+			text: "{| class=\"wikitable\"\n! Animal !! Food\n|-\n| [[Walrus]] || style=\"x\" | Clams\n|}",
+			fields: map[containers.Field]string{
+				containers.FieldLead: "Animal Food Walrus Clams",
+			},
+			links: []string{"Walrus"},
+		},
+		{
+			name: "tags and entities",
+			text: "H<sub>2</sub>O&nbsp;is<br>water &amp; <math>x^2</math>ice.<references/>",
+			fields: map[containers.Field]string{
+				containers.FieldLead: "H2O is water & ice.",
+			},
+		},
+	}
+	cleaner := testCleaner()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc := cleaner.Clean("Walrus", test.text)
+			if doc.Redirect != nil {
+				t.Fatalf("got a redirect to %s", *doc.Redirect)
+			}
+			for field, want := range test.fields {
+				if got := doc.Fields[field]; got != want {
+					t.Errorf("%s field\n got: %q\nwant: %q", field, got, want)
+				}
+			}
+			if test.links != nil && !reflect.DeepEqual(*doc.Links, test.links) {
+				t.Errorf("links\n got: %q\nwant: %q", *doc.Links, test.links)
+			}
+			if test.anchors != nil && !reflect.DeepEqual(doc.Anchors, test.anchors) {
+				t.Errorf("anchors\n got: %q\nwant: %q", doc.Anchors, test.anchors)
+			}
+			if _, found := doc.Fields[containers.FieldAnchors]; found {
+				t.Errorf("the page's own anchors field is set, its links' text belongs to their targets")
+			}
+		})
+	}
+}
+
+func TestWikipediaCleanerRedirect(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"#REDIRECT [[Walrus (animal)]]", "Walrus_%28animal%29"},
+		{"  #redirect: [[Odobenus rosmarus]]\n{{R from scientific name}}", "Odobenus_rosmarus"},
+		{"#REDIRECT [[odobenus  rosmarus]]", "Odobenus_rosmarus"},
+	}
+	cleaner := testCleaner()
+	for _, test := range tests {
+		doc := cleaner.Clean("Odobenus", test.text)
+		if doc.Redirect == nil {
+			t.Errorf("Clean(%q) is not a redirect", test.text)
+			continue
+		}
+		if *doc.Redirect != test.want {
+			t.Errorf("Clean(%q) redirects to %s, want %s", test.text, *doc.Redirect, test.want)
+		}
+		if doc.Fields[containers.FieldRedirects] != "Odobenus" {
+			t.Errorf("Clean(%q) has redirects field %q, want the page's title", test.text, doc.Fields[containers.FieldRedirects])
+		}
+	}
+}
+
+func TestWikipediaCleanerCaseSensitive(t *testing.T) {
+	cleaner := testCleanerWithCase("case-sensitive")
+	doc := cleaner.Clean("Walrus", "A [[walrus]] is not a [[Walrus]].")
+	want := []string{"walrus", "Walrus"}
+	if !reflect.DeepEqual(*doc.Links, want) {
+		t.Errorf("links\n got: %q\nwant: %q", *doc.Links, want)
+	}
+	doc = cleaner.Clean("Odobenus", "#REDIRECT [[odobenus rosmarus]]")
+	if doc.Redirect == nil {
+		t.Fatalf("not a redirect")
+	}
+	if *doc.Redirect != "odobenus_rosmarus" {
+		t.Errorf("redirects to %s, want odobenus_rosmarus", *doc.Redirect)
+	}
+}
@@ -0,0 +1,562 @@
+package cleaners
+
+import (
+	"regexp"
+	"strings"
+)
+
+// A wikitext page is parsed into a tree of Nodes. Constructs that are never
+// closed, like a "{{" without its "}}", are read as plain text, as MediaWiki
+// does, so any input parses.
+
+type NodeKind int
+
+const (
+	NodeDocument NodeKind = iota
+	// NodeSection is a heading and everything up to the next heading of the
+	// same or a higher level
+	NodeSection
+	NodeParagraph
+	NodeText
+	// NodeLink is an internal link, [[Target|label]]
+	NodeLink
+	// NodeExternalLink is a link to a URL, [https://example.org label]
+	NodeExternalLink
+	// NodeTemplate is a template transclusion or parser function, {{name|...}},
+	// with a NodeArgument child per parameter
+	NodeTemplate
+	NodeArgument
+	// NodeTable is a {| ... |} table, with a NodeCell child per cell and
+	// caption
+	NodeTable
+	NodeCell
+	// NodeRef is a <ref> citation
+	NodeRef
+	// NodeTag is any other HTML or extension tag
+	NodeTag
+	NodeComment
+)
+
+type Node struct {
+	Kind NodeKind
+	// Text is the text of a text or comment node, the target of a link, the
+	// URL of an external link, the name of a template, named argument or
+	// tag, or the attributes of a ref
+	Text string
+	// Level is the level of a section's heading, 2 for "== Heading =="
+	Level int
+	// Title is the heading of a section
+	Title []*Node
+	Children []*Node
+}
+
+// rawTags are extension tags whose content isn't wikitext, and is kept as a
+// single text node.
+var rawTags = map[string]bool{
+	"nowiki": true, "pre": true, "math": true, "chem": true, "ce": true,
+	"syntaxhighlight": true, "source": true, "score": true, "timeline": true,
+	"graph": true, "templatedata": true, "mapframe": true, "maplink": true,
+	"gallery": true, "imagemap": true, "hiero": true, "inputbox": true,
+	"categorytree": true,
+}
+
+// voidTags never have content or a closing tag.
+var voidTags = map[string]bool{
+	"br": true, "hr": true, "img": true, "wbr": true,
+}
+
+var (
+	reHeading = regexp.MustCompile(`^(={1,6})(.+?)(={1,6})[ \t]*$`)
+	reTag = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9]*)([^<>]*?)(/?)>`)
+	reURLStart = regexp.MustCompile(`^\[(?i:https?:|ftp:|mailto:|//)`)
+)
+
+// ParseWikitext parses a page's wikitext.
+func ParseWikitext(text string) *Node {
+	p := &parser{src: text, lower: asciiLower(text), parsed: make(map[int]parseResult)}
+	return p.document()
+}
+
+type parser struct {
+	src string
+	// lower is src with ASCII letters lowercased, for finding tags, whose
+	// names are case insensitive
+	lower string
+	pos int
+	// parsed holds the result of each construct tried, by position. A
+	// construct parses the same wherever it's nested, and without this one
+	// that isn't closed would be parsed again by every enclosing construct
+	// that isn't either, taking exponential time.
+	parsed map[int]parseResult
+}
+
+type parseResult struct {
+	node *Node
+	matched bool
+	end int
+}
+
+// document parses the page into paragraphs and tables, nesting them under
+// the sections their headings start.
+func (p *parser) document() *Node {
+	doc := &Node{Kind: NodeDocument}
+	// open holds the sections being read, innermost last
+	open := []*Node{doc}
+	var paragraph *Node
+	add := func(node *Node) {
+		parent := open[len(open) - 1]
+		parent.Children = append(parent.Children, node)
+	}
+
+	for p.pos < len(p.src) {
+		line := p.src[p.pos:p.lineEnd()]
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "----") {
+			paragraph = nil
+			p.nextLine()
+			continue
+		}
+		if match := reHeading.FindStringSubmatch(line); match != nil {
+			// Unbalanced ='s belong to the title
+			level := min(len(match[1]), len(match[3]))
+			title := match[1][level:] + match[2] + match[3][level:]
+			section := &Node{Kind: NodeSection, Level: level, Title: parseInline(strings.TrimSpace(title))}
+			for len(open) > 1 && open[len(open) - 1].Level >= level {
+				open = open[:len(open) - 1]
+			}
+			add(section)
+			open = append(open, section)
+			paragraph = nil
+			p.nextLine()
+			continue
+		}
+		p.skipSpace()
+		if p.has("{|") {
+			table, _ := p.table()
+			add(table)
+			paragraph = nil
+			continue
+		}
+
+		// List items and indented lines are read as part of the paragraph
+		for p.pos < len(p.src) && strings.IndexByte("*#:;", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		nodes := p.inline(func() bool { return p.src[p.pos] == '\n' })
+		if paragraph == nil {
+			paragraph = &Node{Kind: NodeParagraph}
+			add(paragraph)
+		} else {
+			paragraph.Children = appendText(paragraph.Children, "\n")
+		}
+		paragraph.Children = appendNodes(paragraph.Children, nodes)
+		p.nextLine()
+	}
+	return doc
+}
+
+// parseInline parses text holding no block structure, like a heading.
+func parseInline(text string) []*Node {
+	p := &parser{src: text, lower: asciiLower(text), parsed: make(map[int]parseResult)}
+	return p.inline(func() bool { return false })
+}
+
+// inline parses text and inline constructs until the end of the input or
+// until stop reports that the parser is at the end of the enclosing
+// construct.
+func (p *parser) inline(stop func() bool) []*Node {
+	var nodes []*Node
+	text_start := p.pos
+	for p.pos < len(p.src) && !stop() {
+		start := p.pos
+		var node *Node
+		matched := false
+		switch p.src[p.pos] {
+		case '{':
+			if p.has("{{") {
+				node, matched = p.construct(p.template)
+			} else if p.has("{|") && p.atLineStart() {
+				node, matched = p.construct(p.table)
+			}
+		case '[':
+			if p.has("[[") {
+				node, matched = p.construct(p.link)
+			} else {
+				node, matched = p.construct(p.externalLink)
+			}
+		case '<':
+			node, matched = p.construct(p.angle)
+		case '\'':
+			// Bold and italic markup is dropped
+			end := p.pos
+			for end < len(p.src) && p.src[end] == '\'' {
+				end++
+			}
+			if end - p.pos >= 2 {
+				p.pos = end
+				matched = true
+			}
+		}
+		if !matched {
+			p.pos++
+			continue
+		}
+		if start > text_start {
+			nodes = appendText(nodes, p.src[text_start:start])
+		}
+		if node != nil {
+			nodes = append(nodes, node)
+		}
+		text_start = p.pos
+	}
+	if p.pos > text_start {
+		nodes = appendText(nodes, p.src[text_start:p.pos])
+	}
+	return nodes
+}
+
+// construct runs parse at the current position, or repeats what it did
+// there before. A parse function reports whether it matched, moving past
+// what it matched if so, and may match without returning a node for markup
+// that is simply dropped.
+func (p *parser) construct(parse func() (*Node, bool)) (*Node, bool) {
+	if result, found := p.parsed[p.pos]; found {
+		p.pos = result.end
+		return result.node, result.matched
+	}
+	start := p.pos
+	node, matched := parse()
+	if !matched {
+		p.pos = start
+	}
+	p.parsed[start] = parseResult{node: node, matched: matched, end: p.pos}
+	return node, matched
+}
+
+// template parses {{name|arg|...}}, failing if it isn't closed.
+func (p *parser) template() (*Node, bool) {
+	start := p.pos
+	p.pos += 2
+	var args [][]*Node
+	for {
+		arg := p.inline(func() bool { return p.has("}}") || p.src[p.pos] == '|' })
+		if p.pos >= len(p.src) {
+			p.pos = start
+			return nil, false
+		}
+		args = append(args, arg)
+		if p.has("}}") {
+			p.pos += 2
+			break
+		}
+		p.pos++
+	}
+
+	template := &Node{Kind: NodeTemplate, Text: strings.TrimSpace(plainSource(args[0]))}
+	for _, arg := range args[1:] {
+		template.Children = append(template.Children, newArgument(arg))
+	}
+	return template, true
+}
+
+// newArgument splits a template argument into its name, if it has one, and
+// value.
+func newArgument(nodes []*Node) *Node {
+	argument := &Node{Kind: NodeArgument, Children: nodes}
+	if len(nodes) == 0 || nodes[0].Kind != NodeText {
+		return argument
+	}
+	name, value, found := strings.Cut(nodes[0].Text, "=")
+	if !found {
+		return argument
+	}
+	argument.Text = strings.TrimSpace(name)
+	argument.Children = append(appendText(nil, value), nodes[1:]...)
+	return argument
+}
+
+// link parses [[target|label]] with any lowercase letters trailing it, which
+// MediaWiki shows as part of the label, failing if it isn't closed on the
+// same line.
+func (p *parser) link() (*Node, bool) {
+	start := p.pos
+	p.pos += 2
+	end := p.pos
+	for end < len(p.src) && p.src[end] != '|' && p.src[end] != '\n' && !strings.HasPrefix(p.src[end:], "]]") && !strings.HasPrefix(p.src[end:], "[[") {
+		end++
+	}
+	if end >= len(p.src) || p.src[end] == '\n' || p.src[end] == '[' {
+		p.pos = start
+		return nil, false
+	}
+	link := &Node{Kind: NodeLink, Text: strings.TrimSpace(p.src[p.pos:end])}
+	p.pos = end
+	if p.src[p.pos] == '|' {
+		p.pos++
+		link.Children = p.inline(func() bool { return p.has("]]") || p.src[p.pos] == '\n' })
+		if !p.has("]]") {
+			p.pos = start
+			return nil, false
+		}
+	}
+	p.pos += 2
+
+	trail := p.pos
+	for trail < len(p.src) && p.src[trail] >= 'a' && p.src[trail] <= 'z' {
+		trail++
+	}
+	if trail > p.pos {
+		if link.Children == nil {
+			link.Children = appendText(nil, strings.TrimPrefix(link.Text, ":"))
+		}
+		link.Children = appendText(link.Children, p.src[p.pos:trail])
+		p.pos = trail
+	}
+	return link, true
+}
+
+// externalLink parses [URL label], failing if it isn't one.
+func (p *parser) externalLink() (*Node, bool) {
+	if !reURLStart.MatchString(p.src[p.pos:]) {
+		return nil, false
+	}
+	start := p.pos
+	end := p.pos + 1
+	for end < len(p.src) && strings.IndexByte(" \t\n]", p.src[end]) < 0 {
+		end++
+	}
+	link := &Node{Kind: NodeExternalLink, Text: p.src[p.pos + 1:end]}
+	p.pos = end
+	link.Children = p.inline(func() bool { return p.src[p.pos] == ']' || p.src[p.pos] == '\n' })
+	if p.pos >= len(p.src) || p.src[p.pos] != ']' {
+		p.pos = start
+		return nil, false
+	}
+	p.pos++
+	return link, true
+}
+
+// angle parses a comment or tag. A stray closing tag is dropped, matching
+// without a node.
+func (p *parser) angle() (*Node, bool) {
+	if p.has("<!--") {
+		end := strings.Index(p.src[p.pos + 4:], "-->")
+		// An unclosed comment runs to the end of the page
+		if end < 0 {
+			comment := &Node{Kind: NodeComment, Text: p.src[p.pos + 4:]}
+			p.pos = len(p.src)
+			return comment, true
+		}
+		comment := &Node{Kind: NodeComment, Text: p.src[p.pos + 4:p.pos + 4 + end]}
+		p.pos += 4 + end + 3
+		return comment, true
+	}
+
+	match := reTag.FindStringSubmatch(p.src[p.pos:])
+	if match == nil {
+		return nil, false
+	}
+	p.pos += len(match[0])
+	name := strings.ToLower(match[2])
+	if match[1] != "" {
+		return nil, true
+	}
+	kind := NodeTag
+	text := name
+	if name == "ref" {
+		kind = NodeRef
+		text = strings.TrimSpace(match[3])
+	}
+	node := &Node{Kind: kind, Text: text}
+	if match[4] != "" || voidTags[name] {
+		return node, true
+	}
+
+	if rawTags[name] {
+		content_start := p.pos
+		for p.pos < len(p.src) && !p.atCloseTag(name) {
+			p.pos++
+		}
+		node.Children = appendText(nil, p.src[content_start:p.pos])
+		p.skipCloseTag(name)
+		return node, true
+	}
+
+	// A tag that's never closed, like a lone <center>, holds nothing
+	content_start := p.pos
+	children := p.inline(func() bool { return p.atCloseTag(name) })
+	if p.pos >= len(p.src) {
+		p.pos = content_start
+		return node, true
+	}
+	node.Children = children
+	p.skipCloseTag(name)
+	return node, true
+}
+
+// atCloseTag reports whether the parser is at a closing tag for name.
+func (p *parser) atCloseTag(name string) bool {
+	if p.src[p.pos] != '<' || !strings.HasPrefix(p.lower[p.pos + 1:], "/" + name) {
+		return false
+	}
+	end := p.pos + 2 + len(name)
+	return end < len(p.src) && strings.IndexByte(" \t\n/>", p.src[end]) >= 0
+}
+
+// skipCloseTag moves past the closing tag for name, if the parser is at
+// one.
+func (p *parser) skipCloseTag(name string) {
+	if p.pos >= len(p.src) || !p.atCloseTag(name) {
+		return
+	}
+	if end := strings.IndexByte(p.src[p.pos:], '>'); end >= 0 {
+		p.pos += end + 1
+	}
+}
+
+// table parses a {| ... |} table, which may nest, from the start of its
+// first line. A table that's never closed runs to the end of the page.
+func (p *parser) table() (*Node, bool) {
+	table := &Node{Kind: NodeTable}
+	// The rest of the first line holds the table's attributes
+	p.pos = p.lineEnd()
+	for p.pos < len(p.src) {
+		// At the end of the previous line
+		p.pos++
+		p.skipSpace()
+		switch {
+		case p.has("|}"):
+			p.pos += 2
+			return table, true
+		case p.has("|-"):
+			p.pos = p.lineEnd()
+		case p.has("|+"):
+			p.pos += 2
+			table.Children = append(table.Children, p.cell(false))
+		case p.has("|") || p.has("!"):
+			header := p.src[p.pos] == '!'
+			p.pos++
+			for {
+				table.Children = append(table.Children, p.cell(header))
+				if !p.has("||") && !(header && p.has("!!")) {
+					break
+				}
+				p.pos += 2
+			}
+		default:
+			// Text outside any cell
+			if nodes := p.inline(p.atCellLine); len(nodes) > 0 {
+				table.Children = append(table.Children, &Node{Kind: NodeCell, Children: nodes})
+			}
+		}
+		if p.pos < len(p.src) && p.src[p.pos] != '\n' {
+			p.pos = p.lineEnd()
+		}
+	}
+	return table, true
+}
+
+// cell parses a table cell, which runs to the next cell on the same line or
+// the next line starting one. Anything before a single "|" on the cell's
+// first line is its attributes.
+func (p *parser) cell(header bool) *Node {
+	stop := func() bool {
+		return p.has("||") || (header && p.has("!!")) || p.atCellLine()
+	}
+	nodes := p.inline(func() bool {
+		return stop() || p.src[p.pos] == '|' || p.src[p.pos] == '\n'
+	})
+	if p.pos < len(p.src) && p.src[p.pos] == '|' && !p.has("||") {
+		p.pos++
+		nodes = p.inline(stop)
+	} else {
+		nodes = appendNodes(nodes, p.inline(stop))
+	}
+	return &Node{Kind: NodeCell, Children: nodes}
+}
+
+// atCellLine reports whether the parser is at the end of a line followed by
+// one starting a table cell, row or the end of the table.
+func (p *parser) atCellLine() bool {
+	if p.src[p.pos] != '\n' {
+		return false
+	}
+	next := p.pos + 1
+	for next < len(p.src) && (p.src[next] == ' ' || p.src[next] == '\t') {
+		next++
+	}
+	return next >= len(p.src) || p.src[next] == '|' || p.src[next] == '!'
+}
+
+func (p *parser) has(prefix string) bool {
+	return strings.HasPrefix(p.src[p.pos:], prefix)
+}
+
+func (p *parser) atLineStart() bool {
+	return p.pos == 0 || p.src[p.pos - 1] == '\n'
+}
+
+// lineEnd returns the position of the end of the current line.
+func (p *parser) lineEnd() int {
+	if end := strings.IndexByte(p.src[p.pos:], '\n'); end >= 0 {
+		return p.pos + end
+	}
+	return len(p.src)
+}
+
+// nextLine moves to the start of the next line.
+func (p *parser) nextLine() {
+	p.pos = min(p.lineEnd() + 1, len(p.src))
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// appendText adds text to nodes, merging it into the last node if that is
+// text too.
+func appendText(nodes []*Node, text string) []*Node {
+	if text == "" {
+		return nodes
+	}
+	if len(nodes) > 0 && nodes[len(nodes) - 1].Kind == NodeText {
+		nodes[len(nodes) - 1].Text += text
+		return nodes
+	}
+	return append(nodes, &Node{Kind: NodeText, Text: text})
+}
+
+// appendNodes adds more to nodes, merging text nodes where they meet.
+func appendNodes(nodes []*Node, more []*Node) []*Node {
+	if len(more) > 0 && more[0].Kind == NodeText {
+		nodes = appendText(nodes, more[0].Text)
+		more = more[1:]
+	}
+	return append(nodes, more...)
+}
+
+// plainSource returns the text nodes of nodes, as a template's name rarely
+// holds anything else.
+func plainSource(nodes []*Node) string {
+	var text strings.Builder
+	for _, node := range nodes {
+		if node.Kind == NodeText {
+			text.WriteString(node.Text)
+		}
+	}
+	return text.String()
+}
+
+// asciiLower lowercases only ASCII letters, so offsets into the result match
+// the original.
+func asciiLower(text string) string {
+	lower := []byte(text)
+	for i, c := range lower {
+		if c >= 'A' && c <= 'Z' {
+			lower[i] = c + 'a' - 'A'
+		}
+	}
+	return string(lower)
+}
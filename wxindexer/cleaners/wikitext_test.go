@@ -0,0 +1,238 @@
+package cleaners
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// describe renders a parse tree compactly, as kind[text](children), for
+// comparing against what a test expects.
+func describe(nodes []*Node) string {
+	parts := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		parts = append(parts, describeNode(node))
+	}
+	return strings.Join(parts, " ")
+}
+
+func describeNode(node *Node) string {
+	switch node.Kind {
+	case NodeText:
+		return fmt.Sprintf("%q", node.Text)
+	case NodeComment:
+		return fmt.Sprintf("comment[%q]", node.Text)
+	case NodeSection:
+		return fmt.Sprintf("section%d[%s](%s)", node.Level, describe(node.Title), describe(node.Children))
+	}
+	name := map[NodeKind]string{
+		NodeDocument: "doc",
+		NodeParagraph: "p",
+		NodeLink: "link",
+		NodeExternalLink: "ext",
+		NodeTemplate: "tpl",
+		NodeArgument: "arg",
+		NodeTable: "table",
+		NodeCell: "cell",
+		NodeRef: "ref",
+		NodeTag: "tag",
+	}[node.Kind]
+	if node.Text != "" {
+		name += "[" + node.Text + "]"
+	}
+	return name + "(" + describe(node.Children) + ")"
+}
+
+func TestParseWikitext(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "paragraphs",
+			text: "One\ntwo\n\nThree",
+			want: `p("One\ntwo") p("Three")`,
+		},
+		{
+			name: "bold and italics are dropped",
+			text: "'''Bold''' and ''italic''",
+			want: `p("Bold and italic")`,
+		},
+		{
+			name: "links",
+			text: "[[Target]] and [[Target page|the label]]",
+			want: `p(link[Target]() " and " link[Target page]("the label"))`,
+		},
+		{
+			name: "link trail",
+			text: "[[cat]]s and [[dog|hound]]s, [[bird]].",
+			want: `p(link[cat]("cats") " and " link[dog]("hounds") ", " link[bird]() ".")`,
+		},
+		{
+			name: "link trail keeps the leading colon out of the label",
+			text: "[[:fish]]es",
+			want: `p(link[:fish]("fishes"))`,
+		},
+		{
+			name: "link label holding markup",
+			text: "[[Target|a ''fine'' {{lang|fr|label}}]]",
+			want: `p(link[Target]("a fine " tpl[lang](arg("fr") arg("label"))))`,
+		},
+		{
+			name: "external links",
+			text: "[https://example.org Example] and [http://example.com]",
+			want: `p(ext[https://example.org](" Example") " and " ext[http://example.com]())`,
+		},
+		{
+			name: "not an external link",
+			text: "[citation needed]",
+			want: `p("[citation needed]")`,
+		},
+		{
+			name: "template arguments",
+			text: "{{Infobox | name = Walrus | 12 }}",
+			want: `p(tpl[Infobox](arg[name](" Walrus ") arg(" 12 ")))`,
+		},
+		{
+			name: "nested templates",
+			text: "{{outer|{{inner|{{innermost}}}}|b=[[Link]]}}",
+			want: `p(tpl[outer](arg(tpl[inner](arg(tpl[innermost]()))) arg[b](link[Link]())))`,
+		},
+		{
+			name: "unclosed template is text",
+			text: "before {{unclosed|[[Link]] after",
+			want: `p("before {{unclosed|" link[Link]() " after")`,
+		},
+		{
+			name: "unclosed template around a closed one",
+			text: "{{a {{b}} c",
+			want: `p("{{a " tpl[b]() " c")`,
+		},
+		{
+			name: "unclosed link is text",
+			text: "a [[broken link\nnext line",
+			want: `p("a [[broken link\nnext line")`,
+		},
+		{
+			name: "link with an unclosed label is text",
+			text: "a [[Target|label\nb",
+			want: `p("a [[Target|label\nb")`,
+		},
+		{
+			name: "ref",
+			text: `Fact.<ref name="a">{{cite web|url=x}}</ref> More.`,
+			want: `p("Fact." ref[name="a"](tpl[cite web](arg[url]("x"))) " More.")`,
+		},
+		{
+			name: "self-closing ref",
+			text: `Fact.<ref name="a" /> More.`,
+			want: `p("Fact." ref[name="a"]() " More.")`,
+		},
+		{
+			name: "comments",
+			text: "a<!-- hidden [[Link]] -->b",
+			want: `p("a" comment[" hidden [[Link]] "] "b")`,
+		},
+		{
+			name: "unclosed comment runs to the end",
+			text: "a<!-- hidden\n\nstill hidden",
+			want: `p("a" comment[" hidden\n\nstill hidden"])`,
+		},
+		{
+			name: "unclosed tag holds nothing",
+			text: "<center>centered\n\nnext",
+			want: `p(tag[center]() "centered") p("next")`,
+		},
+		{
+			name: "unclosed ref holds nothing",
+			text: "Fact.<ref>unclosed",
+			want: `p("Fact." ref() "unclosed")`,
+		},
+		{
+			name: "stray closing tag is dropped",
+			text: "a</div>b",
+			want: `p("ab")`,
+		},
+		{
+			name: "tag names are case insensitive",
+			text: "<SUB>2</Sub>",
+			want: `p(tag[sub]("2"))`,
+		},
+		{
+			name: "raw tags keep their content as text",
+			text: "<nowiki>[[not a link]]</nowiki> <math>x^{2}</math>",
+			want: `p(tag[nowiki]("[[not a link]]") " " tag[math]("x^{2}"))`,
+		},
+		{
+			name: "void tags",
+			text: "a<br>b<br/>c",
+			want: `p("a" tag[br]() "b" tag[br]() "c")`,
+		},
+		{
+			name: "table",
+			text: "{| class=\"wikitable\"\n|+ Caption\n! Name !! Size\n|-\n| Walrus || style=\"x\" | Large\n|}",
+			want: `table(cell(" Caption") cell(" Name ") cell(" Size") cell(" Walrus ") cell(" Large"))`,
+		},
+		{
+			name: "nested tables",
+			text: "{|\n| outer\n{|\n| inner\n|}\n| after\n|}\nText",
+			want: `table(cell(" outer\n" table(cell(" inner"))) cell(" after")) p("Text")`,
+		},
+		{
+			name: "unclosed table runs to the end",
+			text: "{|\n| cell\n\nmore",
+			want: `table(cell(" cell\n\nmore"))`,
+		},
+		{
+			name: "lists are part of the paragraph",
+			text: "* one\n** two\n# three",
+			want: `p(" one\n two\n three")`,
+		},
+		{
+			name: "sections nest by level",
+			text: "Lead\n== A ==\na\n=== B ===\nb\n== C ==\nc",
+			want: `p("Lead") section2["A"](p("a") section3["B"](p("b"))) section2["C"](p("c"))`,
+		},
+		{
+			name: "unbalanced heading",
+			text: "=== Title ==\ntext",
+			want: `section2["= Title"](p("text"))`,
+		},
+		{
+			name: "heading with markup",
+			text: "== [[Walrus]] ''diet'' ==",
+			want: `section2[link[Walrus]() " diet"]()`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc := ParseWikitext(test.text)
+			if doc.Kind != NodeDocument {
+				t.Fatalf("got a root of kind %d, want NodeDocument", doc.Kind)
+			}
+			if got := describe(doc.Children); got != test.want {
+				t.Errorf("ParseWikitext(%q)\n got: %s\nwant: %s", test.text, got, test.want)
+			}
+		})
+	}
+}
+
+// TestParseWikitextUnclosedNesting checks that deeply nested constructs that
+// are never closed are each tried only once. Were they retried by every
+// enclosing construct, parsing would take exponential time.
+func TestParseWikitextUnclosedNesting(t *testing.T) {
+	const depth = 500
+	for _, unit := range []string{"{{a|", "[[a|", "<div>", "{{a|[[b|<span>"} {
+		text := strings.Repeat(unit, depth)
+		start := time.Now()
+		doc := ParseWikitext(text)
+		if elapsed := time.Since(start); elapsed > 5 * time.Second {
+			t.Errorf("parsing %d unclosed %q took %s", depth, unit, elapsed)
+		}
+		if len(doc.Children) != 1 || doc.Children[0].Kind != NodeParagraph {
+			t.Errorf("parsing %d unclosed %q gave %d top level nodes, want a single paragraph", depth, unit, len(doc.Children))
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"common"
+	"wxindexer/analyzer"
+	"wxindexer/containers"
+	"wxindexer/scoring"
+)
+
+const usage = `usage:
+  wxindexer [index] [flags]      index pages streamed from wxunpacker
+  wxindexer pagerank [flags]     run PageRank over the saved page graph
+  wxindexer merge [flags] <shard graph>...
+                                 combine the document frequencies and page
+                                 graphs of indexers each given one shard
+  wxindexer invert [flags]       build an inverted index segment from the
+                                 forward index
+  wxindexer search [flags] <query>
+                                 score the pages of a segment against a
+                                 query and print the best
+`
+
+type options struct {
+	listen string
+	tls common.TLSFiles
+	siteinfo string
+	profile string
+	stemmer string
+	output string
+	input string
+	segment string
+	memory int
+	graph string
+	redis string
+	shard_redis []string
+	shard_graphs []string
+	update bool
+	positions bool
+	producers int
+	replay string
+	replay_from uint64
+	iterations int
+	top int
+	if_dirty bool
+	scorer string
+	scoring scoring.Params
+	query string
+}
+
+func parseIndexArgs(args []string) *options {
+	var opts options
+	flags := newFlagSet("index")
+	flags.StringVar(&opts.listen, "listen", common.DefaultEndpoint, "endpoint to accept producers on: unix:///path, tcp://host:port or tls://host:port")
+	opts.tls.RegisterFlags(flags)
+	flags.IntVar(&opts.producers, "producers", 1, "number of producers whose streams have to end before indexing finishes")
+	flags.StringVar(&opts.replay, "replay", "", "index the pages in a record file from `wxunpacker -record` instead of listening for producers")
+	flags.Uint64Var(&opts.replay_from, "replay-from", 1, "with -replay, start from this page of the recording")
+	flags.StringVar(&opts.siteinfo, "siteinfo", "", "siteinfo file from `wxunpacker siteinfo`, selects the wiki's profile instead of English Wikipedia")
+	flags.StringVar(&opts.profile, "profile", "", "JSON profile file overriding fields of the wiki's profile")
+	flags.StringVar(&opts.stemmer, "stemmer", "", "stemmer to reduce terms with, overriding the profile's: " + strings.Join(analyzer.StemmerNames(), ", "))
+	flags.StringVar(&opts.output, "output", default_output, "forward index file to write page term frequencies to")
+	flags.BoolVar(&opts.update, "update", false, "apply pages as upserts on top of the existing index in -output instead of starting a new one, letting producers resume the streams saved beside it")
+	flags.BoolVar(&opts.positions, "positions", false, "record where each term is on each page, for phrase and proximity queries")
+	flags.StringVar(&opts.graph, "graph", default_graph, "directory to save the page graph to")
+	flags.StringVar(&opts.redis, "redis", default_redis, "redis server to count document frequencies in")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		exitUsage(flags, "unexpected arguments")
+	}
+	if opts.producers < 1 {
+		exitUsage(flags, "-producers must be at least 1")
+	}
+	if opts.replay_from != 1 && opts.replay == "" {
+		exitUsage(flags, "-replay-from requires -replay")
+	}
+	if opts.stemmer != "" && !slices.Contains(analyzer.StemmerNames(), opts.stemmer) {
+		exitUsage(flags, fmt.Sprintf("unknown stemmer %q", opts.stemmer))
+	}
+	return &opts
+}
+
+func parsePageRankArgs(args []string) *options {
+	var opts options
+	flags := newFlagSet("pagerank")
+	flags.StringVar(&opts.graph, "graph", default_graph, "directory the page graph is saved in")
+	flags.IntVar(&opts.iterations, "iterations", 20, "number of PageRank iterations to run")
+	flags.IntVar(&opts.top, "top", 30, "number of highest ranking pages to log")
+	flags.BoolVar(&opts.if_dirty, "if-dirty", false, "only run if the page graph has been updated since the last run")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		exitUsage(flags, "unexpected arguments")
+	}
+	return &opts
+}
+
+func parseMergeArgs(args []string) *options {
+	var opts options
+	var shard_redis string
+	flags := newFlagSet("merge")
+	flags.StringVar(&opts.graph, "graph", default_graph, "directory to save the merged page graph to")
+	flags.StringVar(&opts.redis, "redis", default_redis, "empty redis server to sum the shards' document frequencies into")
+	flags.StringVar(&shard_redis, "shard-redis", "", "comma separated redis servers the shards counted document frequencies in")
+	flags.Parse(args)
+
+	opts.shard_graphs = flags.Args()
+	if shard_redis != "" {
+		opts.shard_redis = strings.Split(shard_redis, ",")
+	}
+	if len(opts.shard_graphs) == 0 && len(opts.shard_redis) == 0 {
+		exitUsage(flags, "nothing to merge, expected shard graph directories or -shard-redis")
+	}
+	return &opts
+}
+
+func parseInvertArgs(args []string) *options {
+	var opts options
+	flags := newFlagSet("invert")
+	flags.StringVar(&opts.input, "input", default_output, "forward index file written by wxindexer index")
+	flags.StringVar(&opts.segment, "segment", default_segment, "directory to write the segment to, which must not already hold one")
+	flags.IntVar(&opts.memory, "memory", 2048, "MiB of memory for the doc table and the postings sorted before spilling them to disk")
+	flags.StringVar(&opts.redis, "redis", default_redis, "redis server the analyzer of the forward index is recorded in")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		exitUsage(flags, "unexpected arguments")
+	}
+	if opts.memory < 1 {
+		exitUsage(flags, "-memory must be at least 1")
+	}
+	return &opts
+}
+
+func parseSearchArgs(args []string) *options {
+	var opts options
+	var weights string
+	defaults := scoring.DefaultParams()
+	flags := newFlagSet("search")
+	flags.StringVar(&opts.segment, "segment", default_segment, "directory holding the segment to search")
+	flags.StringVar(&opts.scorer, "scorer", "bm25", "how to score pages: " + strings.Join(scoring.Names(), ", "))
+	flags.Float64Var(&opts.scoring.K1, "k1", defaults.K1, "BM25 term frequency saturation")
+	flags.Float64Var(&opts.scoring.B, "b", defaults.B, "BM25 length normalization, from 0 for none to 1 for full")
+	flags.StringVar(&weights, "weights", "", "comma separated field=weight pairs for bm25f, replacing the default weights")
+	flags.IntVar(&opts.top, "top", 10, "number of best pages to print")
+	flags.StringVar(&opts.siteinfo, "siteinfo", "", "siteinfo file the segment's wiki was indexed with")
+	flags.StringVar(&opts.profile, "profile", "", "JSON profile file the segment's wiki was indexed with")
+	flags.StringVar(&opts.stemmer, "stemmer", "", "stemmer the segment was indexed with, overriding the profile's")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		exitUsage(flags, "expected a query")
+	}
+	opts.query = strings.Join(flags.Args(), " ")
+	if !slices.Contains(scoring.Names(), opts.scorer) {
+		exitUsage(flags, fmt.Sprintf("unknown scorer %q", opts.scorer))
+	}
+	if opts.scoring.K1 < 0 || opts.scoring.B < 0 || opts.scoring.B > 1 {
+		exitUsage(flags, "-k1 must be at least 0 and -b between 0 and 1")
+	}
+	opts.scoring.FieldWeights = defaults.FieldWeights
+	if weights != "" {
+		var err error
+		if opts.scoring.FieldWeights, err = parseWeights(weights); err != nil {
+			exitUsage(flags, fmt.Sprintf("bad -weights: %s", err))
+		}
+	}
+	if opts.stemmer != "" && !slices.Contains(analyzer.StemmerNames(), opts.stemmer) {
+		exitUsage(flags, fmt.Sprintf("unknown stemmer %q", opts.stemmer))
+	}
+	return &opts
+}
+
+// parseWeights parses field weights given as "field=weight,...".
+func parseWeights(text string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, pair := range strings.Split(text, ",") {
+		field, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			return nil, fmt.Errorf("expected field=weight, got %q", pair)
+		}
+		if !slices.Contains(containers.Fields, containers.Field(field)) {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("bad weight %q for field %s", value, field)
+		}
+		weights[field] = weight
+	}
+	return weights, nil
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet("wxindexer " + name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		fmt.Fprintf(flags.Output(), "\n%s flags:\n", name)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func exitUsage(flags *flag.FlagSet, msg string) {
+	fmt.Fprintf(flags.Output(), "wxindexer: %s\n", msg)
+	flags.Usage()
+	os.Exit(2)
+}
@@ -1,7 +1,11 @@
 package containers
 
 type Doc struct {
-	Body *string
+	// Fields holds the plain text of each part of the page
+	Fields map[Field]string
 	Links *[]string
+	// Anchors holds the text of the page's links, by the URL of the page
+	// each leads to
+	Anchors map[string]string
 	Redirect *string
 }
@@ -0,0 +1,46 @@
+package containers
+
+// Field names a part of a page whose terms are counted apart from the rest,
+// so searches can weigh a match in a title above one in the body.
+type Field string
+
+const (
+	FieldTitle Field = "title"
+	// FieldRedirects holds the title of a redirect. It is recorded for the
+	// redirect, and credited to the page it leads to when inverting.
+	FieldRedirects Field = "redirects"
+	FieldHeadings Field = "headings"
+	// FieldLead holds the lead section, before the first heading
+	FieldLead Field = "lead"
+	// FieldBody holds the sections after the lead, without their headings
+	FieldBody Field = "body"
+	// FieldAnchors holds the text of links to the page from other pages,
+	// which is recorded by the target of each link and credited to it when
+	// inverting
+	FieldAnchors Field = "anchors"
+)
+
+// Fields lists every field in the order they are written.
+var Fields = []Field{FieldTitle, FieldRedirects, FieldHeadings, FieldLead, FieldBody, FieldAnchors}
+
+// Credited reports whether the field's terms describe another page, the one
+// linked or redirected to, and are indexed under that page rather than the one
+// they were found on.
+func (f Field) Credited() bool {
+	return f == FieldRedirects || f == FieldAnchors
+}
+
+// DFKey is the redis hash holding the document frequencies of terms in the
+// field, alongside df_map holding those of the whole page. Credited fields
+// have none, as the pages they count for are only known once the segment is
+// built, which holds their document frequencies.
+func (f Field) DFKey() string {
+	return "df_map:" + string(f)
+}
+
+// LengthKey is the redis key holding the total number of terms in the field
+// across pages, alongside total_length holding that of the whole page.
+// Credited fields have none, like with DFKey.
+func (f Field) LengthKey() string {
+	return "total_length:" + string(f)
+}
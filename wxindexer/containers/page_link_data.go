@@ -4,4 +4,11 @@ type PageLinkData struct {
 	URL string
 	Links *Set[string]
 	Redirect *string
+	// Replaced holds the links of the version of the page being replaced
+	// when updating an index, or nil if there was none
+	Replaced *Set[string]
+	// Deleted marks a page to remove from the graph along with its links
+	Deleted bool
+	// MovedFrom is the URL of a page being renamed to URL
+	MovedFrom string
 }
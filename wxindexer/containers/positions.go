@@ -0,0 +1,37 @@
+package containers
+
+import (
+	"encoding/binary"
+)
+
+// Positions holds the positions of a term in a field, in increasing order,
+// each stored as the uvarint of its distance from the one before.
+type Positions []byte
+
+// EncodePositions encodes positions, which must be in increasing order.
+func EncodePositions(positions []int) Positions {
+	encoded := make([]byte, 0, len(positions))
+	last := 0
+	for _, position := range positions {
+		encoded = binary.AppendUvarint(encoded, uint64(position - last))
+		last = position
+	}
+	return encoded
+}
+
+// Decode returns the positions, or as many as could be read if they are
+// corrupt.
+func (p Positions) Decode() []int {
+	positions := make([]int, 0, len(p))
+	last := 0
+	for i := 0; i < len(p); {
+		delta, size := binary.Uvarint(p[i:])
+		if size <= 0 {
+			break
+		}
+		last += int(delta)
+		positions = append(positions, last)
+		i += size
+	}
+	return positions
+}
@@ -1,9 +1,44 @@
 package containers
 
+import (
+	"time"
+)
+
 type PageTF struct {
 	Title string
 	URL string
+	ID int64
+	RevisionID int64
+	Timestamp time.Time
+	Contributor string
 	Links []string
+	// Words holds the frequencies of terms in the text of the page, its
+	// headings, lead and body
 	Words map[string]float32
+	// Fields holds the frequencies of terms in each field of the page. It is
+	// empty for pages indexed before fields were.
+	Fields map[Field]map[string]float32 `json:",omitempty"`
+	// Counts holds the number of times each term of Words occurs, and Length
+	// the number of terms in the text, for scorers that weigh term
+	// frequencies by how long pages are. They are empty for pages indexed
+	// before they were recorded.
+	Counts map[string]int `json:",omitempty"`
+	Length int `json:",omitempty"`
+	// FieldCounts and FieldLengths hold the same for each field
+	FieldCounts map[Field]map[string]int `json:",omitempty"`
+	FieldLengths map[Field]int `json:",omitempty"`
+	// Positions holds where each term is in each field, counting the
+	// stopwords left out, for phrase and proximity queries. It is only
+	// recorded when indexing with -positions.
+	Positions map[Field]map[string]Positions `json:",omitempty"`
+	// Anchors holds the number of times each term occurs in the text of the
+	// page's links, by the URL of the page each leads to, to be credited to
+	// that page
+	Anchors map[string]map[string]int `json:",omitempty"`
 	Redirect *string
+	// Deleted marks a tombstone, recording that the page no longer exists
+	Deleted bool `json:",omitempty"`
+	// MovedFrom is the URL the page had before being moved. It is only set on
+	// the way to the writer, which applies the move to the indexed page.
+	MovedFrom string `json:"-"`
 }
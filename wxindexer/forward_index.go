@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"wxindexer/containers"
+)
+
+// forwardIndex is the JSONL file of PageTF records written by jsonWriter.
+// When updating an existing index, new versions of a page are appended rather
+// than rewritten in place, so readers must keep the last record they see for
+// each page ID, dropping the page if that record is a tombstone.
+type forwardIndex struct {
+	file *os.File
+	writer *bufio.Writer
+	size int64
+	// offsets maps a page ID to the offset of its latest record, and ids and
+	// urls map between page URLs and IDs. They are only kept when updating an
+	// index.
+	offsets map[int64]int64
+	ids map[string]int64
+	urls map[int64]string
+}
+
+// openForwardIndex creates a new forward index at path, or with update opens
+// the existing one to append to it.
+func openForwardIndex(path string, update bool) (*forwardIndex, error) {
+	index := &forwardIndex{}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	if !update {
+		index.file, err = os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		index.writer = bufio.NewWriter(index.file)
+		return index, nil
+	}
+
+	index.offsets = make(map[int64]int64)
+	index.ids = make(map[string]int64)
+	index.urls = make(map[int64]string)
+	index.file, err = os.OpenFile(path, os.O_RDWR | os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := index.scan(); err != nil {
+		index.file.Close()
+		return nil, err
+	}
+	index.writer = bufio.NewWriter(index.file)
+	return index, nil
+}
+
+// scan reads every record to find the latest one for each page, leaving the
+// file positioned at its end.
+func (f *forwardIndex) scan() error {
+	reader := bufio.NewReaderSize(f.file, 1024*1024)
+	var offset int64 = 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		} else if err == io.EOF {
+			// A torn final record from an interrupted run, overwrite it
+			log.Printf("wxindexer/forward: dropping incomplete record at offset %d", offset)
+			if err := f.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var record struct {
+			ID int64
+			URL string
+			Deleted bool
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		f.track(record.ID, record.URL, offset, record.Deleted)
+		offset += int64(len(line))
+	}
+	f.size = offset
+	log.Printf("wxindexer/forward: found %d pages in %d bytes of existing index", len(f.offsets), f.size)
+	_, err := f.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// track records that the latest record for a page is at offset.
+func (f *forwardIndex) track(id int64, url string, offset int64, deleted bool) {
+	// A moved page is no longer found under its old URL
+	if previous, ok := f.urls[id]; ok && previous != url {
+		delete(f.ids, previous)
+	}
+	if deleted {
+		delete(f.offsets, id)
+		delete(f.ids, url)
+		delete(f.urls, id)
+		return
+	}
+	f.offsets[id] = offset
+	f.ids[url] = id
+	f.urls[id] = url
+}
+
+// resolve returns the ID of the indexed page with url, or 0 if there is none.
+func (f *forwardIndex) resolve(url string) int64 {
+	return f.ids[url]
+}
+
+// lookup returns the latest record for the page with id, or nil if the index
+// has none.
+func (f *forwardIndex) lookup(id int64) (*containers.PageTF, error) {
+	offset, ok := f.offsets[id]
+	if !ok {
+		return nil, nil
+	}
+	// The record may still be sitting in the write buffer
+	if offset >= f.size - int64(f.writer.Buffered()) {
+		if err := f.writer.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(f.file, offset, f.size - offset))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var page containers.PageTF
+	if err := json.Unmarshal(line, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (f *forwardIndex) append(page containers.PageTF) error {
+	m_page, err := json.Marshal(page)
+	if err != nil {
+		return err
+	}
+	if f.offsets != nil {
+		f.track(page.ID, page.URL, f.size, page.Deleted)
+	}
+	f.writer.Write(m_page)
+	f.writer.Write([]byte("\n"))
+	f.size += int64(len(m_page)) + 1
+	return nil
+}
+
+// flush writes out buffered records and syncs them to disk.
+func (f *forwardIndex) flush() error {
+	if err := f.writer.Flush(); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+func (f *forwardIndex) close() error {
+	if err := f.flush(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
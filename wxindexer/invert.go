@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"wxindexer/containers"
+	"wxindexer/segment"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// runInvert builds an inverted index segment from the forward index. The
+// forward index is read twice, first to find the latest record of each page,
+// then to add those records to the segment, so only their offsets and URLs
+// and the postings buffered by the builder are held in memory. The text of
+// links and the titles of redirects are credited to the pages they lead to.
+func runInvert(opts *options) {
+	file, err := os.Open(opts.input)
+	if err != nil {
+		log.Fatalf("wxindexer/invert: %s", err)
+	}
+	defer file.Close()
+
+	latest, err := latestRecords(file)
+	if err != nil {
+		log.Fatalf("wxindexer/invert: failed to scan %s: %s", opts.input, err)
+	}
+	log.Printf("wxindexer/invert: found %d pages in %s", len(latest), opts.input)
+
+	builder, err := segment.NewBuilder(opts.segment, opts.memory << 20)
+	if err != nil {
+		log.Fatalf("wxindexer/invert: %s", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		panic(err)
+	}
+	if err := addRecords(file, latest, newTargets(latest), builder); err != nil {
+		log.Fatalf("wxindexer/invert: failed to add pages: %s", err)
+	}
+
+	meta, err := builder.Finish(recordedAnalyzer(opts.redis))
+	if err != nil {
+		log.Fatalf("wxindexer/invert: failed to write segment: %s", err)
+	}
+	log.Printf("wxindexer/invert: wrote segment of %d pages and %d terms to %s", meta.Docs, meta.Terms, opts.segment)
+}
+
+// latestRecord locates the latest record of a page in the forward index.
+type latestRecord struct {
+	offset int64
+	url string
+	// redirect is the URL the page redirects to, or "" if it isn't a redirect
+	redirect string
+}
+
+// latestRecords returns the latest record of each page in the forward index,
+// in the order they are in it, leaving out deleted pages. A page's doc number
+// is its index in the result.
+func latestRecords(file *os.File) ([]latestRecord, error) {
+	records := make(map[int64]latestRecord)
+	var offset int64 = 0
+	err := readRecords(file, func(line []byte) error {
+		var record struct {
+			ID int64
+			URL string
+			Redirect *string
+			Deleted bool
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		if record.Deleted {
+			delete(records, record.ID)
+		} else {
+			latest := latestRecord{offset: offset, url: record.URL}
+			if record.Redirect != nil {
+				latest.redirect = *record.Redirect
+			}
+			records[record.ID] = latest
+		}
+		offset += int64(len(line))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make([]latestRecord, 0, len(records))
+	for _, record := range records {
+		latest = append(latest, record)
+	}
+	slices.SortFunc(latest, func(a, b latestRecord) int {
+		return cmp.Compare(a.offset, b.offset)
+	})
+	return latest, nil
+}
+
+// targets finds the docs of the pages that links and redirects lead to.
+type targets struct {
+	docs map[string]uint32
+	// redirects holds the URL each redirect leads to, by its doc
+	redirects map[uint32]string
+}
+
+func newTargets(latest []latestRecord) *targets {
+	t := &targets{docs: make(map[string]uint32, len(latest)), redirects: make(map[uint32]string)}
+	for doc, record := range latest {
+		t.docs[record.url] = uint32(doc)
+		if record.redirect != "" {
+			t.redirects[uint32(doc)] = record.redirect
+		}
+	}
+	return t
+}
+
+// redirect returns the doc of the page a redirect to url leads to, if it is
+// in the segment. Like MediaWiki, it doesn't follow a redirect to a redirect.
+func (t *targets) redirect(url string) (uint32, bool) {
+	// Titles can't hold a "#", so an escaped one starts a section
+	url, _, _ = strings.Cut(url, "%23")
+	doc, found := t.docs[url]
+	if !found {
+		return 0, false
+	}
+	if _, redirect := t.redirects[doc]; redirect {
+		return 0, false
+	}
+	return doc, true
+}
+
+// link returns the doc of the page a link to url leads to, following it if
+// it is a redirect, if it is in the segment.
+func (t *targets) link(url string) (uint32, bool) {
+	doc, found := t.docs[url]
+	if !found {
+		return 0, false
+	}
+	if target, redirect := t.redirects[doc]; redirect {
+		return t.redirect(target)
+	}
+	return doc, true
+}
+
+// addRecords adds the latest records to the segment, in the order they are in
+// the forward index.
+func addRecords(file *os.File, latest []latestRecord, targets *targets, builder *segment.Builder) error {
+	var offset int64 = 0
+	uncounted := 0
+	uncredited := 0
+	defer func() {
+		if uncounted > 0 {
+			log.Printf("wxindexer/invert: WARNING: %d pages were indexed before term counts were recorded, and score 0 under BM25, reindex them to fix", uncounted)
+		}
+		if uncredited > 0 {
+			log.Printf("wxindexer/invert: WARNING: %d pages were indexed before the text of their links was recorded by target, and don't credit it to the pages they link to, reindex them to fix", uncredited)
+		}
+	}()
+	return readRecords(file, func(line []byte) error {
+		at := offset
+		offset += int64(len(line))
+		if len(latest) == 0 || latest[0].offset != at {
+			return nil
+		}
+		latest = latest[1:]
+
+		var page containers.PageTF
+		if err := json.Unmarshal(line, &page); err != nil {
+			return err
+		}
+		if page.Redirect == nil && page.Counts == nil && len(page.Words) > 0 {
+			uncounted++
+		}
+		if page.Anchors == nil && len(page.Fields[containers.FieldAnchors]) > 0 {
+			uncredited++
+		}
+		return addPage(&page, targets, builder)
+	})
+}
+
+// addPage adds page to the doc table, along with its own terms and those of
+// each of its fields, and credits the text of its links and its title as a
+// redirect to the pages they lead to.
+func addPage(page *containers.PageTF, targets *targets, builder *segment.Builder) error {
+	entry := segment.Doc{ID: page.ID, URL: page.URL, Title: page.Title, Length: page.Length}
+	if page.Redirect != nil {
+		entry.Redirect = *page.Redirect
+	}
+	entry.FieldLengths = make(map[string]int)
+	for field, length := range page.FieldLengths {
+		if !field.Credited() {
+			entry.FieldLengths[string(field)] = length
+		}
+	}
+	doc, err := builder.AddDoc(entry)
+	if err != nil {
+		return err
+	}
+
+	if page.Redirect != nil {
+		if target, found := targets.redirect(*page.Redirect); found {
+			for term, count := range page.FieldCounts[containers.FieldRedirects] {
+				if err := builder.Credit(containers.FieldRedirects, term, target, count); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for link, counts := range page.Anchors {
+		target, found := targets.link(link)
+		if !found {
+			continue
+		}
+		for term, count := range counts {
+			if err := builder.Credit(containers.FieldAnchors, term, target, count); err != nil {
+				return err
+			}
+		}
+	}
+
+	for term, tf := range page.Words {
+		if err := builder.Add(term, doc, tf, page.Counts[term], nil); err != nil {
+			return err
+		}
+	}
+	for field, frequencies := range page.Fields {
+		if field.Credited() {
+			continue
+		}
+		for term, tf := range frequencies {
+			count := page.FieldCounts[field][term]
+			positions := page.Positions[field][term]
+			if err := builder.Add(segment.FieldTerm(string(field), term), doc, tf, count, positions); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readRecords calls fn with each complete line of the forward index, including
+// its newline. A torn final record from an interrupted run is skipped.
+func readRecords(file *os.File, fn func(line []byte) error) error {
+	reader := bufio.NewReaderSize(file, 1024*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		} else if err == io.EOF {
+			log.Printf("wxindexer/invert: skipping incomplete final record")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+}
+
+// recordedAnalyzer returns the ID of the analyzer recorded alongside the
+// document frequencies in redis, or "" if it can't be read.
+func recordedAnalyzer(addr string) string {
+	rdb := newRedisClient(addr)
+	defer rdb.Close()
+	analyzer, err := rdb.Get(ctx, "analyzer").Result()
+	if err == redis.Nil {
+		log.Printf("wxindexer/invert: no analyzer recorded in %s", addr)
+	} else if err != nil {
+		log.Printf("wxindexer/invert: failed to read the analyzer from %s: %s", addr, err)
+	}
+	return analyzer
+}
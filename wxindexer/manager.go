@@ -2,21 +2,21 @@ package main
 
 import (
 	"log"
-	"net"
 	"os"
-	"io"
 	"time"
 	"bufio"
 	"sync"
 	"fmt"
 	"sort"
+	"errors"
+	"io/fs"
 
 	"common"
+	"wxindexer/analyzer"
 	"wxindexer/cleaners"
 	"wxindexer/containers"
 	"wxindexer/pagerank"
 
-	"github.com/vmihailenco/msgpack/v5"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -25,89 +25,130 @@ var (
 	reader_group sync.WaitGroup
 	indexer_group sync.WaitGroup
 	writer_group sync.WaitGroup
+	mapper_group sync.WaitGroup
+)
+
+const (
+	default_output = "./localdata/.tf_output.jsonl"
+	default_graph = "./localdata/pagegraph/"
+	default_redis = "localhost:6380"
+	default_segment = "./localdata/segment/"
 )
 
 func main() {
+	args := os.Args[1:]
+	command := "index"
+	if len(args) > 0 && (args[0] == "index" || args[0] == "pagerank" || args[0] == "merge" || args[0] == "invert" || args[0] == "search") {
+		command = args[0]
+		args = args[1:]
+	}
 
-	pagerank.LoadStructures("./localdata/pagegraph/")
-	
-	pagerank.AddPage(containers.PageLinkData{
-		URL: "a",
-		Links: &containers.Set[string]{"b": {}},
-		Redirect: nil,
-	})
-	pagerank.Pprint()
-	pagerank.AddPage(containers.PageLinkData{
-		URL: "b",
-		Links: &containers.Set[string]{"a": {}},
-		Redirect: nil,
-	})
-	pagerank.Pprint()
-	for i := range(10) {
-		pagerank.AddPage(containers.PageLinkData{
-			URL: strconv.Itoa(i),
-			Links: &containers.Set[string]{"a": {}},
-			Redirect: nil,
-		})
+	switch command {
+	case "pagerank":
+		runPageRank(parsePageRankArgs(args))
+	case "merge":
+		runMerge(parseMergeArgs(args))
+	case "invert":
+		runInvert(parseInvertArgs(args))
+	case "search":
+		runSearch(parseSearchArgs(args))
+	default:
+		runIndex(parseIndexArgs(args))
 	}
+}
+
+func runPageRank(opts *options) {
+	if opts.if_dirty && !pagerank.IsDirty(opts.graph) {
+		log.Println("wxindexer/manager: page graph unchanged since the last run, skipping PageRank")
+		return
+	}
+	pagerank.LoadStructures(opts.graph)
 	pagerank.PreProcess()
-	pagerank.Pprint()
-	
-	pagerank.PreProcess()
-	var result = pagerank.RunPageRank(20)
-	
-	var max_val float64 = 0
-	var max_url string = ""
-	var result = pagerank.GetScores()
+	var result = pagerank.RunPageRank(opts.graph, opts.iterations)
+
 	type KeyValuePair struct {
-        Key   string
-        Value float64
-    }
-    var pairs []KeyValuePair
-    for k, v := range result {
-        pairs = append(pairs, KeyValuePair{k, v})
-    }
-    sort.Slice(pairs, func(i, j int) bool {
-        return pairs[i].Value > pairs[j].Value
-    })
-	for i := range 30 {
+		Key   string
+		Value float64
+	}
+	var pairs []KeyValuePair
+	for k, v := range result {
+		pairs = append(pairs, KeyValuePair{k, v})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Value > pairs[j].Value
+	})
+	for i := range min(opts.top, len(pairs)) {
 		log.Printf("wxindexer/manager: Page %d: %s with score %f", i, pairs[i].Key, pairs[i].Value)
-    }
-	return
-
-	log.Println("wxindexer/manager: initalizing cleaner")
-	cleaner := cleaners.NewWikipediaCleaner()
+	}
+}
 
+func runIndex(opts *options) {
 	log.Println("wxindexer/manager: initializing redis client")
-	rdb := newRedisClient()
+	rdb := newRedisClient(opts.redis)
 
-	log.Println("wxindexer/manager: loading stopwords")
-	stopwords, err := loadStopWords()
+	// The recording, or the first producer to connect, says which wiki is
+	// being indexed
+	var receiver *receiver
+	var first *connection
+	var records *common.RecordReader
+	var hello *common.Hello
+	if opts.replay != "" {
+		var err error
+		records, err = common.OpenRecordFile(opts.replay)
+		if err != nil {
+			panic(err)
+		}
+		defer records.Close()
+		hello = records.Hello()
+		log.Printf("wxindexer/manager: replaying pages recorded by %s from %s", hello.Producer, opts.replay)
+	} else {
+		listener, err := common.Listen(opts.listen, opts.tls)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("wxindexer/manager: listening on %s", opts.listen)
+		defer listener.Close()
+
+		receiver, err = newReceiver(listener, opts.update, opts.producers, streamsPath(opts.output))
+		if err != nil {
+			log.Fatalf("wxindexer/manager: %s", err)
+		}
+		log.Println("wxindexer/manager: waiting for connection...")
+		first = receiver.accept()
+		hello = first.hello
+	}
+
+	profile, err := loadProfile(opts, hello.Profile)
 	if err != nil {
 		panic(err)
 	}
+	log.Printf("wxindexer/manager: using profile for %s (%s)", profile.Name, profile.Language)
 
-	addr := "/tmp/windexIPC.sock"
-	os.Remove(addr)
+	log.Println("wxindexer/manager: initalizing cleaner")
+	cleaner := cleaners.NewWikipediaCleaner(profile)
 
-	listener, err := net.Listen("unix", addr)
+	log.Println("wxindexer/manager: loading stopwords")
+	stopwords, err := loadStopWords(profile.Stopwords)
 	if err != nil {
 		panic(err)
 	}
-	defer listener.Close()
 
-	log.Println("wxindexer/manager: waiting for connection...")
-	connection, err := listener.Accept()
+	terms, err := analyzer.New(profile, stopwords)
 	if err != nil {
-		panic(err)
+		log.Fatalf("wxindexer/manager: %s", err)
+	}
+	if err := recordAnalyzer(rdb, terms); err != nil {
+		log.Fatalf("wxindexer/manager: %s", err)
 	}
-	defer connection.Close()
-	log.Println("wxindexer/manager: connection established")
+	log.Printf("wxindexer/manager: analyzing terms with %s", terms.ID())
 
-	decoder := msgpack.NewDecoder(connection)
+	forward, err := openForwardIndex(opts.output, opts.update)
+	if err != nil {
+		panic(err)
+	}
 
-	index_chan := make(chan common.PageData, 1000)
-	write_chan := make(chan containers.PageTF, 1000)
+	index_chan := make(chan queuedPage, 1000)
+	write_chan := make(chan indexedPage, 1000)
 	pg_map_chan := make(chan containers.PageLinkData, 1000)
 	stop_logging := make(chan bool)
 
@@ -129,51 +170,103 @@ func main() {
 	}(stop_logging)
 
 	reader_group.Add(1)
-	writer_group.Add(2)
+	writer_group.Add(1)
+	mapper_group.Add(1)
 	indexer_group.Add(workers)
 
-	var count int64 = 0
-	go socketReader(decoder, index_chan)
-	go jsonWriter(write_chan)
-	go pgMapper(pg_map_chan)
+	if records != nil {
+		go replayRecords(records, opts.replay_from, index_chan, write_chan, opts.update)
+		go jsonWriter(write_chan, forward, rdb, pg_map_chan, terms, opts.update, func() {})
+	} else {
+		go receiver.serve(first, index_chan, write_chan)
+		go jsonWriter(write_chan, forward, rdb, pg_map_chan, terms, opts.update, receiver.flushed)
+	}
+	go pgMapper(pg_map_chan, opts.graph, opts.update)
 
 	for i := range workers {
-		go indexer(i, cleaner, stopwords, rdb, index_chan, write_chan, pg_map_chan)
+		go indexer(i, cleaner, terms, opts.positions, index_chan, write_chan, pg_map_chan)
 	}
 
+	if receiver != nil {
+		receiver.wait()
+	}
 	reader_group.Wait()
 	close(index_chan)
 	indexer_group.Wait()
 	close(write_chan)
-	close(pg_map_chan)
 	writer_group.Wait()
+	// Everything is on disk, so the producers can finish
+	if receiver != nil {
+		receiver.close()
+	}
+	close(pg_map_chan)
+	mapper_group.Wait()
 	close(stop_logging)
+}
 
-	log.Printf("Num words: %d", count)
+func newRedisClient(addr string) *redis.Client {
+	return redis.NewClient(&redis.Options {
+		Addr: addr,
+	})
+}
 
-	/*
-	result = pagerank.RunPageRank(20)
-	max_val = 0
-	max_url = ""
-	for key, value := range result {
-		if value > max_val {
-			max_val = value
-			max_url = key
+// recordAnalyzer saves the ID of terms alongside the document frequencies,
+// for searches to analyze queries the same way, refusing to mix terms from a
+// different analyzer into an existing index.
+func recordAnalyzer(rdb *redis.Client, terms *analyzer.Analyzer) error {
+	recorded, err := rdb.Get(ctx, "analyzer").Result()
+	if err == redis.Nil {
+		pages, err := rdb.Exists(ctx, "total_pages").Result()
+		if err != nil {
+			return err
+		}
+		if pages != 0 {
+			return fmt.Errorf("%s holds document frequencies with no analyzer recorded, index into an empty server", rdb.Options().Addr)
 		}
+		return rdb.Set(ctx, "analyzer", terms.ID(), 0).Err()
+	} else if err != nil {
+		return err
 	}
-	log.Printf("wxindexer/manager: Found highest ranking page %s with score %f", max_url, max_val)
-	*/
+	if recorded != terms.ID() {
+		return fmt.Errorf("%s holds terms from analyzer %s, not %s", rdb.Options().Addr, recorded, terms.ID())
+	}
+	return nil
 }
 
-func newRedisClient() *redis.Client {
-	return redis.NewClient(&redis.Options {
-		Addr: "localhost:6380",
-	})
+// loadProfile selects the profile of the wiki being indexed: the one derived
+// from -siteinfo, the one sent by the producer, or English Wikipedia, with
+// -profile and -stemmer applied on top.
+func loadProfile(opts *options, sent *common.WikiProfile) (*common.WikiProfile, error) {
+	profile := common.EnglishWikipedia()
+	if sent != nil {
+		profile = sent
+	}
+	if opts.siteinfo != "" {
+		site, err := common.LoadSiteInfo(opts.siteinfo)
+		if err != nil {
+			return nil, err
+		}
+		profile = common.ProfileFromSiteInfo(site)
+	}
+	if opts.profile != "" {
+		overrides, err := common.LoadProfile(opts.profile)
+		if err != nil {
+			return nil, err
+		}
+		profile.Merge(overrides)
+	}
+	if opts.stemmer != "" {
+		profile.Stemmer = opts.stemmer
+	}
+	return profile, nil
 }
 
-func loadStopWords() (*containers.Set[string], error) {
-	file, err := os.Open("./data/stopwords")
-	if err != nil {
+func loadStopWords(path string) (*containers.Set[string], error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("wxindexer/manager: no stopword list at %s, indexing without stopwords", path)
+		return containers.NewSet[string](), nil
+	} else if err != nil {
 		return nil, err
 	}
 	defer file.Close()
@@ -192,47 +285,20 @@ func loadStopWords() (*containers.Set[string], error) {
 	return stopwords, nil
 }
 
-func socketReader(decoder *msgpack.Decoder, out_chan chan <- common.PageData) {
-	var diff = 0
-	var wait int64 = 0
-
-	for {
-		var page common.PageData
-		start := time.Now()
-		err := decoder.Decode(&page)
-		wait = time.Since(start).Microseconds() + wait
-		if diff >= 1000 {
-			//log.Println("wxindexer/reader: avg recieve wait time:", wait / 1000)
-			diff = 0
-			wait = 0
-		}
-		diff++
-		if err != nil {
-			if err == io.EOF {
-				log.Println("wxindexer/reader: connection closed by sender. Exiting.")
-				reader_group.Done()
-				return
-			}
-			log.Printf("wxindexer/reader: decoder error: %v", err)
-		}
-		out_chan <- page
-	}
-}
-
 func indexer(
 	id int,
 	cleaner cleaners.Cleaner,
-	stopwords *containers.Set[string],
-	rdb *redis.Client,
-	in_chan <- chan common.PageData,
-	write_chan chan <- containers.PageTF,
+	terms *analyzer.Analyzer,
+	record_positions bool,
+	in_chan <- chan queuedPage,
+	write_chan chan <- indexedPage,
 	pg_map_chan chan <- containers.PageLinkData) {
 
 	var tf containers.PageTF
 	for {
 		if page, ok := <- in_chan; ok {
-			tf = index(page, cleaner, stopwords, rdb)
-			write_chan <- tf
+			tf = index(page.data, cleaner, terms, record_positions)
+			write_chan <- indexedPage{tf: tf, from: page.from}
 			//pg_map_chan <- containers.PageLinkData{URL: tf.URL, Links: containers.SetFromSlice(tf.Links), Redirect: tf.Redirect}
 		} else {
 			log.Printf("wxindexer/indexer@%d: exiting\n", id)
@@ -242,11 +308,31 @@ func indexer(
 	indexer_group.Done()
 }
 
-func pgMapper(pg_map_chan <- chan containers.PageLinkData) {
+func pgMapper(pg_map_chan <- chan containers.PageLinkData, graph_path string, update bool) {
 	//pagerank.LoadPageWeb("./localdata/pagegraph/.pagegraph")
+	if update {
+		pagerank.LoadStructures(graph_path)
+	}
 	for pg := range pg_map_chan {
-		pagerank.AddPage(pg)
+		if pg.Deleted {
+			pagerank.RemovePage(pg)
+		} else if pg.MovedFrom != "" {
+			pagerank.RenamePage(pg.MovedFrom, pg.URL)
+		} else if update {
+			pagerank.UpdatePage(pg)
+		} else {
+			pagerank.AddPage(pg)
+		}
+	}
+
+	// Save the graph for the next PageRank run, or merge, to pick up
+	if err := os.MkdirAll(graph_path, 0755); err != nil {
+		panic(err)
+	}
+	pagerank.DumpStructures(graph_path)
+	if err := pagerank.MarkDirty(graph_path); err != nil {
+		log.Printf("wxindexer/pgmapper: failed to mark page graph dirty: %s", err)
 	}
 	log.Println("wxindexer/pgmapper: exiting")
-	writer_group.Done()
+	mapper_group.Done()
 }
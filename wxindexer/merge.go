@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"wxindexer/containers"
+	"wxindexer/pagerank"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Pages are split between sharded indexers by the producer, so no page is
+// counted by more than one shard and the merged document frequencies are
+// just the sums of the shards'.
+
+func runMerge(opts *options) {
+	if len(opts.shard_redis) > 0 {
+		rdb := newRedisClient(opts.redis)
+		if err := mergeDocumentFrequencies(rdb, opts.shard_redis); err != nil {
+			log.Fatalf("wxindexer/merge: %s", err)
+		}
+	}
+
+	if len(opts.shard_graphs) > 0 {
+		pagerank.MergeStructures(opts.shard_graphs)
+		if err := os.MkdirAll(opts.graph, 0755); err != nil {
+			panic(err)
+		}
+		pagerank.DumpStructures(opts.graph)
+		if err := pagerank.MarkDirty(opts.graph); err != nil {
+			log.Printf("wxindexer/merge: failed to mark page graph dirty: %s", err)
+		}
+	}
+}
+
+// mergeDocumentFrequencies adds the df_map, field document frequencies,
+// total_pages and total lengths of each shard's redis server to rdb's, which
+// must start out without any. The shards must have been indexed with the same
+// analyzer, which is recorded in rdb.
+func mergeDocumentFrequencies(rdb *redis.Client, shards []string) error {
+	keys := []string{"df_map", "total_pages", "analyzer"}
+	for _, field := range containers.Fields {
+		if !field.Credited() {
+			keys = append(keys, field.DFKey())
+		}
+	}
+	keys = append(keys, lengthKeys()...)
+	existing, err := rdb.Exists(ctx, keys...).Result()
+	if err != nil {
+		return err
+	}
+	if existing != 0 {
+		return fmt.Errorf("%s already has document frequencies, merge into an empty server", rdb.Options().Addr)
+	}
+
+	analyzer := ""
+	for i, addr := range shards {
+		shard := newRedisClient(addr)
+		shard_analyzer, err := shard.Get(ctx, "analyzer").Result()
+		if err != nil && err != redis.Nil {
+			shard.Close()
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+		if i == 0 {
+			analyzer = shard_analyzer
+		} else if shard_analyzer != analyzer {
+			shard.Close()
+			return fmt.Errorf("%s was indexed with analyzer %q, not %q like the shards before it", addr, shard_analyzer, analyzer)
+		}
+		pages, err := shard.Get(ctx, "total_pages").Int64()
+		if err != nil && err != redis.Nil {
+			shard.Close()
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+		words, err := mergeShardFrequencies(rdb, shard, "df_map")
+		for _, field := range containers.Fields {
+			if err == nil && !field.Credited() {
+				_, err = mergeShardFrequencies(rdb, shard, field.DFKey())
+			}
+		}
+		if err == nil {
+			err = mergeLengths(rdb, shard)
+		}
+		shard.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+		if err := rdb.IncrBy(ctx, "total_pages", pages).Err(); err != nil {
+			return err
+		}
+		log.Printf("wxindexer/merge: merged %d pages and %d words from %s", pages, words, addr)
+	}
+	if analyzer != "" {
+		return rdb.Set(ctx, "analyzer", analyzer, 0).Err()
+	}
+	return nil
+}
+
+// lengthKeys returns the keys holding total lengths, of the page and of each
+// field.
+func lengthKeys() []string {
+	keys := []string{"total_length"}
+	for _, field := range containers.Fields {
+		if !field.Credited() {
+			keys = append(keys, field.LengthKey())
+		}
+	}
+	return keys
+}
+
+// mergeLengths adds the total lengths of the shard to rdb's.
+func mergeLengths(rdb *redis.Client, shard *redis.Client) error {
+	for _, key := range lengthKeys() {
+		length, err := shard.Get(ctx, key).Int64()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := rdb.IncrBy(ctx, key, length).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeShardFrequencies adds the document frequencies in the shard's hash key
+// to rdb's, returning the number of words in it. HSCAN can return a word more
+// than once if the hash is resized while it runs, so repeats are skipped.
+func mergeShardFrequencies(rdb *redis.Client, shard *redis.Client, key string) (int, error) {
+	var cursor uint64 = 0
+	var words = 0
+	seen := make(map[string]bool)
+	for {
+		fields, next, err := shard.HScan(ctx, key, cursor, "", 10000).Result()
+		if err != nil {
+			return words, err
+		}
+		_, err = rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i := 0; i + 1 < len(fields); i += 2 {
+				if seen[fields[i]] {
+					continue
+				}
+				seen[fields[i]] = true
+				words++
+				var count int64
+				if _, err := fmt.Sscan(fields[i + 1], &count); err != nil {
+					return fmt.Errorf("%s[%s]: %w", key, fields[i], err)
+				}
+				pipe.HIncrBy(ctx, key, fields[i], count)
+			}
+			return nil
+		})
+		if err != nil {
+			return words, err
+		}
+		cursor = next
+		if cursor == 0 {
+			return words, nil
+		}
+	}
+}
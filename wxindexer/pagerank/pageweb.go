@@ -27,6 +27,7 @@ const nullID NodeID = math.MaxUint32
 const fln_pg_graph = "pageweb"
 const fln_id_to_url = "idtourl"
 const fln_pg_score = "scores"
+const fln_dirty = "dirty"
 const damping_factor float64 = 0.85
 
 var pg_graph = make(PageGraph)
@@ -71,7 +72,7 @@ func AddPage(page containers.PageLinkData) {
 
 	for link := range *page.Links {
 		edges++
-		if id, ok := url_to_id[link]; ok {
+		if id, ok := url_to_id[link]; ok && pg_graph[id] != nil {
 			(*pg_graph[id]).Incoming = append((*pg_graph[id]).Incoming, url_to_id[page.URL])
 		} else {
 			var new_id = createID(link)
@@ -84,6 +85,90 @@ func AddPage(page containers.PageLinkData) {
 	}
 }
 
+// UpdatePage replaces the links of a page that may already be in the graph,
+// removing it from the incoming links of the pages in page.Replaced first.
+func UpdatePage(page containers.PageLinkData) {
+	id := createID(page.URL)
+	if page.Replaced != nil {
+		for link := range *page.Replaced {
+			if target, ok := url_to_id[link]; ok && pg_graph[target] != nil {
+				(*pg_graph[target]).Incoming = slices.DeleteFunc((*pg_graph[target]).Incoming, func(incoming NodeID) bool {
+					return incoming == id
+				})
+			}
+		}
+	}
+	// PreProcess removes redirect pages from the saved graph
+	if pg_graph[id] == nil {
+		pg_graph[id] = &PageLinks{
+			Incoming: make([]NodeID, 0),
+			NumOutgoing: 0,
+			Redirect: nullID,
+		}
+	}
+	AddPage(page)
+}
+
+// RemovePage removes a page from the graph along with the links to it and
+// the links from it, which are given in page.Replaced.
+func RemovePage(page containers.PageLinkData) {
+	id, ok := url_to_id[page.URL]
+	if !ok {
+		return
+	}
+	if page.Replaced != nil {
+		for link := range *page.Replaced {
+			if target, ok := url_to_id[link]; ok && pg_graph[target] != nil {
+				(*pg_graph[target]).Incoming = slices.DeleteFunc((*pg_graph[target]).Incoming, func(incoming NodeID) bool {
+					return incoming == id
+				})
+			}
+		}
+	}
+	if pg_graph[id] != nil {
+		for _, source := range (*pg_graph[id]).Incoming {
+			if pg_graph[source] != nil && (*pg_graph[source]).NumOutgoing > 0 {
+				(*pg_graph[source]).NumOutgoing--
+			}
+		}
+	}
+	delete(pg_graph, id)
+}
+
+// RenamePage moves a page to a new URL, keeping its links. If a page already
+// had the new URL, such as a redirect the move replaced, links to it are
+// taken over by the moved page.
+func RenamePage(from string, to string) {
+	id, ok := url_to_id[from]
+	if !ok {
+		return
+	}
+	if other, ok := url_to_id[to]; ok && other != id {
+		if pg_graph[other] != nil && pg_graph[id] != nil {
+			(*pg_graph[id]).Incoming = append((*pg_graph[id]).Incoming, (*pg_graph[other]).Incoming...)
+		}
+		delete(pg_graph, other)
+		// IDs index pg_score, so the old one can't be reused
+		id_to_url[other] = ""
+	}
+	delete(url_to_id, from)
+	url_to_id[to] = id
+	id_to_url[id] = to
+}
+
+// MarkDirty records that the graph saved at path has changed since PageRank
+// was last run over it.
+func MarkDirty(path string) error {
+	return os.WriteFile(filepath.Join(path, fln_dirty), nil, 0644)
+}
+
+// IsDirty reports whether the graph saved at path has changed since PageRank
+// was last run over it.
+func IsDirty(path string) bool {
+	_, err := os.Stat(filepath.Join(path, fln_dirty))
+	return err == nil
+}
+
 func createID(url string) NodeID {
 	var new_id NodeID
 	if id, ok := url_to_id[url]; ok {
@@ -170,6 +255,10 @@ func LoadStructures(path string) {
 	next_index = NodeID(len(id_to_url))
 	url_to_id = make(map[string]NodeID, len(id_to_url))
 	for id, url := range id_to_url {
+		// Left behind by RenamePage
+		if url == "" {
+			continue
+		}
 		url_to_id[url] = NodeID(id)
 	}
 }
@@ -215,7 +304,63 @@ func runIteration() {
 	log.Printf("Num broken incoming: %d", broken_incoming)
 }
 
-func RunPageRank(iterations int) map[string]float64 {
+// MergeStructures replaces the graph with the union of the graphs saved at
+// paths, each built by an indexer from its own shard of the pages. Pages are
+// matched up by URL. Only the shard holding a page knows its outgoing links,
+// the others just know of links to it, so counts are added up.
+func MergeStructures(paths []string) {
+	pg_graph = make(PageGraph)
+	pg_score = make([]float64, 0)
+	url_to_id = make(map[string]NodeID)
+	id_to_url = make([]string, 0)
+	next_index = 0
+
+	for _, path := range paths {
+		log.Printf("wxindexer/pageweb: merging page web structures from: %s", path)
+		var shard_graph PageGraph
+		var shard_urls []string
+		if err := readStructure(filepath.Join(path, fln_pg_graph), &shard_graph); err != nil {
+			log.Printf("wxindexer/pageweb: Failed to load pg_graph: %s", err)
+			continue
+		}
+		if err := readStructure(filepath.Join(path, fln_id_to_url), &shard_urls); err != nil {
+			log.Printf("wxindexer/pageweb: Failed to load id_to_url: %s", err)
+			continue
+		}
+
+		// IDs of removed pages may still be linked to, and are left out
+		mapID := func(id NodeID) NodeID {
+			if id == nullID || int(id) >= len(shard_urls) || shard_urls[id] == "" {
+				return nullID
+			}
+			return createID(shard_urls[id])
+		}
+		for id, links := range shard_graph {
+			merged_id := mapID(id)
+			if merged_id == nullID || links == nil {
+				continue
+			}
+			merged := pg_graph[merged_id]
+			if merged == nil {
+				merged = &PageLinks{Incoming: make([]NodeID, 0), Redirect: nullID}
+				pg_graph[merged_id] = merged
+			}
+			for _, source := range links.Incoming {
+				if source_id := mapID(source); source_id != nullID {
+					merged.Incoming = append(merged.Incoming, source_id)
+				}
+			}
+			merged.NumOutgoing += links.NumOutgoing
+			if redirect := mapID(links.Redirect); redirect != nullID {
+				merged.Redirect = redirect
+			}
+		}
+		log.Printf("wxindexer/pageweb: Merged pg_graph of size: %d", len(shard_graph))
+	}
+	log.Printf("wxindexer/pageweb: Merged web of %d nodes", len(pg_graph))
+}
+
+func RunPageRank(path string, iterations int) map[string]float64 {
 	for i := range iterations {
 		log.Printf("wxindexer/pageweb: running PageRank iteration %d", i)
 		copyPageScore()
@@ -223,7 +368,8 @@ func RunPageRank(iterations int) map[string]float64 {
 		//PprintScores()
 		log.Printf("wxindexer/pageweb: Total rank delta over iteration %d: %v", i, getDelta())
 	}
-	DumpStructures("./localdata/pagegraph/")
+	DumpStructures(path)
+	os.Remove(filepath.Join(path, fln_dirty))
 	return exportPgScores()
 }
 
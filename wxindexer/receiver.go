@@ -0,0 +1,691 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"common"
+	"wxindexer/containers"
+)
+
+// How often the forward index is flushed to disk and producers are told what
+// has been durably indexed
+const ack_interval = 250 * time.Millisecond
+
+// How long a producer has to complete the handshake once connected
+const handshake_timeout = 30 * time.Second
+
+// producerStream tracks the sequenced messages of one producer's stream,
+// which lives on across reconnects.
+type producerStream struct {
+	id string
+	// read_mu is held by the connection reading the stream, so one that
+	// replaces a lost connection waits for the old one to let go
+	read_mu sync.Mutex
+	// received is the highest sequence number passed down the pipeline
+	received uint64
+	// end is the sequence number of the stream's end message, once received
+	end uint64
+
+	mu sync.Mutex
+	// completed is the sequence number up to which every message has been
+	// written, and ahead holds those written out of order beyond it
+	completed uint64
+	ahead map[uint64]bool
+	// durable is the sequence number up to which every message has been
+	// written and flushed to disk
+	durable uint64
+	// conn is the connection currently reading the stream
+	conn *connection
+	ended bool
+}
+
+// delivery identifies a sequenced message, so it can be acknowledged once
+// it has been written.
+type delivery struct {
+	stream *producerStream
+	seq uint64
+}
+
+// queuedPage is a received page waiting to be indexed.
+type queuedPage struct {
+	data common.PageData
+	from delivery
+}
+
+// indexedPage is a page waiting to be written to the forward index.
+type indexedPage struct {
+	tf containers.PageTF
+	from delivery
+}
+
+// done marks the message as written, which the indexers may do out of
+// order.
+func (d delivery) done() {
+	if d.stream == nil {
+		return
+	}
+	s := d.stream
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d.seq != s.completed + 1 {
+		s.ahead[d.seq] = true
+		return
+	}
+	s.completed = d.seq
+	for s.ahead[s.completed + 1] {
+		delete(s.ahead, s.completed + 1)
+		s.completed++
+	}
+}
+
+// state returns what is to be saved of the stream once everything written
+// so far is on disk.
+func (s *producerStream) state() streamState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return streamState{Acked: s.completed, Ended: s.ended && s.completed >= s.end}
+}
+
+// flushed records that everything up to seq is on disk.
+func (s *producerStream) flushed(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.durable = max(s.durable, seq)
+}
+
+func (s *producerStream) acked() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.durable
+}
+
+// receiver accepts any number of producer connections and feeds the pages
+// they send into the pipeline, until every producer has ended its stream.
+type receiver struct {
+	listener net.Listener
+	update bool
+	// producers is how many streams have to end before the indexer finishes
+	producers int
+	profile *common.WikiProfile
+
+	// state_path is where the state of each stream is saved whenever the
+	// forward index is flushed, saved is what was last saved there, and
+	// resumable holds the streams saved by an earlier run that no producer
+	// has picked up again
+	state_path string
+	saved map[string]streamState
+	resumable map[string]streamState
+
+	mu sync.Mutex
+	streams map[string]*producerStream
+	ended int
+	finished bool
+	// done is closed once every stream has ended
+	done chan struct{}
+	// connected passes on the connections that complete the handshake
+	connected chan *connection
+	// connections counts connections still open, each waiting for what it
+	// sent to be acknowledged
+	connections sync.WaitGroup
+}
+
+// connection is an accepted producer connection.
+type connection struct {
+	conn net.Conn
+	hello *common.Hello
+	stream *producerStream
+	encoder *common.Encoder
+	decoder *common.Decoder
+	// stop_acks is closed when the connection is lost or replaced, and
+	// ended when the stream has ended on it
+	stop_acks chan struct{}
+	stop_once sync.Once
+	ended chan struct{}
+}
+
+// newReceiver takes connections from listener, saving the state of their
+// streams to state_path. When updating, producers can resume the streams
+// saved there by an earlier run, otherwise it starts out empty.
+func newReceiver(listener net.Listener, update bool, producers int, state_path string) (*receiver, error) {
+	r := &receiver{
+		listener: listener,
+		update: update,
+		producers: producers,
+		state_path: state_path,
+		saved: make(map[string]streamState),
+		resumable: make(map[string]streamState),
+		streams: make(map[string]*producerStream),
+		done: make(chan struct{}),
+		connected: make(chan *connection),
+	}
+	if update {
+		saved, err := loadStreams(state_path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(saved) > 0 {
+			log.Printf("wxindexer/receiver: %d streams can be resumed from %s", len(saved), state_path)
+		}
+		r.saved = saved
+		maps.Copy(r.resumable, saved)
+	} else if err := os.Remove(state_path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	go r.listen()
+	return r, nil
+}
+
+// streamsPath is where the state of the streams writing to the forward index
+// at output is saved.
+func streamsPath(output string) string {
+	return output + ".streams"
+}
+
+// streamState is what is saved of a stream, so its producer can resume it
+// when the indexer is restarted.
+type streamState struct {
+	// Acked is the sequence number up to which every message has been
+	// written and flushed to disk
+	Acked uint64
+	// Ended is set once the end of the stream is among them
+	Ended bool `json:",omitempty"`
+}
+
+func loadStreams(path string) (map[string]streamState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	streams := make(map[string]streamState)
+	if err := json.Unmarshal(data, &streams); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return streams, nil
+}
+
+// saveStreams atomically replaces the stream states at path, syncing them to
+// disk before returning.
+func saveStreams(path string, streams map[string]streamState) error {
+	data, err := json.MarshalIndent(streams, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp_path := path + ".tmp"
+	f, err := os.Create(tmp_path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp_path, path)
+}
+
+// accept waits for a producer to connect and complete the handshake. It
+// returns nil once every stream has ended.
+func (r *receiver) accept() *connection {
+	for {
+		select {
+		case c := <- r.connected:
+			if r.attach(c) {
+				return c
+			}
+			log.Printf("wxindexer/receiver: all streams have ended, turning away %s", c.hello.Producer)
+			c.conn.Close()
+		case <- r.done:
+			return nil
+		}
+	}
+}
+
+// listen accepts connections until the listener is closed, leaving each to
+// complete the handshake on its own so a slow producer holds up no other.
+func (r *receiver) listen() {
+	for {
+		conn, err := r.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			panic(err)
+		}
+		go r.handshake(conn)
+	}
+}
+
+// handshake greets the producer on conn, dropping it if it takes longer than
+// handshake_timeout, and passes the connection on to accept.
+func (r *receiver) handshake(conn net.Conn) {
+	err := conn.SetDeadline(time.Now().Add(handshake_timeout))
+	var hello *common.Hello
+	var encoder *common.Encoder
+	var decoder *common.Decoder
+	if err == nil {
+		hello, encoder, decoder, err = common.Accept(conn, r.acked)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		log.Printf("wxindexer/receiver: handshake failed: %v", err)
+		conn.Close()
+		return
+	}
+	log.Printf("wxindexer/receiver: connection established with %s (stream %s)", hello.Producer, hello.Stream)
+
+	c := &connection{
+		conn: conn,
+		hello: hello,
+		encoder: encoder,
+		decoder: decoder,
+		stop_acks: make(chan struct{}),
+		ended: make(chan struct{}),
+	}
+	select {
+	case r.connected <- c:
+	case <- r.done:
+		log.Printf("wxindexer/receiver: all streams have ended, turning away %s", hello.Producer)
+		conn.Close()
+	}
+}
+
+// acked returns what has already been acknowledged on the stream a producer
+// is connecting to, which is nothing if it is new. A producer resuming a
+// stream the indexer knows nothing of is refused, as the messages it had
+// acknowledged are lost.
+func (r *receiver) acked(hello *common.Hello) (uint64, error) {
+	r.mu.Lock()
+	stream, ok := r.streams[hello.Stream]
+	saved, resumable := r.resumable[hello.Stream]
+	r.mu.Unlock()
+	if ok {
+		return stream.acked(), nil
+	} else if resumable {
+		return saved.Acked, nil
+	} else if hello.Resumed {
+		return 0, fmt.Errorf("stream %s is unknown, restart the indexer with -update and the forward index the stream was written to", hello.Stream)
+	}
+	return 0, nil
+}
+
+// attach hands c the stream it belongs to, taking it over from any earlier
+// connection the producer has given up on. It reports false if the indexer
+// is no longer taking new streams.
+func (r *receiver) attach(c *connection) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stream, ok := r.streams[c.hello.Stream]
+	if !ok {
+		if r.finished {
+			return false
+		}
+		stream = &producerStream{id: c.hello.Stream, ahead: make(map[uint64]bool)}
+		// A stream saved by an earlier run carries on after what was
+		// acknowledged on it
+		if saved, resumable := r.resumable[c.hello.Stream]; resumable {
+			delete(r.resumable, c.hello.Stream)
+			stream.received = saved.Acked
+			stream.completed = saved.Acked
+			stream.durable = saved.Acked
+			if saved.Ended {
+				stream.end = saved.Acked
+			}
+			log.Printf("wxindexer/receiver: resuming stream %s after message %d", stream.id, saved.Acked)
+		}
+		r.streams[c.hello.Stream] = stream
+		r.checkProfile(c.hello)
+	}
+	c.stream = stream
+
+	stream.mu.Lock()
+	old := stream.conn
+	stream.conn = c
+	stream.mu.Unlock()
+	if old != nil {
+		log.Printf("wxindexer/receiver: stream %s reconnected, dropping its old connection", stream.id)
+		old.stop()
+	}
+
+	r.connections.Add(1)
+	go func() {
+		c.sendAcks()
+		r.connections.Done()
+	}()
+	return true
+}
+
+// checkProfile warns about producers sending pages from another wiki than
+// the first one, whose profile the indexer was set up with. r.mu must be
+// held.
+func (r *receiver) checkProfile(hello *common.Hello) {
+	if r.profile == nil {
+		r.profile = hello.Profile
+		return
+	}
+	if hello.Profile != nil && hello.Profile.Name != r.profile.Name {
+		log.Printf("wxindexer/receiver: WARNING: %s is sending pages from %s, but the index is set up for %s", hello.Producer, hello.Profile.Name, r.profile.Name)
+	}
+}
+
+// serve reads from first, and from every producer that connects after it,
+// until every stream has ended.
+func (r *receiver) serve(first *connection, out_chan chan <- queuedPage, write_chan chan <- indexedPage) {
+	reader_group.Add(1)
+	go r.read(first, out_chan, write_chan)
+	for {
+		c := r.accept()
+		if c == nil {
+			break
+		}
+		reader_group.Add(1)
+		go r.read(c, out_chan, write_chan)
+	}
+	reader_group.Done()
+}
+
+// read passes the pages from c down the pipeline until the stream ends or
+// the connection is lost, when the producer is left to reconnect.
+func (r *receiver) read(c *connection, out_chan chan <- queuedPage, write_chan chan <- indexedPage) {
+	defer reader_group.Done()
+	stream := c.stream
+	stream.read_mu.Lock()
+	defer stream.read_mu.Unlock()
+
+	stream.mu.Lock()
+	ended := stream.ended
+	stream.mu.Unlock()
+	// Lost before the end was acknowledged, or resumed after it, there's
+	// nothing left to read
+	if ended || stream.end != 0 || socketReader(c, out_chan, write_chan, r.update) {
+		close(c.ended)
+		r.streamEnded(stream)
+		return
+	}
+	c.stop()
+	stream.mu.Lock()
+	if stream.conn == c {
+		stream.conn = nil
+	}
+	stream.mu.Unlock()
+	log.Printf("wxindexer/receiver: waiting for %s to reconnect", c.hello.Producer)
+}
+
+func (r *receiver) streamEnded(stream *producerStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stream.mu.Lock()
+	already := stream.ended
+	stream.ended = true
+	stream.mu.Unlock()
+	if already {
+		return
+	}
+	r.ended++
+	log.Printf("wxindexer/receiver: %d of %d streams ended", r.ended, max(r.producers, len(r.streams)))
+	if !r.finished && r.ended >= r.producers && r.ended == len(r.streams) {
+		r.finished = true
+		close(r.done)
+	}
+}
+
+// wait blocks until every stream has ended and stops taking connections.
+func (r *receiver) wait() {
+	<- r.done
+	r.listener.Close()
+}
+
+// flushed records that everything written so far on every stream is on
+// disk. The state of the streams is saved before they are acknowledged, so
+// no producer drops a message the indexer would lose track of in a crash.
+func (r *receiver) flushed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	states := maps.Clone(r.resumable)
+	for id, stream := range r.streams {
+		states[id] = stream.state()
+	}
+	if !maps.Equal(states, r.saved) {
+		if err := saveStreams(r.state_path, states); err != nil {
+			log.Printf("wxindexer/receiver: failed to save the state of the streams, holding back acknowledgements: %v", err)
+			return
+		}
+		r.saved = states
+	}
+	for id, stream := range r.streams {
+		stream.flushed(states[id].Acked)
+	}
+}
+
+// close waits for the end of every stream to be acknowledged, once
+// everything has been written and flushed.
+func (r *receiver) close() {
+	r.connections.Wait()
+}
+
+func (c *connection) stop() {
+	c.stop_once.Do(func() {
+		close(c.stop_acks)
+	})
+}
+
+// sendAcks tells the producer how far its stream has been durably indexed
+// until the connection is lost, or until the end of the stream has been
+// acknowledged, when the connection is closed.
+func (c *connection) sendAcks() {
+	defer c.conn.Close()
+	ticker := time.NewTicker(ack_interval)
+	defer ticker.Stop()
+	var sent uint64 = 0
+	for {
+		select {
+		case <- ticker.C:
+		case <- c.stop_acks:
+			return
+		}
+		acked := c.stream.acked()
+		if acked > sent {
+			err := c.encoder.Encode(common.MsgAck, 0, &common.Ack{Seq: acked})
+			if err == nil {
+				err = c.encoder.Flush()
+			}
+			if err != nil {
+				log.Printf("wxindexer/receiver: failed to acknowledge %d: %v", acked, err)
+				return
+			}
+			sent = acked
+		}
+		select {
+		case <- c.ended:
+			if acked >= c.stream.end {
+				return
+			}
+		default:
+		}
+	}
+}
+
+// socketReader passes the pages read from c down the pipeline, dropping any
+// already received, until the stream ends or the connection is lost. It
+// reports whether the stream ended.
+func socketReader(
+	c *connection,
+	out_chan chan <- queuedPage,
+	write_chan chan <- indexedPage,
+	update bool,
+) bool {
+	stream := c.stream
+	var diff = 0
+	var wait int64 = 0
+
+	for {
+		start := time.Now()
+		message, err := c.decoder.Decode()
+		wait = time.Since(start).Microseconds() + wait
+		if diff >= 1000 {
+			//log.Println("wxindexer/reader: avg recieve wait time:", wait / 1000)
+			diff = 0
+			wait = 0
+		}
+		diff++
+		if err == io.EOF {
+			log.Printf("wxindexer/reader: connection closed by sender without ending the stream, after %d messages", stream.received)
+			return false
+		} else if err != nil {
+			log.Printf("wxindexer/reader: decoder error after %d messages, dropping connection: %v", stream.received, err)
+			return false
+		}
+
+		if message.Seq != 0 {
+			// Resent after a reconnect, and already on its way
+			if message.Seq <= stream.received {
+				continue
+			}
+			// The producer resends everything unacknowledged when it
+			// reconnects, so the missing messages arrive then
+			if message.Seq != stream.received + 1 {
+				log.Printf("wxindexer/reader: expected message %d, got %d, dropping connection", stream.received + 1, message.Seq)
+				return false
+			}
+			stream.received = message.Seq
+		}
+		from := delivery{stream: stream, seq: message.Seq}
+
+		switch message.Type {
+		case common.MsgCheckpoint:
+			log.Printf("wxindexer/reader: sender checkpointed at page %d (%s)", message.Checkpoint.PageID, message.Checkpoint.Title)
+			continue
+		case common.MsgEnd:
+			stream.end = message.Seq
+			// Acknowledged once every page before it has been written
+			from.done()
+			checkEnd(message)
+			return true
+		}
+		dispatch(message, from, out_chan, write_chan, update)
+	}
+}
+
+// checkEnd reports whether the end of a stream came after as many messages
+// as the producer says it sent.
+func checkEnd(message *common.Message) {
+	if uint64(message.End.Messages) != message.Seq - 1 {
+		log.Printf("wxindexer/reader: ERROR: sender sent %d messages but the stream ended at message %d", message.End.Messages, message.Seq)
+	} else {
+		log.Printf("wxindexer/reader: end of stream after %d messages. Exiting.", message.End.Messages)
+	}
+}
+
+// dispatch passes a page or deletion down the pipeline.
+func dispatch(
+	message *common.Message,
+	from delivery,
+	out_chan chan <- queuedPage,
+	write_chan chan <- indexedPage,
+	update bool,
+) {
+	if message.Type != common.MsgPage && message.Type != common.MsgDelete {
+		log.Printf("wxindexer/reader: ignoring unexpected %s message", message.Type)
+		from.done()
+		return
+	}
+
+	page := *message.Page
+	if message.Type == common.MsgDelete {
+		page.Op = common.OpDelete
+	}
+	// Applying changes to a freshly truncated index would silently lose it
+	if page.Op != common.OpIndex && !update {
+		log.Fatalf("wxindexer/reader: received %s of %s, restart with -update to apply changes to an existing index", page.Op, page.Title)
+	}
+	// Deletions and moves have nothing to index and go straight to the
+	// writer, once any earlier version of the pages they touch, which the
+	// indexers may still hold, has been written
+	if page.Op == common.OpDelete || page.Op == common.OpMove {
+		change := pageChange(page)
+		pending.wait(change.ID, change.URL, change.MovedFrom)
+		write_chan <- indexedPage{tf: change, from: from}
+		return
+	}
+	pending.add(page.ID, page.URL)
+	out_chan <- queuedPage{data: page, from: from}
+}
+
+// pendingPages counts the pages passed to the indexers and not yet written,
+// by ID and by URL.
+type pendingPages struct {
+	mu sync.Mutex
+	written *sync.Cond
+	ids map[int64]int
+	urls map[string]int
+}
+
+var pending = newPendingPages()
+
+func newPendingPages() *pendingPages {
+	p := &pendingPages{ids: make(map[int64]int), urls: make(map[string]int)}
+	p.written = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *pendingPages) add(id int64, url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id != 0 {
+		p.ids[id]++
+	}
+	p.urls[url]++
+}
+
+// remove is called by the writer once a page added has been written.
+func (p *pendingPages) remove(id int64, url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id != 0 {
+		p.ids[id]--
+		if p.ids[id] <= 0 {
+			delete(p.ids, id)
+		}
+	}
+	p.urls[url]--
+	if p.urls[url] <= 0 {
+		delete(p.urls, url)
+	}
+	p.written.Broadcast()
+}
+
+// wait blocks until no page with id, or with any of urls, is pending.
+func (p *pendingPages) wait(id int64, urls ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.isPending(id, urls) {
+		p.written.Wait()
+	}
+}
+
+func (p *pendingPages) isPending(id int64, urls []string) bool {
+	if id != 0 && p.ids[id] > 0 {
+		return true
+	}
+	for _, url := range urls {
+		if url != "" && p.urls[url] > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"log"
+
+	"common"
+)
+
+// replayRecords passes the pages in a record file down the pipeline, starting
+// from the one with sequence number from, as socketReader does for pages
+// from a connection.
+func replayRecords(
+	records *common.RecordReader,
+	from uint64,
+	out_chan chan <- queuedPage,
+	write_chan chan <- indexedPage,
+	update bool,
+) {
+	defer reader_group.Done()
+	if from > 1 {
+		if err := records.Seek(from); err != nil {
+			log.Fatalf("wxindexer/replay: failed to seek to page %d: %s", from, err)
+		}
+	}
+
+	var count = 0
+	for {
+		message, err := records.Read()
+		if err == io.EOF {
+			break
+		} else if err == common.ErrIncomplete {
+			log.Printf("wxindexer/replay: WARNING: %s, replayed the %d pages before it was cut short", err, count)
+			break
+		} else if err != nil {
+			log.Fatalf("wxindexer/replay: failed to read page after %d pages: %s", count, err)
+		}
+
+		if message.Type == common.MsgEnd {
+			if from <= 1 {
+				checkEnd(message)
+			}
+			continue
+		}
+		dispatch(message, delivery{}, out_chan, write_chan, update)
+		count++
+	}
+	log.Printf("wxindexer/replay: replayed %d pages", count)
+}
@@ -0,0 +1,90 @@
+package scoring
+
+import (
+	"math"
+	"sort"
+)
+
+// BM25 scores a page by how often the term occurs in it, with repeats
+// counting for less and less and long pages discounted, times the inverse of
+// the number of pages with the term.
+type BM25 struct {
+	K1 float64
+	B float64
+}
+
+func (s *BM25) Fields() []string {
+	return nil
+}
+
+func (s *BM25) Score(stats *Stats, match *Match) float64 {
+	norm := lengthNorm(s.B, match.Length, stats.AvgLength)
+	if norm <= 0 {
+		return 0
+	}
+	return saturate(s.K1, idf(stats, match), float64(match.Count) / norm)
+}
+
+// BM25F is BM25 over a page whose fields are weighted, so that a match in
+// the title counts as several in the body. Each field's count is discounted
+// by the field's length before they are weighted and summed.
+type BM25F struct {
+	K1 float64
+	B map[string]float64
+	Weights map[string]float64
+	fields []string
+}
+
+func newBM25F(params Params) *BM25F {
+	s := &BM25F{K1: params.K1, B: make(map[string]float64), Weights: params.FieldWeights}
+	for field := range params.FieldWeights {
+		s.fields = append(s.fields, field)
+		s.B[field] = params.B
+		if b, found := params.FieldB[field]; found {
+			s.B[field] = b
+		}
+	}
+	sort.Strings(s.fields)
+	return s
+}
+
+func (s *BM25F) Fields() []string {
+	return s.fields
+}
+
+func (s *BM25F) Score(stats *Stats, match *Match) float64 {
+	tf := 0.0
+	for field, count := range match.FieldCounts {
+		norm := lengthNorm(s.B[field], match.FieldLengths[field], stats.AvgFieldLengths[field])
+		if norm > 0 {
+			tf += s.Weights[field] * float64(count) / norm
+		}
+	}
+	return saturate(s.K1, idf(stats, match), tf)
+}
+
+// saturate weighs idf by tf, which counts for less the higher it gets. A tf
+// of 0 scores 0, even with a k1 of 0.
+func saturate(k1 float64, idf float64, tf float64) float64 {
+	if tf == 0 {
+		return 0
+	}
+	return idf * tf * (k1 + 1) / (tf + k1)
+}
+
+// idf is BM25's inverse document frequency, which unlike TF-IDF's stays
+// positive for terms in most pages.
+func idf(stats *Stats, match *Match) float64 {
+	df := float64(match.DocFreq)
+	return math.Log(1 + (float64(stats.Pages) - df + 0.5) / (df + 0.5))
+}
+
+// lengthNorm is the factor a count is divided by for a page or field of
+// length, compared to the average. With a b of 1 it is 0 for an empty page or
+// field, whose matches then score nothing.
+func lengthNorm(b float64, length int, average float64) float64 {
+	if average == 0 {
+		return 1
+	}
+	return 1 - b + b * float64(length) / average
+}
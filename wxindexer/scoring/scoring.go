@@ -0,0 +1,99 @@
+package scoring
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Stats describes the collection being searched.
+type Stats struct {
+	// Pages is the number of pages, leaving out redirects
+	Pages int
+	AvgLength float64
+	AvgFieldLengths map[string]float64
+}
+
+// Match describes the occurrences of a query term in a page.
+type Match struct {
+	// DocFreq is the number of pages with the term
+	DocFreq int
+	// TF is the augmented term frequency of the term in the page
+	TF float32
+	// Count is the number of times the term occurs in the page, and Length
+	// the number of terms in the page
+	Count int
+	Length int
+	// FieldCounts and FieldLengths hold the same for each field, for the
+	// fields the scorer asks for
+	FieldCounts map[string]int
+	FieldLengths map[string]int
+}
+
+// A Scorer scores how well a page matches a query term. A page's score for a
+// query is the sum of its scores for each term.
+type Scorer interface {
+	// Fields returns the fields whose counts and lengths Score needs, or nil
+	// if it only needs the page's
+	Fields() []string
+	Score(stats *Stats, match *Match) float64
+}
+
+const (
+	DefaultK1 = 1.2
+	DefaultB = 0.75
+)
+
+// DefaultWeights weigh a match in a title far above one in the body. The
+// redirects and anchors fields hold the titles of redirects to the page and
+// the text of links to it.
+var DefaultWeights = map[string]float64{
+	"title": 5,
+	"redirects": 4,
+	"headings": 2,
+	"anchors": 2,
+	"lead": 1.5,
+	"body": 1,
+}
+
+// Params tune the BM25 scorers.
+type Params struct {
+	// K1 controls how quickly repeating a term stops raising the score
+	K1 float64
+	// B controls how much a match in a long page or field is discounted,
+	// from 0 for not at all to 1 for in proportion to its length
+	B float64
+	// FieldB overrides B for some fields, for BM25F
+	FieldB map[string]float64
+	// FieldWeights weighs each field for BM25F. Fields without a weight
+	// aren't scored.
+	FieldWeights map[string]float64
+}
+
+func DefaultParams() Params {
+	return Params{K1: DefaultK1, B: DefaultB, FieldWeights: DefaultWeights}
+}
+
+var scorers = map[string]func(Params) Scorer{
+	"tfidf": func(Params) Scorer { return TFIDF{} },
+	"bm25": func(params Params) Scorer { return &BM25{K1: params.K1, B: params.B} },
+	"bm25f": func(params Params) Scorer { return newBM25F(params) },
+}
+
+// Names returns the names of the scorers New knows.
+func Names() []string {
+	names := make([]string, 0, len(scorers))
+	for name := range scorers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New returns the scorer called name, tuned by params where it takes any.
+func New(name string, params Params) (Scorer, error) {
+	scorer, found := scorers[name]
+	if !found {
+		return nil, fmt.Errorf("unknown scorer %q", name)
+	}
+	return scorer(params), nil
+}
@@ -0,0 +1,68 @@
+package scoring
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+var testStats = &Stats{
+	Pages: 100,
+	AvgLength: 50,
+	AvgFieldLengths: map[string]float64{"title": 4, "body": 40},
+}
+
+func TestScore(t *testing.T) {
+	params := Params{
+		K1: DefaultK1,
+		B: DefaultB,
+		FieldB: map[string]float64{"title": 0.5},
+		FieldWeights: map[string]float64{"title": 5, "body": 1},
+	}
+	bm25f := newBM25F(params)
+	tests := []struct {
+		name string
+		scorer Scorer
+		stats *Stats
+		match Match
+		want float64
+	}{
+		{"bm25", &BM25{K1: 1.2, B: 0.75}, testStats, Match{DocFreq: 9, Count: 3, Length: 100}, 3.059072458892049},
+		{"bm25 term in every page", &BM25{K1: 1.2, B: 0.75}, testStats, Match{DocFreq: 100, Count: 1, Length: 25}, 0.006238935172962296},
+		{"bm25 no average length", &BM25{K1: 1.2, B: 0.75}, &Stats{Pages: 100}, Match{DocFreq: 9, Count: 3, Length: 100}, 3.7145879857974875},
+		{"bm25 k1 0", &BM25{K1: 0, B: 0.75}, testStats, Match{DocFreq: 9, Count: 3, Length: 100}, 2.3638287182347644},
+		{"bm25 k1 0 no count", &BM25{K1: 0, B: 0.75}, testStats, Match{DocFreq: 9, Length: 100}, 0},
+		// With b 1, an empty page has a length norm of 0
+		{"bm25 b 1 empty page", &BM25{K1: 1.2, B: 1}, testStats, Match{DocFreq: 9, Count: 3}, 0},
+		{"bm25f", bm25f, testStats, Match{DocFreq: 9, FieldCounts: map[string]int{"title": 1, "body": 2}, FieldLengths: map[string]int{"title": 2, "body": 80}}, 4.507766392912807},
+		{"bm25f unweighted field", bm25f, testStats, Match{DocFreq: 9, FieldCounts: map[string]int{"lead": 7, "body": 2}, FieldLengths: map[string]int{"lead": 10, "body": 80}}, 2.536791795178772},
+		{"bm25f no fields", bm25f, testStats, Match{DocFreq: 9}, 0},
+		{"bm25f b 1 empty field", newBM25F(Params{K1: 1.2, B: 1, FieldWeights: params.FieldWeights}), testStats, Match{DocFreq: 9, FieldCounts: map[string]int{"title": 1, "body": 2}, FieldLengths: map[string]int{"body": 80}}, 2.3638287182347644},
+		{"tfidf", TFIDF{}, testStats, Match{DocFreq: 10, TF: 0.75}, 1.7269388197455342},
+		{"tfidf term in every page", TFIDF{}, testStats, Match{DocFreq: 100, TF: 0.75}, 0},
+		{"tfidf more pages than counted", TFIDF{}, testStats, Match{DocFreq: 200, TF: 0.75}, 0},
+		{"tfidf unknown term", TFIDF{}, testStats, Match{TF: 0.75}, 0},
+	}
+	for _, test := range tests {
+		got := test.scorer.Score(test.stats, &test.match)
+		if math.IsNaN(got) || math.Abs(got - test.want) > 1e-12 {
+			t.Errorf("%s: scored %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if names := Names(); !reflect.DeepEqual(names, []string{"bm25", "bm25f", "tfidf"}) {
+		t.Errorf("Names() = %q", names)
+	}
+	scorer, err := New("bm25f", DefaultParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := scorer.Fields(); !reflect.DeepEqual(fields, []string{"anchors", "body", "headings", "lead", "redirects", "title"}) {
+		t.Errorf("bm25f scores fields %q", fields)
+	}
+	if _, err := New("pagerank", DefaultParams()); err == nil {
+		t.Errorf("New made an unknown scorer")
+	}
+}
@@ -0,0 +1,20 @@
+package scoring
+
+import (
+	"math"
+)
+
+// TFIDF scores a page by the augmented frequency of the term in it, times
+// the inverse of the number of pages with the term.
+type TFIDF struct{}
+
+func (TFIDF) Fields() []string {
+	return nil
+}
+
+func (TFIDF) Score(stats *Stats, match *Match) float64 {
+	if match.DocFreq == 0 {
+		return 0
+	}
+	return float64(match.TF) * math.Log(max(float64(stats.Pages) / float64(match.DocFreq), 1))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"wxindexer/analyzer"
+	"wxindexer/scoring"
+	"wxindexer/segment"
+)
+
+// runSearch scores the pages of a segment against a query and prints the
+// best, so that scorers and their parameters can be compared on the same
+// index.
+func runSearch(opts *options) {
+	seg, err := segment.Open(opts.segment)
+	if err != nil {
+		log.Fatalf("wxindexer/search: %s", err)
+	}
+	defer seg.Close()
+
+	profile, err := loadProfile(opts, nil)
+	if err != nil {
+		log.Fatalf("wxindexer/search: failed to load the wiki profile: %s", err)
+	}
+	stopwords, err := loadStopWords(profile.Stopwords)
+	if err != nil {
+		log.Fatalf("wxindexer/search: failed to load stopwords: %s", err)
+	}
+	terms, err := analyzer.New(profile, stopwords)
+	if err != nil {
+		log.Fatalf("wxindexer/search: %s", err)
+	}
+	if seg.Meta.Analyzer != "" && seg.Meta.Analyzer != terms.ID() {
+		log.Fatalf("wxindexer/search: the segment's terms were made by analyzer %s, but the query's would be made by %s", seg.Meta.Analyzer, terms.ID())
+	}
+
+	scorer, err := scoring.New(opts.scorer, opts.scoring)
+	if err != nil {
+		log.Fatalf("wxindexer/search: %s", err)
+	}
+	stats := &scoring.Stats{
+		Pages: int(seg.Meta.Pages),
+		AvgLength: seg.Meta.AvgLength,
+		AvgFieldLengths: seg.Meta.AvgFieldLengths,
+	}
+
+	scores := make(map[uint32]float64)
+	seen := make(map[string]bool)
+	for _, term := range terms.Terms(opts.query) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		matches, err := termMatches(seg, scorer.Fields(), term)
+		if err != nil {
+			log.Fatalf("wxindexer/search: failed to read the postings of %q: %s", term, err)
+		}
+		for doc, match := range matches {
+			scores[doc] += scorer.Score(stats, match)
+		}
+	}
+
+	docs := make([]uint32, 0, len(scores))
+	for doc := range scores {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		if scores[docs[i]] != scores[docs[j]] {
+			return scores[docs[i]] > scores[docs[j]]
+		}
+		return docs[i] < docs[j]
+	})
+	fmt.Printf("%d pages match %q under %s\n", len(docs), opts.query, opts.scorer)
+	for i, doc := range docs[:min(opts.top, len(docs))] {
+		entry, err := seg.Doc(doc)
+		if err != nil {
+			log.Fatalf("wxindexer/search: %s", err)
+		}
+		if entry.Redirect != "" {
+			fmt.Printf("%3d. %8.4f  %s -> %s\n", i + 1, scores[doc], entry.Title, entry.Redirect)
+		} else {
+			fmt.Printf("%3d. %8.4f  %s  %s\n", i + 1, scores[doc], entry.Title, entry.URL)
+		}
+	}
+}
+
+// termMatches collects the docs with term, from the page's own postings if
+// fields is empty and otherwise from those of each field. A page's own terms
+// leave out its title, so for fields the doc frequency is the number of
+// docs the term is in any of them.
+func termMatches(seg *segment.Segment, fields []string, term string) (map[uint32]*scoring.Match, error) {
+	matches := make(map[uint32]*scoring.Match)
+	if len(fields) == 0 {
+		postings, err := seg.Lookup(term)
+		if err != nil || postings == nil {
+			return matches, err
+		}
+		for postings.Next() {
+			doc := postings.Doc()
+			matches[doc] = &scoring.Match{
+				DocFreq: postings.Len(),
+				TF: postings.TF(),
+				Count: postings.Count(),
+				Length: seg.Length(doc),
+			}
+		}
+		return matches, postings.Err()
+	}
+
+	for _, field := range fields {
+		postings, err := seg.Lookup(segment.FieldTerm(field, term))
+		if err != nil {
+			return nil, err
+		} else if postings == nil {
+			continue
+		}
+		for postings.Next() {
+			doc := postings.Doc()
+			match, found := matches[doc]
+			if !found {
+				match = &scoring.Match{FieldCounts: make(map[string]int), FieldLengths: make(map[string]int)}
+				matches[doc] = match
+			}
+			match.FieldCounts[field] = postings.Count()
+			match.FieldLengths[field] = seg.FieldLength(doc, field)
+		}
+		if err := postings.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, match := range matches {
+		match.DocFreq = len(matches)
+	}
+	return matches, nil
+}
@@ -0,0 +1,713 @@
+package segment
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"wxindexer/containers"
+)
+
+// posting_overhead estimates the memory a buffered posting takes besides its
+// term and positions.
+const posting_overhead = 64
+
+// merge_fan_in is the most runs merged at once, keeping the files open well
+// under the usual limit of 1024. More runs are merged in several passes.
+const merge_fan_in = 256
+
+type posting struct {
+	term string
+	doc uint32
+	tf uint8
+	count uint32
+	positions []byte
+}
+
+// Builder writes a segment from docs and their postings, which can be added
+// in any order. Postings are buffered until they take up the memory given,
+// then sorted and spilled to a run file, and the runs are merged into the
+// posting lists at the end.
+//
+// The offsets of the docs, 8 bytes each, and the lengths credited to them, 4
+// bytes for each doc and credited field, are held until the end and count
+// against the memory, leaving the rest for postings. Over all of enwiki's 17
+// million pages and redirects they take about 300MB. However large they grow,
+// postings get at least an eighth of the memory.
+type Builder struct {
+	dir string
+	memory int
+	docs_file *os.File
+	docs *bufio.Writer
+	docs_size uint64
+	doc_offsets []uint64
+	lengths_file *os.File
+	lengths *bufio.Writer
+	// pages counts the docs that aren't redirects, total_length sums their
+	// lengths, and field_lengths their lengths of each field
+	pages int
+	total_length uint64
+	field_lengths []uint64
+	// credited holds the lengths credited to docs by others, for each field
+	// by doc, to be added to their own once every doc has been written
+	credited [][]uint32
+	buffer []posting
+	buffered int
+	// runs are the run files left to merge, and run_count numbers them
+	runs []string
+	run_count int
+	positions bool
+}
+
+// NewBuilder starts building a segment in dir, which must not already hold
+// one, buffering up to memory bytes of postings at a time.
+func NewBuilder(dir string, memory int) (*Builder, error) {
+	if _, err := os.Stat(filepath.Join(dir, fln_meta)); err == nil {
+		return nil, fmt.Errorf("%s already holds a segment", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	docs_file, err := os.Create(filepath.Join(dir, fln_docs))
+	if err != nil {
+		return nil, err
+	}
+	lengths_file, err := os.Create(filepath.Join(dir, fln_lengths))
+	if err != nil {
+		docs_file.Close()
+		return nil, err
+	}
+	return &Builder{
+		dir: dir,
+		memory: memory,
+		docs_file: docs_file,
+		docs: bufio.NewWriterSize(docs_file, 1024*1024),
+		lengths_file: lengths_file,
+		lengths: bufio.NewWriterSize(lengths_file, 1024*1024),
+		field_lengths: make([]uint64, len(containers.Fields)),
+		credited: make([][]uint32, len(containers.Fields)),
+	}, nil
+}
+
+// tableMemory returns the memory taken by the doc offsets and the credited
+// lengths.
+func (b *Builder) tableMemory() int {
+	memory := 8 * cap(b.doc_offsets)
+	for _, lengths := range b.credited {
+		memory += 4 * cap(lengths)
+	}
+	return memory
+}
+
+// AddDoc adds doc to the doc table, returning its doc number.
+func (b *Builder) AddDoc(doc Doc) (uint32, error) {
+	number := uint32(len(b.doc_offsets))
+	b.doc_offsets = append(b.doc_offsets, b.docs_size)
+
+	record := binary.AppendUvarint(nil, uint64(doc.ID))
+	for _, field := range []string{doc.URL, doc.Title, doc.Redirect} {
+		record = binary.AppendUvarint(record, uint64(len(field)))
+		record = append(record, field...)
+	}
+	if _, err := b.docs.Write(record); err != nil {
+		return 0, err
+	}
+	b.docs_size += uint64(len(record))
+
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(doc.Length))
+	if _, err := b.lengths.Write(buf[:]); err != nil {
+		return 0, err
+	}
+	for i, field := range containers.Fields {
+		length := doc.FieldLengths[string(field)]
+		binary.LittleEndian.PutUint32(buf[:], uint32(length))
+		if _, err := b.lengths.Write(buf[:]); err != nil {
+			return 0, err
+		}
+		if doc.Redirect == "" {
+			b.field_lengths[i] += uint64(length)
+		}
+	}
+	if doc.Redirect == "" {
+		b.pages++
+		b.total_length += uint64(doc.Length)
+	}
+	return number, nil
+}
+
+// Add adds a posting for term in doc, occurring count times with the
+// augmented term frequency tf, with positions in the form stored in the
+// forward index, or nil.
+func (b *Builder) Add(term string, doc uint32, tf float32, count int, positions []byte) error {
+	b.buffer = append(b.buffer, posting{term: term, doc: doc, tf: QuantizeTF(tf), count: uint32(count), positions: positions})
+	b.buffered += len(term) + len(positions) + posting_overhead
+	b.positions = b.positions || len(positions) > 0
+	if b.buffered >= max(b.memory - b.tableMemory(), b.memory / 8) {
+		return b.spill()
+	}
+	return nil
+}
+
+// Credit adds count occurrences of term to field of doc, on behalf of another
+// doc that describes it, such as one linking to it. Doc may be added before
+// or after. The postings credited to a doc for a term are summed, and carry
+// a term frequency of 1, as the most frequent term of a field gathered from
+// many docs is only known once they are merged. Only pages should be
+// credited, as field lengths are averaged over them.
+func (b *Builder) Credit(field containers.Field, term string, doc uint32, count int) error {
+	i := slices.Index(containers.Fields, field)
+	if i < 0 {
+		return fmt.Errorf("unknown field %q", field)
+	}
+	if int(doc) >= len(b.credited[i]) {
+		b.credited[i] = append(b.credited[i], make([]uint32, int(doc) + 1 - len(b.credited[i]))...)
+	}
+	b.credited[i][doc] += uint32(count)
+	b.field_lengths[i] += uint64(count)
+	return b.Add(FieldTerm(string(field), term), doc, 1, count, nil)
+}
+
+// sortBuffer sorts the buffered postings by term and then doc.
+func (b *Builder) sortBuffer() {
+	sort.Slice(b.buffer, func(i, j int) bool {
+		if b.buffer[i].term != b.buffer[j].term {
+			return b.buffer[i].term < b.buffer[j].term
+		}
+		return b.buffer[i].doc < b.buffer[j].doc
+	})
+}
+
+// newRun creates the next run file.
+func (b *Builder) newRun() (*runWriter, error) {
+	path := filepath.Join(b.dir, fmt.Sprintf("run%04d.tmp", b.run_count))
+	b.run_count++
+	run, err := createRun(path)
+	if err != nil {
+		return nil, err
+	}
+	b.runs = append(b.runs, path)
+	return run, nil
+}
+
+// spill writes the buffered postings out to a new run file.
+func (b *Builder) spill() error {
+	b.sortBuffer()
+	run, err := b.newRun()
+	if err != nil {
+		return err
+	}
+	for i := range b.buffer {
+		if err := run.write(&b.buffer[i]); err != nil {
+			run.file.Close()
+			return err
+		}
+	}
+	log.Printf("wxindexer/segment: spilled %d postings to %s", len(b.buffer), run.file.Name())
+	b.buffer = nil
+	b.buffered = 0
+	return run.close()
+}
+
+// mergeRuns merges the first merge_fan_in runs into a new one at the end.
+func (b *Builder) mergeRuns() error {
+	paths := b.runs[:merge_fan_in]
+	b.runs = b.runs[merge_fan_in:]
+	var sources []postingSource
+	defer func() {
+		closeSources(sources)
+	}()
+	for _, path := range paths {
+		source, err := openRun(path)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, source)
+	}
+	queue, err := newPostingQueue(sources)
+	if err != nil {
+		return err
+	}
+	run, err := b.newRun()
+	if err != nil {
+		return err
+	}
+	for len(queue) > 0 {
+		if err := run.write(queue[0].posting); err != nil {
+			run.file.Close()
+			return err
+		}
+		if err := queue.advance(); err != nil {
+			run.file.Close()
+			return err
+		}
+	}
+	if err := run.close(); err != nil {
+		return err
+	}
+	log.Printf("wxindexer/segment: merged %d runs into %s", len(paths), run.file.Name())
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	return nil
+}
+
+// Finish merges the postings into the posting lists and term dictionary and
+// writes the segment's metadata, recording analyzer as the ID of the
+// analyzer the terms were made by.
+func (b *Builder) Finish(analyzer string) (*Meta, error) {
+	if err := b.finishDocs(); err != nil {
+		return nil, err
+	}
+	if err := b.lengths.Flush(); err != nil {
+		b.lengths_file.Close()
+		return nil, err
+	}
+	if err := b.finishCredited(); err != nil {
+		b.lengths_file.Close()
+		return nil, err
+	}
+	if err := b.lengths_file.Close(); err != nil {
+		return nil, err
+	}
+
+	// Postings that all fit in memory are merged straight from the buffer
+	var sources []postingSource
+	if len(b.runs) == 0 {
+		b.sortBuffer()
+		sources = append(sources, &bufferSource{postings: b.buffer})
+	} else {
+		if len(b.buffer) > 0 {
+			if err := b.spill(); err != nil {
+				return nil, err
+			}
+		}
+		for len(b.runs) > merge_fan_in {
+			if err := b.mergeRuns(); err != nil {
+				return nil, err
+			}
+		}
+		for _, path := range b.runs {
+			run, err := openRun(path)
+			if err != nil {
+				closeSources(sources)
+				return nil, err
+			}
+			sources = append(sources, run)
+		}
+	}
+	terms, err := b.merge(sources)
+	closeSources(sources)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range b.runs {
+		os.Remove(path)
+	}
+
+	meta := &Meta{
+		Version: Version,
+		Docs: uint32(len(b.doc_offsets)),
+		Pages: uint32(b.pages),
+		Terms: terms,
+		Positions: b.positions,
+		Analyzer: analyzer,
+		AvgLength: average(b.total_length, b.pages),
+		AvgFieldLengths: make(map[string]float64),
+		Created: time.Now().UTC(),
+	}
+	for i, field := range containers.Fields {
+		meta.Fields = append(meta.Fields, string(field))
+		meta.AvgFieldLengths[string(field)] = average(b.field_lengths[i], b.pages)
+	}
+	return meta, writeMeta(b.dir, meta)
+}
+
+func average(total uint64, count int) float64 {
+	if count == 0 {
+		return 0
+	}
+	return float64(total) / float64(count)
+}
+
+// finishCredited adds the lengths credited to docs to those written for them,
+// rewriting the lengths file a block of docs at a time.
+func (b *Builder) finishCredited() error {
+	docs := len(b.doc_offsets)
+	for _, lengths := range b.credited {
+		if len(lengths) > docs {
+			return fmt.Errorf("doc %d was credited but never added", len(lengths) - 1)
+		}
+	}
+	const block = 65536
+	record := 4 * (len(containers.Fields) + 1)
+	buf := make([]byte, block * record)
+	for start := 0; start < docs; start += block {
+		end := min(start + block, docs)
+		changed := false
+		for _, lengths := range b.credited {
+			if len(lengths) > start {
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		at := int64(start * record)
+		chunk := buf[:(end - start) * record]
+		if _, err := b.lengths_file.ReadAt(chunk, at); err != nil {
+			return err
+		}
+		for i, lengths := range b.credited {
+			for doc := start; doc < min(end, len(lengths)); doc++ {
+				offset := (doc - start) * record + 4 * (i + 1)
+				binary.LittleEndian.PutUint32(chunk[offset:], binary.LittleEndian.Uint32(chunk[offset:]) + lengths[doc])
+			}
+		}
+		if _, err := b.lengths_file.WriteAt(chunk, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishDocs writes the offset of each doc in the doc table after them,
+// followed by the number of docs.
+func (b *Builder) finishDocs() error {
+	var buf [8]byte
+	for _, offset := range append(b.doc_offsets, uint64(len(b.doc_offsets))) {
+		binary.LittleEndian.PutUint64(buf[:], offset)
+		if _, err := b.docs.Write(buf[:]); err != nil {
+			b.docs_file.Close()
+			return err
+		}
+	}
+	if err := b.docs.Flush(); err != nil {
+		b.docs_file.Close()
+		return err
+	}
+	return b.docs_file.Close()
+}
+
+// merge writes the posting lists of the postings from sources, and the term
+// dictionary pointing into them, returning the number of terms.
+func (b *Builder) merge(sources []postingSource) (uint64, error) {
+	postings_file, err := os.Create(filepath.Join(b.dir, fln_postings))
+	if err != nil {
+		return 0, err
+	}
+	defer postings_file.Close()
+	terms_file, err := os.Create(filepath.Join(b.dir, fln_terms))
+	if err != nil {
+		return 0, err
+	}
+	defer terms_file.Close()
+
+	postings_out := bufio.NewWriterSize(postings_file, 1024*1024)
+	terms_out := bufio.NewWriterSize(terms_file, 1024*1024)
+	postings := newPostingsWriter(postings_out)
+	dictionary := newDictionaryWriter(terms_out)
+
+	queue, err := newPostingQueue(sources)
+	if err != nil {
+		return 0, err
+	}
+
+	var terms uint64 = 0
+	var term string
+	add := func(posting *posting) error {
+		if terms == 0 || posting.term != term {
+			if terms > 0 {
+				if err := endTerm(postings, dictionary, term); err != nil {
+					return err
+				}
+			}
+			term = posting.term
+			terms++
+			postings.begin()
+		}
+		return postings.add(posting.doc, posting.tf, posting.count, posting.positions)
+	}
+
+	// Postings of the same term and doc, credited by different docs, are
+	// summed before being added
+	var current posting
+	started := false
+	for len(queue) > 0 {
+		head := queue[0].posting
+		if started && head.term == current.term && head.doc == current.doc {
+			current.count += head.count
+			current.tf = max(current.tf, head.tf)
+		} else {
+			if started {
+				if err := add(&current); err != nil {
+					return 0, err
+				}
+			}
+			current = *head
+			started = true
+		}
+		if err := queue.advance(); err != nil {
+			return 0, err
+		}
+	}
+	if started {
+		if err := add(&current); err != nil {
+			return 0, err
+		}
+	}
+	if terms > 0 {
+		if err := endTerm(postings, dictionary, term); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := postings_out.Flush(); err != nil {
+		return 0, err
+	}
+	if err := dictionary.finish(); err != nil {
+		return 0, err
+	}
+	if err := terms_out.Flush(); err != nil {
+		return 0, err
+	}
+	return terms, nil
+}
+
+func endTerm(postings *postingsWriter, dictionary *dictionaryWriter, term string) error {
+	offset, length, df, err := postings.end()
+	if err != nil {
+		return err
+	}
+	return dictionary.add(term, termInfo{DocFreq: df, offset: offset, length: length})
+}
+
+// A postingSource yields postings sorted by term and then doc.
+type postingSource interface {
+	next() (*posting, error)
+	close() error
+}
+
+type bufferSource struct {
+	postings []posting
+	next_index int
+}
+
+func (s *bufferSource) next() (*posting, error) {
+	if s.next_index == len(s.postings) {
+		return nil, io.EOF
+	}
+	s.next_index++
+	return &s.postings[s.next_index - 1], nil
+}
+
+func (s *bufferSource) close() error {
+	return nil
+}
+
+// runWriter writes postings to a run file, in the form runSource reads.
+type runWriter struct {
+	file *os.File
+	writer *bufio.Writer
+	record []byte
+}
+
+func createRun(path string) (*runWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &runWriter{file: file, writer: bufio.NewWriterSize(file, 1024*1024)}, nil
+}
+
+func (w *runWriter) write(posting *posting) error {
+	record := binary.AppendUvarint(w.record[:0], uint64(len(posting.term)))
+	record = append(record, posting.term...)
+	record = binary.AppendUvarint(record, uint64(posting.doc))
+	record = append(record, posting.tf)
+	record = binary.AppendUvarint(record, uint64(posting.count))
+	record = binary.AppendUvarint(record, uint64(len(posting.positions)))
+	record = append(record, posting.positions...)
+	w.record = record
+	_, err := w.writer.Write(record)
+	return err
+}
+
+// close flushes the run and closes its file.
+func (w *runWriter) close() error {
+	if err := w.writer.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// runSource reads back a run file written by a runWriter.
+type runSource struct {
+	file *os.File
+	reader *bufio.Reader
+	current posting
+	term []byte
+}
+
+func openRun(path string) (*runSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &runSource{file: file, reader: bufio.NewReaderSize(file, 256*1024)}, nil
+}
+
+// next returns the next posting, which is only valid until the following
+// call.
+func (s *runSource) next() (*posting, error) {
+	term_len, err := binary.ReadUvarint(s.reader)
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, err
+	}
+	s.term, err = readBytes(s.reader, s.term, term_len)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := binary.ReadUvarint(s.reader)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	tf, err := s.reader.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	count, err := binary.ReadUvarint(s.reader)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	positions_len, err := binary.ReadUvarint(s.reader)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	// Positions are held on to until their block is written
+	var positions []byte
+	if positions_len > 0 {
+		if positions, err = readBytes(s.reader, nil, positions_len); err != nil {
+			return nil, err
+		}
+	}
+
+	s.current = posting{term: string(s.term), doc: uint32(doc), tf: tf, count: uint32(count), positions: positions}
+	return &s.current, nil
+}
+
+func (s *runSource) close() error {
+	return s.file.Close()
+}
+
+func readBytes(reader *bufio.Reader, buf []byte, size uint64) ([]byte, error) {
+	if uint64(cap(buf)) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func closeSources(sources []postingSource) {
+	for _, source := range sources {
+		source.close()
+	}
+}
+
+// postingQueue is a heap of sources ordered by their current postings. Each
+// source is sorted by term and doc, so postings of the same term come out in
+// doc order.
+type postingQueue []*queuedSource
+
+type queuedSource struct {
+	source postingSource
+	posting *posting
+}
+
+func (q postingQueue) Len() int {
+	return len(q)
+}
+
+func (q postingQueue) Less(i, j int) bool {
+	if q[i].posting.term != q[j].posting.term {
+		return q[i].posting.term < q[j].posting.term
+	}
+	return q[i].posting.doc < q[j].posting.doc
+}
+
+func (q postingQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *postingQueue) Push(item any) {
+	*q = append(*q, item.(*queuedSource))
+}
+
+func (q *postingQueue) Pop() any {
+	old := *q
+	item := old[len(old) - 1]
+	*q = old[:len(old) - 1]
+	return item
+}
+
+// newPostingQueue returns a queue of the sources that aren't empty.
+func newPostingQueue(sources []postingSource) (postingQueue, error) {
+	queue := make(postingQueue, 0, len(sources))
+	for _, source := range sources {
+		if err := queue.pushNext(source); err != nil {
+			return nil, err
+		}
+	}
+	heap.Init(&queue)
+	return queue, nil
+}
+
+// pushNext adds source to the queue, before it is made a heap, unless it is
+// empty.
+func (q *postingQueue) pushNext(source postingSource) error {
+	posting, err := source.next()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	*q = append(*q, &queuedSource{source: source, posting: posting})
+	return nil
+}
+
+// advance moves the source at the head of the queue on to its next posting.
+func (q *postingQueue) advance() error {
+	head := (*q)[0]
+	posting, err := head.source.next()
+	if err == io.EOF {
+		heap.Pop(q)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	head.posting = posting
+	heap.Fix(q, 0)
+	return nil
+}
@@ -0,0 +1,332 @@
+package segment
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"wxindexer/containers"
+)
+
+// testCorpus is what is added to a builder, along with the segment it should
+// make.
+type testCorpus struct {
+	docs []Doc
+	postings []testAdd
+	credits []testCredit
+	// want holds the postings expected of each term by doc
+	want map[string]map[uint32]testPosting
+	// lengths holds the expected length of each doc's fields, credited
+	// lengths included
+	lengths []map[string]int
+}
+
+type testAdd struct {
+	term string
+	doc uint32
+	tf float32
+	count int
+	positions []int
+}
+
+type testCredit struct {
+	field containers.Field
+	term string
+	doc uint32
+	count int
+}
+
+func newTestCorpus(rng *rand.Rand, docs int) *testCorpus {
+	c := &testCorpus{want: make(map[string]map[uint32]testPosting)}
+	expect := func(term string, doc uint32, posting testPosting) {
+		if c.want[term] == nil {
+			c.want[term] = make(map[uint32]testPosting)
+		}
+		c.want[term][doc] = posting
+	}
+	words := []string{"walrus", "seal", "clam", "tusk", "arctic", "ice", "café", "a", "zz"}
+
+	for doc := uint32(0); doc < uint32(docs); doc++ {
+		entry := Doc{ID: int64(doc) + 100, URL: fmt.Sprintf("Page_%d", doc), Title: fmt.Sprintf("Page %d", doc), FieldLengths: make(map[string]int)}
+		if doc % 10 == 9 {
+			entry.Redirect = "Page_0"
+		} else {
+			entry.Length = rng.Intn(500)
+			entry.FieldLengths[string(containers.FieldLead)] = rng.Intn(100)
+		}
+		c.docs = append(c.docs, entry)
+		c.lengths = append(c.lengths, maps(entry.FieldLengths))
+
+		for _, i := range rng.Perm(len(words))[:rng.Intn(4)] {
+			add := testAdd{term: words[i], doc: doc, tf: rng.Float32(), count: 1 + rng.Intn(9)}
+			if rng.Intn(2) == 0 {
+				add.term = FieldTerm(string(containers.FieldLead), add.term)
+				add.positions = []int{rng.Intn(5), 5 + rng.Intn(50)}
+			}
+			c.postings = append(c.postings, add)
+			expect(add.term, doc, testPosting{doc: doc, tf: QuantizeTF(add.tf), count: uint32(add.count), positions: add.positions})
+		}
+	}
+
+	// Credits go to pages from anywhere, including ones added later, and
+	// sum when they name the same term and page
+	for i := 0; i < docs; i++ {
+		target := uint32(rng.Intn(docs))
+		if c.docs[target].Redirect != "" {
+			continue
+		}
+		field := containers.FieldAnchors
+		if i % 4 == 0 {
+			field = containers.FieldRedirects
+		}
+		credit := testCredit{field: field, term: words[rng.Intn(3)], doc: target, count: 1 + rng.Intn(3)}
+		c.credits = append(c.credits, credit)
+		term := FieldTerm(string(field), credit.term)
+		summed := c.want[term][target]
+		expect(term, target, testPosting{doc: target, tf: 255, count: summed.count + uint32(credit.count)})
+		c.lengths[target][string(field)] += credit.count
+	}
+	return c
+}
+
+func maps(m map[string]int) map[string]int {
+	copied := make(map[string]int, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
+
+// build adds the corpus to a builder with the memory given, crediting as the
+// docs are added like invert does.
+func (c *testCorpus) build(t *testing.T, dir string, memory int) *Meta {
+	builder, err := NewBuilder(dir, memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postings := c.postings
+	for i, entry := range c.docs {
+		doc, err := builder.AddDoc(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc != uint32(i) {
+			t.Fatalf("doc %d was numbered %d", i, doc)
+		}
+		for len(postings) > 0 && postings[0].doc == doc {
+			add := postings[0]
+			postings = postings[1:]
+			var positions []byte
+			if add.positions != nil {
+				positions = containers.EncodePositions(add.positions)
+			}
+			if err := builder.Add(add.term, add.doc, add.tf, add.count, positions); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for j := i; j < len(c.credits); j += len(c.docs) {
+			credit := c.credits[j]
+			if err := builder.Credit(credit.field, credit.term, credit.doc, credit.count); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	meta, err := builder.Finish("test-analyzer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+// check compares the segment in dir with what the corpus should make.
+func (c *testCorpus) check(t *testing.T, dir string) {
+	seg, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+
+	if seg.Meta.Docs != uint32(len(c.docs)) || seg.Meta.Terms != uint64(len(c.want)) || seg.Meta.Analyzer != "test-analyzer" {
+		t.Errorf("meta has %d docs, %d terms and analyzer %q, want %d, %d and test-analyzer", seg.Meta.Docs, seg.Meta.Terms, seg.Meta.Analyzer, len(c.docs), len(c.want))
+	}
+	for i, want := range c.docs {
+		doc := uint32(i)
+		entry, err := seg.Doc(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.ID != want.ID || entry.URL != want.URL || entry.Title != want.Title || entry.Redirect != want.Redirect {
+			t.Errorf("doc %d is %+v, want %+v", doc, entry, want)
+		}
+		if seg.Length(doc) != want.Length {
+			t.Errorf("doc %d has length %d, want %d", doc, seg.Length(doc), want.Length)
+		}
+		for _, field := range containers.Fields {
+			if got := seg.FieldLength(doc, string(field)); got != c.lengths[doc][string(field)] {
+				t.Errorf("doc %d has %s length %d, want %d", doc, field, got, c.lengths[doc][string(field)])
+			}
+		}
+	}
+
+	var terms []string
+	if err := seg.EachPrefix("", func(term string, doc_freq int) bool {
+		terms = append(terms, term)
+		if doc_freq != len(c.want[term]) {
+			t.Errorf("%s has a doc frequency of %d, want %d", term, doc_freq, len(c.want[term]))
+		}
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var want_terms []string
+	for term := range c.want {
+		want_terms = append(want_terms, term)
+	}
+	sort.Strings(want_terms)
+	if !reflect.DeepEqual(terms, want_terms) {
+		t.Errorf("terms\n got: %q\nwant: %q", terms, want_terms)
+	}
+
+	for term, docs := range c.want {
+		var want []testPosting
+		for _, posting := range docs {
+			want = append(want, posting)
+		}
+		sort.Slice(want, func(i, j int) bool {
+			return want[i].doc < want[j].doc
+		})
+		postings, err := seg.Lookup(term)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := readList(postings)
+		if postings.Err() != nil {
+			t.Fatal(postings.Err())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("postings of %s\n got: %v\nwant: %v", term, got, want)
+		}
+	}
+}
+
+func TestBuilderRoundTrip(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	corpus := newTestCorpus(rand.New(rand.NewSource(5)), 400)
+	if len(corpus.postings) + len(corpus.credits) <= 2 * merge_fan_in {
+		t.Fatalf("the corpus has too few postings to need several merge passes")
+	}
+	tests := []struct {
+		name string
+		memory int
+	}{
+		{"in memory", 1 << 30},
+		{"a few runs", 64 << 10},
+		// Each posting is spilled to its own run, taking several passes to
+		// merge
+		{"a run per posting", 0},
+	}
+	var first string
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			meta := corpus.build(t, dir, test.memory)
+			corpus.check(t, dir)
+
+			pages := 0
+			for _, doc := range corpus.docs {
+				if doc.Redirect == "" {
+					pages++
+				}
+			}
+			if meta.Pages != uint32(pages) {
+				t.Errorf("meta counts %d pages, want %d", meta.Pages, pages)
+			}
+			runs, _ := filepath.Glob(filepath.Join(dir, "run*.tmp"))
+			if len(runs) > 0 {
+				t.Errorf("%d runs were left behind", len(runs))
+			}
+
+			// However the postings were spilled, the segment is the same
+			postings, err := os.ReadFile(filepath.Join(dir, fln_postings))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first == "" {
+				first = string(postings)
+			} else if string(postings) != first {
+				t.Errorf("the postings differ from those built in memory")
+			}
+		})
+	}
+}
+
+func TestBuilderAverages(t *testing.T) {
+	dir := t.TempDir()
+	builder, err := NewBuilder(dir, 1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lead := string(containers.FieldLead)
+	docs := []Doc{
+		{ID: 1, URL: "A", Length: 10, FieldLengths: map[string]int{lead: 4}},
+		{ID: 2, URL: "B", Length: 20, FieldLengths: map[string]int{lead: 8}},
+		{ID: 3, URL: "C", Redirect: "A", Length: 100, FieldLengths: map[string]int{lead: 100}},
+	}
+	for _, doc := range docs {
+		if _, err := builder.AddDoc(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := builder.Credit(containers.FieldRedirects, "c", 0, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Credit("nonsense", "c", 0, 1); err == nil {
+		t.Errorf("crediting an unknown field succeeded")
+	}
+	meta, err := builder.Finish("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Redirects count for neither
+	if meta.Pages != 2 || meta.AvgLength != 15 || meta.AvgFieldLengths[lead] != 6 || meta.AvgFieldLengths[string(containers.FieldRedirects)] != 1.5 {
+		t.Errorf("meta has %d pages, average length %v and field lengths %v", meta.Pages, meta.AvgLength, meta.AvgFieldLengths)
+	}
+}
+
+func TestBuilderCreditUnknownDoc(t *testing.T) {
+	builder, err := NewBuilder(t.TempDir(), 1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := builder.AddDoc(Doc{ID: 1, URL: "A"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Credit(containers.FieldAnchors, "a", 5, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := builder.Finish(""); err == nil {
+		t.Errorf("finishing with a doc credited but never added succeeded")
+	}
+}
+
+func TestNewBuilderRefusesExistingSegment(t *testing.T) {
+	dir := t.TempDir()
+	builder, err := NewBuilder(dir, 1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := builder.Finish(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBuilder(dir, 1 << 20); err == nil {
+		t.Errorf("a second builder was started in %s", dir)
+	}
+}
@@ -0,0 +1,329 @@
+package segment
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The term dictionary is front coded: terms are stored in sorted order in
+// blocks of dictionary_block, the first of each whole and the rest as the
+// length of the prefix they share with the term before and the suffix after
+// it. Each block is:
+//
+//   uvarint  offset of the posting list of the block's first term
+//   ...      an entry per term:
+//     uvarint  length of the prefix shared with the term before
+//     uvarint  length of the suffix
+//     ...      the suffix
+//     uvarint  number of docs with the term
+//     uvarint  length of the term's posting list, which follows the one
+//              before it
+//
+// followed by the offset of each block as a little endian uint64, and the
+// number of terms and of blocks, so a lookup can binary search the first
+// terms of the blocks and only decode the block the term would be in.
+
+const dictionary_block = 16
+
+var errCorruptDictionary = errors.New("segment: corrupt term dictionary")
+
+// termInfo locates the posting list of a term.
+type termInfo struct {
+	DocFreq int
+	offset int64
+	length int64
+}
+
+type dictionaryWriter struct {
+	out *bufio.Writer
+	size uint64
+	terms uint64
+	block_offsets []uint64
+	last string
+	entry []byte
+}
+
+func newDictionaryWriter(out *bufio.Writer) *dictionaryWriter {
+	return &dictionaryWriter{out: out}
+}
+
+// add appends the entry for term, which must sort after the last one.
+func (w *dictionaryWriter) add(term string, info termInfo) error {
+	shared := 0
+	w.entry = w.entry[:0]
+	if w.terms % dictionary_block == 0 {
+		w.block_offsets = append(w.block_offsets, w.size)
+		w.entry = binary.AppendUvarint(w.entry, uint64(info.offset))
+	} else {
+		for shared < min(len(term), len(w.last)) && term[shared] == w.last[shared] {
+			shared++
+		}
+	}
+	w.entry = binary.AppendUvarint(w.entry, uint64(shared))
+	w.entry = binary.AppendUvarint(w.entry, uint64(len(term) - shared))
+	w.entry = append(w.entry, term[shared:]...)
+	w.entry = binary.AppendUvarint(w.entry, uint64(info.DocFreq))
+	w.entry = binary.AppendUvarint(w.entry, uint64(info.length))
+	if _, err := w.out.Write(w.entry); err != nil {
+		return err
+	}
+	w.size += uint64(len(w.entry))
+	w.terms++
+	w.last = term
+	return nil
+}
+
+// finish writes the block offsets and counts after the blocks.
+func (w *dictionaryWriter) finish() error {
+	var buf [8]byte
+	for _, value := range append(w.block_offsets, w.terms, uint64(len(w.block_offsets))) {
+		binary.LittleEndian.PutUint64(buf[:], value)
+		if _, err := w.out.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dictionary reads a term dictionary mapped into memory.
+type dictionary struct {
+	data []byte
+	terms int
+	blocks int
+	// index holds the offset of each block
+	index []byte
+}
+
+func openDictionary(path string) (*dictionary, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// The mapping outlives the file
+	defer file.Close()
+	data, err := mapFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 16 {
+		unmapFile(data)
+		return nil, errCorruptDictionary
+	}
+	terms := binary.LittleEndian.Uint64(data[len(data) - 16:])
+	blocks := binary.LittleEndian.Uint64(data[len(data) - 8:])
+	if blocks != (terms + dictionary_block - 1) / dictionary_block || uint64(len(data) - 16) / 8 < blocks {
+		unmapFile(data)
+		return nil, errCorruptDictionary
+	}
+	index_start := len(data) - 16 - 8 * int(blocks)
+	return &dictionary{
+		data: data,
+		terms: int(terms),
+		blocks: int(blocks),
+		index: data[index_start:len(data) - 16],
+	}, nil
+}
+
+// entries returns the blocks of entries, without the index after them.
+func (d *dictionary) entries() []byte {
+	return d.data[:len(d.data) - 16 - len(d.index)]
+}
+
+func (d *dictionary) close() error {
+	return unmapFile(d.data)
+}
+
+// termCursor decodes the dictionary's entries in order, from the start of a
+// block.
+type termCursor struct {
+	dict *dictionary
+	block int
+	pos int
+	left int
+	offset int64
+	// term and info are those of the current entry
+	term []byte
+	info termInfo
+	err error
+}
+
+// cursor returns a cursor positioned before the first entry of block.
+func (d *dictionary) cursor(block int) *termCursor {
+	c := &termCursor{dict: d, block: block - 1}
+	c.nextBlock()
+	return c
+}
+
+func (c *termCursor) nextBlock() bool {
+	c.block++
+	if c.block >= c.dict.blocks {
+		c.left = 0
+		return false
+	}
+	data := c.dict.entries()
+	c.pos = int(min(binary.LittleEndian.Uint64(c.dict.index[8 * c.block:]), uint64(len(data))))
+	c.left = min(dictionary_block, c.dict.terms - c.block * dictionary_block)
+	offset, size := binary.Uvarint(data[c.pos:])
+	if size <= 0 {
+		return c.fail()
+	}
+	c.offset = int64(offset)
+	c.pos += size
+	return true
+}
+
+// next decodes the next entry, returning false at the end of the
+// dictionary.
+func (c *termCursor) next() bool {
+	if c.left == 0 && !c.nextBlock() {
+		return false
+	}
+	data := c.dict.entries()
+	var fields [4]uint64
+	for i := range fields {
+		value, size := binary.Uvarint(data[min(c.pos, len(data)):])
+		if size <= 0 {
+			return c.fail()
+		}
+		fields[i] = value
+		c.pos += size
+		if i == 1 {
+			if fields[0] > uint64(len(c.term)) || uint64(len(data) - c.pos) < value {
+				return c.fail()
+			}
+			c.term = append(c.term[:fields[0]], data[c.pos:c.pos + int(value)]...)
+			c.pos += int(value)
+		}
+	}
+	c.info = termInfo{DocFreq: int(fields[2]), offset: c.offset, length: int64(fields[3])}
+	c.offset += int64(fields[3])
+	c.left--
+	return true
+}
+
+func (c *termCursor) fail() bool {
+	c.err = errCorruptDictionary
+	c.left = 0
+	c.block = c.dict.blocks
+	return false
+}
+
+// findBlock returns the last block whose first term sorts at or before term.
+func (d *dictionary) findBlock(term string) int {
+	found := sort.Search(d.blocks, func(block int) bool {
+		c := d.cursor(block)
+		return c.next() && string(c.term) > term
+	})
+	return max(found - 1, 0)
+}
+
+// lookup returns the entry for term, if there is one.
+func (d *dictionary) lookup(term string) (termInfo, bool) {
+	c := d.cursor(d.findBlock(term))
+	for c.next() {
+		switch strings.Compare(string(c.term), term) {
+		case 0:
+			return c.info, true
+		case 1:
+			return termInfo{}, false
+		}
+	}
+	return termInfo{}, false
+}
+
+// eachPrefix calls fn with each term starting with prefix, in order, until
+// fn returns false.
+func (d *dictionary) eachPrefix(prefix string, fn func(c *termCursor) bool) error {
+	c := d.cursor(d.findBlock(prefix))
+	for c.next() {
+		if bytes.HasPrefix(c.term, []byte(prefix)) {
+			if !fn(c) {
+				return nil
+			}
+		} else if string(c.term) > prefix {
+			break
+		}
+	}
+	return c.err
+}
+
+// eachFuzzy calls fn with each term within distance edits of term whose
+// first prefix_length characters are the same as term's, in order, until fn
+// returns false. Edits are insertions, deletions and substitutions of
+// characters.
+//
+// Terms are checked against term one by one, but the edit distance table is
+// only filled in from the prefix each shares with the term before, and once
+// a prefix is more than distance edits away, the terms sharing it are
+// skipped.
+func (d *dictionary) eachFuzzy(term string, distance int, prefix_length int, fn func(c *termCursor) bool) error {
+	target := []rune(term)
+	prefix_length = min(prefix_length, len(target))
+	prefix := string(target[:prefix_length])
+	target = target[prefix_length:]
+
+	// rows[i] holds the edit distances from the first i characters of the
+	// candidate after the prefix to each prefix of the target
+	rows := [][]int{make([]int, len(target) + 1)}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	var candidate, last []rune
+	valid := 0
+	dead := -1
+
+	return d.eachPrefix(prefix, func(c *termCursor) bool {
+		last, candidate = candidate, appendRunes(last[:0], c.term[len(prefix):])
+		common := 0
+		for common < min(len(candidate), len(last)) && candidate[common] == last[common] {
+			common++
+		}
+		if dead >= 0 && common >= dead {
+			return true
+		}
+		dead = -1
+
+		for i := min(common, valid) + 1; i <= len(candidate); i++ {
+			if len(rows) <= i {
+				rows = append(rows, make([]int, len(target) + 1))
+			}
+			above, row := rows[i - 1], rows[i]
+			row[0] = i
+			closest := row[0]
+			for j := 1; j <= len(target); j++ {
+				cost := 1
+				if target[j - 1] == candidate[i - 1] {
+					cost = 0
+				}
+				row[j] = min(above[j] + 1, row[j - 1] + 1, above[j - 1] + cost)
+				closest = min(closest, row[j])
+			}
+			if closest > distance {
+				dead = i
+				valid = i
+				return true
+			}
+		}
+		valid = len(candidate)
+		if rows[len(candidate)][len(target)] <= distance {
+			return fn(c)
+		}
+		return true
+	})
+}
+
+func appendRunes(runes []rune, text []byte) []rune {
+	for len(text) > 0 {
+		r, size := utf8.DecodeRune(text)
+		runes = append(runes, r)
+		text = text[size:]
+	}
+	return runes
+}
@@ -0,0 +1,249 @@
+package segment
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeDictionary writes terms, which must be sorted, as a dictionary and
+// opens it. Each term's doc frequency is one more than its index, and its
+// posting list ten bytes longer.
+func writeDictionary(t *testing.T, terms []string) *dictionary {
+	path := filepath.Join(t.TempDir(), fln_terms)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bufio.NewWriter(file)
+	writer := newDictionaryWriter(out)
+	var offset int64
+	for i, term := range terms {
+		if err := writer.add(term, testInfo(i, offset)); err != nil {
+			t.Fatal(err)
+		}
+		offset += testInfo(i, offset).length
+	}
+	if err := writer.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dict, err := openDictionary(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dict.close()
+	})
+	return dict
+}
+
+func testInfo(i int, offset int64) termInfo {
+	return termInfo{DocFreq: i + 1, offset: offset, length: int64(i + 10)}
+}
+
+// testTerms makes n sorted terms, sharing prefixes of different lengths.
+func testTerms(n int) []string {
+	terms := make([]string, n)
+	for i := range terms {
+		terms[i] = fmt.Sprintf("%c%02d", 'a' + i / 10, i % 10)
+		if i % 3 == 0 {
+			terms[i] += "x"
+		}
+	}
+	sort.Strings(terms)
+	return terms
+}
+
+func TestDictionaryLookup(t *testing.T) {
+	for _, n := range []int{0, 1, dictionary_block - 1, dictionary_block, dictionary_block + 1, 2 * dictionary_block, 3 * dictionary_block + 5} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			terms := testTerms(n)
+			dict := writeDictionary(t, terms)
+			if dict.terms != n || dict.blocks != (n + dictionary_block - 1) / dictionary_block {
+				t.Fatalf("opened %d terms in %d blocks", dict.terms, dict.blocks)
+			}
+			var offset int64
+			for i, term := range terms {
+				want := testInfo(i, offset)
+				offset += want.length
+				info, found := dict.lookup(term)
+				if !found || info != want {
+					t.Errorf("lookup(%q) = %+v, %v, want %+v", term, info, found, want)
+				}
+				// The terms either side of it that aren't in the dictionary
+				for _, missing := range []string{term[:len(term) - 1], term + "!"} {
+					if i + 1 < len(terms) && missing == terms[i + 1] {
+						continue
+					}
+					if info, found := dict.lookup(missing); found {
+						t.Errorf("lookup(%q) found %+v", missing, info)
+					}
+				}
+			}
+			for _, missing := range []string{"", "0", "~"} {
+				if info, found := dict.lookup(missing); found {
+					t.Errorf("lookup(%q) found %+v", missing, info)
+				}
+			}
+		})
+	}
+}
+
+func TestDictionaryEachPrefix(t *testing.T) {
+	terms := testTerms(4 * dictionary_block + 3)
+	dict := writeDictionary(t, terms)
+
+	// Prefixes of the terms either side of each block boundary, and some
+	// matching nothing
+	prefixes := []string{"", "0", "~", "b0", "zz"}
+	for block := dictionary_block; block < len(terms); block += dictionary_block {
+		for _, term := range terms[block - 1:block + 1] {
+			for size := 1; size <= len(term); size++ {
+				prefixes = append(prefixes, term[:size])
+			}
+		}
+	}
+	for _, prefix := range prefixes {
+		var want []string
+		for _, term := range terms {
+			if strings.HasPrefix(term, prefix) {
+				want = append(want, term)
+			}
+		}
+		var got []string
+		if err := dict.eachPrefix(prefix, func(c *termCursor) bool {
+			got = append(got, string(c.term))
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("eachPrefix(%q)\n got: %q\nwant: %q", prefix, got, want)
+		}
+	}
+
+	// Stopping early
+	var got []string
+	dict.eachPrefix("", func(c *termCursor) bool {
+		got = append(got, string(c.term))
+		return len(got) < dictionary_block + 1
+	})
+	if !reflect.DeepEqual(got, terms[:dictionary_block + 1]) {
+		t.Errorf("eachPrefix went on after being stopped: %q", got)
+	}
+}
+
+// levenshtein is the edit distance between a and b, by characters.
+func levenshtein(a string, b string) int {
+	x, y := []rune(a), []rune(b)
+	row := make([]int, len(y) + 1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i - 1] == y[j - 1] {
+				cost = 0
+			}
+			diagonal, row[j] = row[j], min(row[j] + 1, row[j - 1] + 1, diagonal + cost)
+		}
+	}
+	return row[len(y)]
+}
+
+func TestDictionaryEachFuzzy(t *testing.T) {
+	terms := []string{
+		"a", "ab", "abc", "abd", "abdc", "b", "ba", "bar", "bard", "bark", "barn",
+		"baron", "barons", "barrow", "bat", "batch", "bath", "cafe", "café",
+		"cafés", "caff", "clam", "clams", "lead:seal", "lead:seals", "lead:walrus",
+		"seal", "seals", "sell", "walrus", "walruses", "wałrus", "zebra", "ø", "øl",
+	}
+	sort.Strings(terms)
+	dict := writeDictionary(t, terms)
+
+	queries := []string{"", "a", "ba", "bar", "barn", "barrows", "cafe", "café", "seal", "walrus", "wlarus", "lead:seal", "x", "ø"}
+	for _, query := range queries {
+		for distance := 0; distance <= 2; distance++ {
+			for _, prefix_length := range []int{0, 1, 2, 5, 10} {
+				prefix := string([]rune(query)[:min(prefix_length, len([]rune(query)))])
+				var want []string
+				for _, term := range terms {
+					if strings.HasPrefix(term, prefix) && levenshtein(term, query) <= distance {
+						want = append(want, term)
+					}
+				}
+				var got []string
+				if err := dict.eachFuzzy(query, distance, prefix_length, func(c *termCursor) bool {
+					got = append(got, string(c.term))
+					return true
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("eachFuzzy(%q, %d, %d)\n got: %q\nwant: %q", query, distance, prefix_length, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+		{"café", "cafe", 1},
+		{"walrus", "wlarus", 2},
+	}
+	for _, test := range tests {
+		if got := levenshtein(test.a, test.b); got != test.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestEmptyDictionary(t *testing.T) {
+	dict := writeDictionary(t, nil)
+	if dict.terms != 0 || dict.blocks != 0 {
+		t.Errorf("opened %d terms in %d blocks", dict.terms, dict.blocks)
+	}
+	if info, found := dict.lookup(""); found {
+		t.Errorf("lookup found %+v", info)
+	}
+	fn := func(c *termCursor) bool {
+		t.Errorf("found %q", c.term)
+		return true
+	}
+	if err := dict.eachPrefix("", fn); err != nil {
+		t.Error(err)
+	}
+	if err := dict.eachFuzzy("a", 2, 0, fn); err != nil {
+		t.Error(err)
+	}
+
+	// A file with no counts isn't a dictionary at all
+	path := filepath.Join(t.TempDir(), fln_terms)
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openDictionary(path); err != errCorruptDictionary {
+		t.Errorf("opening an empty file gave %v, want errCorruptDictionary", err)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package segment
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the whole of file into memory, where it can't be mapped.
+func mapFile(file *os.File) ([]byte, error) {
+	return io.ReadAll(file)
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
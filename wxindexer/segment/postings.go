@@ -0,0 +1,320 @@
+package segment
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+
+	"wxindexer/containers"
+)
+
+var errCorrupt = errors.New("segment: corrupt posting list")
+
+// postingsWriter encodes posting lists one term at a time, each between a
+// begin and an end.
+type postingsWriter struct {
+	out *bufio.Writer
+	size int64
+	start int64
+	df int
+	// last_doc is the last doc of the block before the one being filled
+	last_doc uint32
+	docs []uint32
+	tfs []uint8
+	counts []uint32
+	positions [][]byte
+	deltas []uint32
+	scratch []byte
+}
+
+func newPostingsWriter(out *bufio.Writer) *postingsWriter {
+	return &postingsWriter{
+		out: out,
+		docs: make([]uint32, 0, block_size),
+		tfs: make([]uint8, 0, block_size),
+		counts: make([]uint32, 0, block_size),
+		positions: make([][]byte, 0, block_size),
+		deltas: make([]uint32, block_size),
+	}
+}
+
+func (w *postingsWriter) begin() {
+	w.start = w.size
+	w.df = 0
+	w.last_doc = 0
+}
+
+// add appends a posting, which must be for a later doc than the last.
+func (w *postingsWriter) add(doc uint32, tf uint8, count uint32, positions []byte) error {
+	w.docs = append(w.docs, doc)
+	w.tfs = append(w.tfs, tf)
+	w.counts = append(w.counts, count)
+	w.positions = append(w.positions, positions)
+	w.df++
+	if len(w.docs) == block_size {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// end finishes the posting list, returning where it is in the postings file
+// and the number of docs in it.
+func (w *postingsWriter) end() (offset int64, length int64, df int, err error) {
+	if len(w.docs) > 0 {
+		if err := w.flushBlock(); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	return w.start, w.size - w.start, w.df, nil
+}
+
+func (w *postingsWriter) flushBlock() error {
+	n := len(w.docs)
+	var widest uint32 = 0
+	var largest uint32 = 0
+	with_positions := false
+	prev := w.last_doc
+	for i, doc := range w.docs {
+		w.deltas[i] = doc - prev
+		widest |= w.deltas[i]
+		prev = doc
+		largest |= w.counts[i]
+		with_positions = with_positions || len(w.positions[i]) > 0
+	}
+
+	flags := byte(bits.Len32(widest))
+	if with_positions {
+		flags |= has_positions
+	}
+	body := append(w.scratch[:0], flags)
+	body = packBits(body, w.deltas[:n], bits.Len32(widest))
+	body = append(body, byte(bits.Len32(largest)))
+	body = packBits(body, w.counts, bits.Len32(largest))
+	body = append(body, w.tfs...)
+	if with_positions {
+		for _, positions := range w.positions {
+			body = binary.AppendUvarint(body, uint64(len(positions)))
+			body = append(body, positions...)
+		}
+	}
+
+	var header [2 * binary.MaxVarintLen64]byte
+	header_len := binary.PutUvarint(header[:], uint64(w.docs[n - 1] - w.last_doc))
+	header_len += binary.PutUvarint(header[header_len:], uint64(len(body)))
+	if _, err := w.out.Write(header[:header_len]); err != nil {
+		return err
+	}
+	if _, err := w.out.Write(body); err != nil {
+		return err
+	}
+	w.size += int64(header_len + len(body))
+	w.scratch = body
+
+	w.last_doc = w.docs[n - 1]
+	w.docs = w.docs[:0]
+	w.tfs = w.tfs[:0]
+	w.counts = w.counts[:0]
+	clear(w.positions)
+	w.positions = w.positions[:0]
+	return nil
+}
+
+// packBits appends values, each width bits wide, to dst, least significant
+// bits first.
+func packBits(dst []byte, values []uint32, width int) []byte {
+	var acc uint64 = 0
+	var held = 0
+	for _, value := range values {
+		acc |= uint64(value) << held
+		held += width
+		for held >= 8 {
+			dst = append(dst, byte(acc))
+			acc >>= 8
+			held -= 8
+		}
+	}
+	if held > 0 {
+		dst = append(dst, byte(acc))
+	}
+	return dst
+}
+
+// unpackBits reads len(dst) values packed by packBits, returning what follows
+// them in src.
+func unpackBits(src []byte, dst []uint32, width int) ([]byte, error) {
+	size := (len(dst) * width + 7) / 8
+	if len(src) < size {
+		return nil, errCorrupt
+	}
+	mask := uint64(1) << width - 1
+	var acc uint64 = 0
+	var held = 0
+	var next = 0
+	for i := range dst {
+		for held < width {
+			acc |= uint64(src[next]) << held
+			next++
+			held += 8
+		}
+		dst[i] = uint32(acc & mask)
+		acc >>= width
+		held -= width
+	}
+	return src[size:], nil
+}
+
+// Postings iterates over the posting list of a term in doc order.
+type Postings struct {
+	data []byte
+	df int
+	// left counts the postings in the blocks after the current one
+	left int
+	// last_doc is the last doc of the current block
+	last_doc uint32
+	docs [block_size]uint32
+	counts [block_size]uint32
+	tfs []byte
+	positions [block_size][]byte
+	n int
+	i int
+	err error
+}
+
+func newPostings(data []byte, df int) *Postings {
+	return &Postings{data: data, df: df, left: df}
+}
+
+// Len returns the number of docs in the list.
+func (p *Postings) Len() int {
+	return p.df
+}
+
+// Next moves to the next posting, or to the first one if it hasn't been
+// called yet, returning false at the end of the list.
+func (p *Postings) Next() bool {
+	if p.i + 1 < p.n {
+		p.i++
+		return true
+	}
+	return p.loadBlock(0)
+}
+
+// Advance moves on to the first posting for target or a later doc, skipping
+// the blocks before it, and returns false if there is none.
+func (p *Postings) Advance(target uint32) bool {
+	if p.n == 0 || p.docs[p.n - 1] < target {
+		if !p.loadBlock(target) {
+			return false
+		}
+	}
+	for p.docs[p.i] < target {
+		p.i++
+	}
+	return true
+}
+
+func (p *Postings) Doc() uint32 {
+	return p.docs[p.i]
+}
+
+func (p *Postings) TF() float32 {
+	return DequantizeTF(p.tfs[p.i])
+}
+
+// Count returns the number of times the term occurs in the doc, or 0 if it
+// wasn't recorded.
+func (p *Postings) Count() int {
+	return int(p.counts[p.i])
+}
+
+// Positions returns the positions of the term in the doc, or nil if they
+// weren't recorded.
+func (p *Postings) Positions() []int {
+	if p.positions[p.i] == nil {
+		return nil
+	}
+	return containers.Positions(p.positions[p.i]).Decode()
+}
+
+// Err returns the error that ended the iteration early, if any.
+func (p *Postings) Err() error {
+	return p.err
+}
+
+// loadBlock decodes the first of the remaining blocks ending at or after
+// target.
+func (p *Postings) loadBlock(target uint32) bool {
+	p.n = 0
+	p.i = 0
+	for p.left > 0 {
+		delta, delta_len := binary.Uvarint(p.data)
+		if delta_len <= 0 {
+			return p.fail()
+		}
+		length, length_len := binary.Uvarint(p.data[delta_len:])
+		if length_len <= 0 || uint64(len(p.data) - delta_len - length_len) < length {
+			return p.fail()
+		}
+		body := p.data[delta_len + length_len:delta_len + length_len + int(length)]
+		p.data = p.data[delta_len + length_len + int(length):]
+
+		count := min(p.left, block_size)
+		p.left -= count
+		first := p.last_doc
+		p.last_doc += uint32(delta)
+		if p.last_doc < target {
+			continue
+		}
+		if !p.decodeBlock(body, count, first) {
+			return p.fail()
+		}
+		return true
+	}
+	return false
+}
+
+func (p *Postings) decodeBlock(body []byte, count int, prev uint32) bool {
+	if len(body) == 0 {
+		return false
+	}
+	flags := body[0]
+	rest, err := unpackBits(body[1:], p.docs[:count], int(flags &^ has_positions))
+	if err != nil || len(rest) == 0 {
+		return false
+	}
+	rest, err = unpackBits(rest[1:], p.counts[:count], int(rest[0]))
+	if err != nil || len(rest) < count {
+		return false
+	}
+	for i := range count {
+		prev += p.docs[i]
+		p.docs[i] = prev
+	}
+	p.tfs = rest[:count]
+	rest = rest[count:]
+
+	for i := range count {
+		p.positions[i] = nil
+		if flags & has_positions == 0 {
+			continue
+		}
+		length, length_len := binary.Uvarint(rest)
+		if length_len <= 0 || uint64(len(rest) - length_len) < length {
+			return false
+		}
+		if length > 0 {
+			p.positions[i] = rest[length_len:length_len + int(length)]
+		}
+		rest = rest[length_len + int(length):]
+	}
+	p.n = count
+	return true
+}
+
+func (p *Postings) fail() bool {
+	p.err = errCorrupt
+	p.n = 0
+	p.left = 0
+	return false
+}
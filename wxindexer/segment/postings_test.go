@@ -0,0 +1,201 @@
+package segment
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"wxindexer/containers"
+)
+
+func TestPackBits(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for width := 0; width <= 32; width++ {
+		for _, n := range []int{0, 1, 7, 8, 9, block_size} {
+			values := make([]uint32, n)
+			for i := range values {
+				values[i] = uint32(rng.Uint64() & (uint64(1) << width - 1))
+			}
+			packed := packBits([]byte{0xAA}, values, width)
+			if want := 1 + (n * width + 7) / 8; len(packed) != want {
+				t.Fatalf("width %d, %d values: packed into %d bytes, want %d", width, n, len(packed), want)
+			}
+			got := make([]uint32, n)
+			rest, err := unpackBits(append(packed[1:], 0x55), got, width)
+			if err != nil {
+				t.Fatalf("width %d, %d values: %v", width, n, err)
+			}
+			if !reflect.DeepEqual(rest, []byte{0x55}) {
+				t.Errorf("width %d, %d values: left %x after the values, want 55", width, n, rest)
+			}
+			if !reflect.DeepEqual(got, values) {
+				t.Errorf("width %d, %d values: unpacked %v, want %v", width, n, got, values)
+			}
+		}
+	}
+	if _, err := unpackBits([]byte{1, 2}, make([]uint32, 3), 8); err != errCorrupt {
+		t.Errorf("unpacking from too short a buffer gave %v, want errCorrupt", err)
+	}
+}
+
+// testPosting is a posting as read back from a list.
+type testPosting struct {
+	doc uint32
+	tf uint8
+	count uint32
+	positions []int
+}
+
+// encodeList writes postings as one posting list.
+func encodeList(t *testing.T, postings []testPosting) []byte {
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	writer := newPostingsWriter(out)
+	writer.begin()
+	for _, posting := range postings {
+		var positions []byte
+		if posting.positions != nil {
+			positions = containers.EncodePositions(posting.positions)
+		}
+		if err := writer.add(posting.doc, posting.tf, posting.count, positions); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offset, length, df, err := writer.end()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if offset != 0 || length != int64(buf.Len()) || df != len(postings) {
+		t.Fatalf("end gave offset %d, length %d and df %d, want 0, %d and %d", offset, length, df, buf.Len(), len(postings))
+	}
+	return buf.Bytes()
+}
+
+// testList makes n postings with docs spaced by up to gap, some with
+// positions.
+func testList(rng *rand.Rand, n int, gap int, with_positions bool) []testPosting {
+	postings := make([]testPosting, n)
+	var doc uint32 = uint32(rng.Intn(gap))
+	for i := range postings {
+		postings[i] = testPosting{doc: doc, tf: uint8(rng.Intn(256)), count: uint32(rng.Intn(1000))}
+		if with_positions && i % 3 != 0 {
+			postings[i].positions = []int{rng.Intn(10), 10 + rng.Intn(1000)}
+		}
+		doc += 1 + uint32(rng.Intn(gap))
+	}
+	return postings
+}
+
+func readList(p *Postings) []testPosting {
+	var got []testPosting
+	for p.Next() {
+		got = append(got, testPosting{doc: p.Doc(), tf: QuantizeTF(p.TF()), count: uint32(p.Count()), positions: p.Positions()})
+	}
+	return got
+}
+
+func TestPostingsRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	tests := []struct {
+		name string
+		postings []testPosting
+	}{
+		{"single doc 0", []testPosting{{doc: 0, tf: 255, count: 1}}},
+		{"zero counts", []testPosting{{doc: 3}, {doc: 4}}},
+		{"last doc", []testPosting{{doc: 0, count: 1}, {doc: 1 << 32 - 1, count: 1 << 32 - 1}}},
+		{"dense", testList(rng, 50, 1, false)},
+		{"block less one", testList(rng, block_size - 1, 10, false)},
+		{"one block", testList(rng, block_size, 10, false)},
+		{"block and one", testList(rng, block_size + 1, 10, false)},
+		{"many blocks", testList(rng, 5 * block_size + 17, 1000, false)},
+		{"positions", testList(rng, 3 * block_size, 5, true)},
+		{"positions in some blocks only", append(testList(rng, block_size, 5, false), testPosting{doc: 100000, count: 2, positions: []int{3, 8}})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := range test.postings {
+				// tfs are read back quantized, and the writer takes them so
+				test.postings[i].tf = QuantizeTF(DequantizeTF(test.postings[i].tf))
+			}
+			postings := newPostings(encodeList(t, test.postings), len(test.postings))
+			got := readList(postings)
+			if postings.Err() != nil {
+				t.Fatal(postings.Err())
+			}
+			if !reflect.DeepEqual(got, test.postings) {
+				t.Errorf("read back\n%v\nwant\n%v", got, test.postings)
+			}
+			if postings.Next() {
+				t.Errorf("Next moved past the end of the list")
+			}
+		})
+	}
+}
+
+func TestPostingsAdvance(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	list := testList(rng, 4 * block_size + 5, 20, false)
+	data := encodeList(t, list)
+
+	// first returns the index of the first posting for target or later
+	first := func(target uint32) int {
+		for i, posting := range list {
+			if posting.doc >= target {
+				return i
+			}
+		}
+		return len(list)
+	}
+	targets := []uint32{0, list[0].doc, list[block_size - 1].doc, list[block_size - 1].doc + 1, list[block_size].doc, list[3 * block_size + 2].doc, list[len(list) - 1].doc}
+	for i := 0; i < 50; i++ {
+		targets = append(targets, uint32(rng.Intn(int(list[len(list) - 1].doc) + 2)))
+	}
+	for _, target := range targets {
+		postings := newPostings(data, len(list))
+		want := first(target)
+		found := postings.Advance(target)
+		if found != (want < len(list)) {
+			t.Fatalf("Advance(%d) reported %v, want %v", target, found, want < len(list))
+		}
+		if !found {
+			continue
+		}
+		if postings.Doc() != list[want].doc || postings.Count() != int(list[want].count) {
+			t.Fatalf("Advance(%d) moved to doc %d with count %d, want doc %d with count %d", target, postings.Doc(), postings.Count(), list[want].doc, list[want].count)
+		}
+		// Iteration carries on from there
+		rest := readList(postings)
+		if len(rest) != len(list) - want - 1 || (len(rest) > 0 && rest[0].doc != list[want + 1].doc) {
+			t.Fatalf("after Advance(%d), Next read %d postings, want %d", target, len(rest), len(list) - want - 1)
+		}
+	}
+
+	// Advancing repeatedly, as when intersecting lists
+	postings := newPostings(data, len(list))
+	for i := 0; i < len(list); i += 37 {
+		if !postings.Advance(list[i].doc) || postings.Doc() != list[i].doc {
+			t.Fatalf("advancing in steps, Advance(%d) didn't find it", list[i].doc)
+		}
+	}
+	if postings.Advance(list[len(list) - 1].doc + 1) {
+		t.Errorf("Advance past the last doc found doc %d", postings.Doc())
+	}
+}
+
+func TestPostingsCorrupt(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	list := testList(rng, 2 * block_size + 3, 10, true)
+	data := encodeList(t, list)
+	for _, size := range []int{0, 1, 2, len(data) / 2, len(data) - 1} {
+		postings := newPostings(data[:size], len(list))
+		got := readList(postings)
+		if postings.Err() != errCorrupt {
+			t.Errorf("reading %d of %d bytes gave error %v after %d postings, want errCorrupt", size, len(data), postings.Err(), len(got))
+		}
+	}
+}
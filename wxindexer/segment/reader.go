@@ -0,0 +1,199 @@
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Segment is an open segment, safe for concurrent use.
+type Segment struct {
+	Meta *Meta
+	dictionary *dictionary
+	postings *os.File
+	docs *os.File
+	// docs_table is the offset of the table of doc offsets in the docs file
+	docs_table int64
+	// lengths is the lengths file mapped into memory, and fields maps the
+	// name of a field to its place among each doc's lengths
+	lengths []byte
+	fields map[string]int
+}
+
+// Open opens the segment in dir.
+func Open(dir string) (*Segment, error) {
+	meta, err := readMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Version != Version {
+		return nil, fmt.Errorf("%s holds a version %d segment, expected version %d", dir, meta.Version, Version)
+	}
+	dict, err := openDictionary(filepath.Join(dir, fln_terms))
+	if err != nil {
+		return nil, err
+	}
+	postings, err := os.Open(filepath.Join(dir, fln_postings))
+	if err != nil {
+		dict.close()
+		return nil, err
+	}
+	docs, err := os.Open(filepath.Join(dir, fln_docs))
+	if err != nil {
+		dict.close()
+		postings.Close()
+		return nil, err
+	}
+	segment := &Segment{
+		Meta: meta,
+		dictionary: dict,
+		postings: postings,
+		docs: docs,
+		fields: make(map[string]int),
+	}
+	info, err := docs.Stat()
+	if err == nil {
+		segment.docs_table = info.Size() - 8 * (int64(meta.Docs) + 1)
+		segment.lengths, err = mapLengths(filepath.Join(dir, fln_lengths), meta)
+	}
+	if err != nil {
+		segment.Close()
+		return nil, err
+	}
+	for i, field := range meta.Fields {
+		segment.fields[field] = i + 1
+	}
+	return segment, nil
+}
+
+func mapLengths(path string, meta *Meta) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	lengths, err := mapFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(lengths) != 4 * (len(meta.Fields) + 1) * int(meta.Docs) {
+		unmapFile(lengths)
+		return nil, fmt.Errorf("segment: lengths file doesn't match its %d docs", meta.Docs)
+	}
+	return lengths, nil
+}
+
+// DocFreq returns the number of docs with term.
+func (s *Segment) DocFreq(term string) int {
+	info, _ := s.dictionary.lookup(term)
+	return info.DocFreq
+}
+
+// Lookup returns the posting list of term, or nil if no doc has it.
+func (s *Segment) Lookup(term string) (*Postings, error) {
+	info, found := s.dictionary.lookup(term)
+	if !found {
+		return nil, nil
+	}
+	data := make([]byte, info.length)
+	if _, err := s.postings.ReadAt(data, info.offset); err != nil {
+		return nil, err
+	}
+	return newPostings(data, info.DocFreq), nil
+}
+
+// EachPrefix calls fn with each term starting with prefix and the number of
+// docs with it, in order, until fn returns false. A field's terms can be
+// enumerated by giving FieldTerm(field, prefix).
+func (s *Segment) EachPrefix(prefix string, fn func(term string, doc_freq int) bool) error {
+	return s.dictionary.eachPrefix(prefix, func(c *termCursor) bool {
+		return fn(string(c.term), c.info.DocFreq)
+	})
+}
+
+// EachFuzzy calls fn with each term within distance edits of term and the
+// number of docs with it, in order, until fn returns false. Only terms
+// starting with the same first prefix_length characters as term are
+// considered, which narrows the search, and also keeps the matches of a
+// field term like FieldTerm(field, term) in the field when prefix_length
+// covers the field's name.
+func (s *Segment) EachFuzzy(term string, distance int, prefix_length int, fn func(term string, doc_freq int) bool) error {
+	return s.dictionary.eachFuzzy(term, distance, prefix_length, func(c *termCursor) bool {
+		return fn(string(c.term), c.info.DocFreq)
+	})
+}
+
+// Length returns the number of terms in doc.
+func (s *Segment) Length(doc uint32) int {
+	return s.length(doc, 0)
+}
+
+// FieldLength returns the number of terms in field of doc.
+func (s *Segment) FieldLength(doc uint32, field string) int {
+	i, found := s.fields[field]
+	if !found {
+		return 0
+	}
+	return s.length(doc, i)
+}
+
+func (s *Segment) length(doc uint32, i int) int {
+	at := 4 * ((len(s.Meta.Fields) + 1) * int(doc) + i)
+	return int(binary.LittleEndian.Uint32(s.lengths[at:]))
+}
+
+// Doc returns the entry for doc in the doc table.
+func (s *Segment) Doc(doc uint32) (*Doc, error) {
+	if doc >= s.Meta.Docs {
+		return nil, fmt.Errorf("segment: doc %d out of range", doc)
+	}
+	var offsets [16]byte
+	if _, err := s.docs.ReadAt(offsets[:], s.docs_table + 8 * int64(doc)); err != nil {
+		return nil, err
+	}
+	start := binary.LittleEndian.Uint64(offsets[:8])
+	end := binary.LittleEndian.Uint64(offsets[8:])
+	// The last doc runs up to the table
+	if doc == s.Meta.Docs - 1 {
+		end = uint64(s.docs_table)
+	}
+	if end < start {
+		return nil, fmt.Errorf("segment: corrupt doc table")
+	}
+	record := make([]byte, end - start)
+	if _, err := s.docs.ReadAt(record, int64(start)); err != nil {
+		return nil, err
+	}
+
+	id, size := binary.Uvarint(record)
+	if size <= 0 {
+		return nil, fmt.Errorf("segment: corrupt doc %d", doc)
+	}
+	record = record[size:]
+	var fields [3]string
+	for i := range fields {
+		length, size := binary.Uvarint(record)
+		if size <= 0 || uint64(len(record) - size) < length {
+			return nil, fmt.Errorf("segment: corrupt doc %d", doc)
+		}
+		fields[i] = string(record[size:size + int(length)])
+		record = record[size + int(length):]
+	}
+	entry := &Doc{ID: int64(id), URL: fields[0], Title: fields[1], Redirect: fields[2]}
+	entry.Length = s.Length(doc)
+	entry.FieldLengths = make(map[string]int)
+	for _, field := range s.Meta.Fields {
+		if length := s.FieldLength(doc, field); length > 0 {
+			entry.FieldLengths[field] = length
+		}
+	}
+	return entry, nil
+}
+
+func (s *Segment) Close() error {
+	s.dictionary.close()
+	unmapFile(s.lengths)
+	s.docs.Close()
+	return s.postings.Close()
+}
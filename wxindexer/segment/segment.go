@@ -0,0 +1,120 @@
+package segment
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A segment is an immutable inverted index over a set of pages, stored as a
+// directory of files:
+//
+//   meta.json  the Meta describing the segment, written last
+//   terms      the term dictionary, mapped into memory when opened
+//   postings   the posting list of each term
+//   docs       the doc table, mapping doc numbers to pages
+//   lengths    the length of each doc and of each of its fields, in the
+//              order of Meta.Fields, as little endian uint32s
+//
+// Doc numbers are dense and local to the segment. A page's own terms are
+// indexed as they are and the terms of its fields as "field:term", which
+// can't clash as terms hold no colons.
+//
+// A posting list is a run of blocks of up to block_size postings, each:
+//
+//   uvarint  last doc in the block, less the last doc of the block before
+//   uvarint  length of the rest of the block
+//   byte     bit width of the doc deltas, with has_positions set if any
+//            posting in the block has positions
+//   ...      the doc deltas bit-packed, the first from the last doc of the
+//            block before
+//   byte     bit width of the term counts
+//   ...      the number of times the term occurs in each doc, bit-packed
+//   ...      a byte per posting holding its quantized term frequency
+//   ...      if has_positions, per posting the uvarint length of its
+//            positions and the positions as stored in the forward index
+//
+// so lookups can skip whole blocks without decoding them.
+
+const Version = 3
+
+const (
+	fln_meta = "meta.json"
+	fln_terms = "terms"
+	fln_postings = "postings"
+	fln_docs = "docs"
+	fln_lengths = "lengths"
+
+	block_size = 128
+	has_positions = 0x80
+)
+
+type Meta struct {
+	Version int
+	Docs uint32
+	// Pages counts the docs that aren't redirects
+	Pages uint32
+	Terms uint64
+	// Positions is set if any posting has positions
+	Positions bool
+	// Analyzer is the ID of the analyzer that made the terms, if known
+	Analyzer string
+	// Fields are the fields whose lengths are stored
+	Fields []string
+	// AvgLength is the average length of the pages that aren't redirects,
+	// and AvgFieldLengths that of each field over the same pages, counting
+	// the terms credited to them
+	AvgLength float64
+	AvgFieldLengths map[string]float64
+	Created time.Time
+}
+
+// Doc is an entry in the doc table.
+type Doc struct {
+	ID int64
+	URL string
+	Title string
+	// Redirect is the URL the page redirects to, or "" if it isn't a redirect
+	Redirect string
+	// Length is the number of terms in the page, and FieldLengths those in
+	// each of its fields
+	Length int
+	FieldLengths map[string]int
+}
+
+// FieldTerm is the term that the occurrences of term in field are indexed
+// under.
+func FieldTerm(field string, term string) string {
+	return field + ":" + term
+}
+
+// QuantizeTF stores a term frequency between 0 and 1 in a byte.
+func QuantizeTF(tf float32) uint8 {
+	return uint8(math.Round(float64(min(max(tf, 0), 1)) * 255))
+}
+
+func DequantizeTF(quantized uint8) float32 {
+	return float32(quantized) / 255
+}
+
+func writeMeta(dir string, meta *Meta) error {
+	data, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, fln_meta), data, 0644)
+}
+
+func readMeta(dir string) (*Meta, error) {
+	data, err := os.ReadFile(filepath.Join(dir, fln_meta))
+	if err != nil {
+		return nil, err
+	}
+	var meta Meta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
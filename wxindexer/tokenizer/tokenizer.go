@@ -0,0 +1,140 @@
+package tokenizer
+
+import (
+	"strings"
+	"unicode"
+
+	"common"
+
+	"github.com/clipperhouse/uax29/v2/words"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Tokenizer segments text on Unicode word boundaries (UAX #29) and
+// normalises each word into a term:
+//
+//   - Case is folded, so "STRASSE", "Straße" and "strasse" are one term.
+//   - With accent folding, accents are removed from Latin, Greek and
+//     Cyrillic letters, so "Zurich" matches "Zürich".
+//   - A possessive "'s" is dropped and other apostrophes are removed, so
+//     "Einstein's" is "einstein" and "O'Brien" is "obrien".
+//   - Hyphenated words are split into their parts, and other punctuation
+//     inside words, as in "U.S.A.", is removed.
+//   - Numbers keep their decimal point but lose grouping commas, so "1,000"
+//     and "1000" are one term.
+//
+// Queries have to be tokenized by a Tokenizer built from the same profile as
+// the one that indexed the pages they are matched against. It is safe for
+// concurrent use.
+type Tokenizer struct {
+	fold_accents bool
+}
+
+// New returns the tokenizer for the wiki described by profile.
+func New(profile *common.WikiProfile) *Tokenizer {
+	return &Tokenizer{fold_accents: profile.FoldAccents}
+}
+
+// Name identifies the tokenizer's rules, "unicode" or "unicode+fold-accents".
+func (t *Tokenizer) Name() string {
+	if t.fold_accents {
+		return "unicode+fold-accents"
+	}
+	return "unicode"
+}
+
+// Tokens returns the terms of text in order.
+func (t *Tokenizer) Tokens(text string) []string {
+	tokens := make([]string, 0, len(text) / 6)
+	caser := cases.Fold()
+	segments := words.FromString(text)
+	for segments.Next() {
+		if token := t.normalize(segments.Value(), caser); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// Normalize returns the term for a single word, or "" if it has none, as for
+// punctuation.
+func (t *Tokenizer) Normalize(word string) string {
+	return t.normalize(word, cases.Fold())
+}
+
+func (t *Tokenizer) normalize(word string, caser cases.Caser) string {
+	letters := false
+	digits := false
+	for _, r := range word {
+		if unicode.IsLetter(r) {
+			letters = true
+			break
+		}
+		digits = digits || unicode.IsNumber(r)
+	}
+	if !letters && !digits {
+		return ""
+	}
+
+	if !letters {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsNumber(r) || r == '.' {
+				return r
+			}
+			return -1
+		}, word)
+	}
+
+	word = trimPossessive(word)
+	word = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r) {
+			return r
+		}
+		return -1
+	}, word)
+	word = caser.String(word)
+	if t.fold_accents {
+		word = foldAccents(word)
+	}
+	return word
+}
+
+// trimPossessive drops a trailing "'s", written with either apostrophe.
+func trimPossessive(word string) string {
+	for _, suffix := range []string{"'s", "'S", "’s", "’S"} {
+		if trimmed, found := strings.CutSuffix(word, suffix); found && trimmed != "" {
+			return trimmed
+		}
+	}
+	return word
+}
+
+// foldedLetters are letters without a decomposition that are still read as
+// accented forms of others.
+var foldedLetters = map[rune]string{
+	'ø': "o", 'ł': "l", 'đ': "d", 'ħ': "h", 'ı': "i", 'æ': "ae", 'œ': "oe",
+}
+
+// foldAccents removes the combining marks from Latin, Greek and Cyrillic
+// letters. The marks of other scripts, like Devanagari's vowel signs, are
+// part of the letters, and are kept.
+func foldAccents(word string) string {
+	var folded strings.Builder
+	strip := false
+	for _, r := range norm.NFD.String(word) {
+		if unicode.Is(unicode.Mn, r) {
+			if !strip {
+				folded.WriteRune(r)
+			}
+			continue
+		}
+		strip = unicode.In(r, unicode.Latin, unicode.Greek, unicode.Cyrillic)
+		if replacement, found := foldedLetters[r]; found {
+			folded.WriteString(replacement)
+		} else {
+			folded.WriteRune(r)
+		}
+	}
+	return norm.NFC.String(folded.String())
+}
@@ -0,0 +1,67 @@
+package tokenizer
+
+import (
+	"reflect"
+	"testing"
+
+	"common"
+)
+
+func TestTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		fold_accents bool
+		want []string
+	}{
+		{"case folding", "STRASSE Straße strasse", false, []string{"strasse", "strasse", "strasse"}},
+		{"possessive", "Einstein's theory, Jesus' disciples", false, []string{"einstein", "theory", "jesus", "disciples"}},
+		{"curly possessive", "EINSTEIN’S", false, []string{"einstein"}},
+		{"lone s", "'s", false, []string{"s"}},
+		{"apostrophes", "O'Brien rock'n'roll", false, []string{"obrien", "rocknroll"}},
+		{"grouped numbers", "1,000 and 1000 and 1,000,000", false, []string{"1000", "and", "1000", "and", "1000000"}},
+		{"decimals", "3.14 and 2,500.5", false, []string{"3.14", "and", "2500.5"}},
+		{"hyphens", "state-of-the-art well-known", false, []string{"state", "of", "the", "art", "well", "known"}},
+		{"abbreviations", "U.S.A. e.g.", false, []string{"usa", "eg"}},
+		{"punctuation", "-- ... !? «»", false, []string{}},
+		{"accents kept", "Zürich café", false, []string{"zürich", "café"}},
+		{"accents folded", "Zürich café Ångström naïve", true, []string{"zurich", "cafe", "angstrom", "naive"}},
+		{"letters without decompositions", "Øresund Łódź Đorđe Æsir", true, []string{"oresund", "lodz", "dorde", "aesir"}},
+		{"greek and cyrillic", "Ἀθῆναι Йошкар", true, []string{"αθηναι", "иошкар"}},
+		{"devanagari marks kept", "हिन्दी", true, []string{"हिन्दी"}},
+		{"cjk ideographs", "東京都に住む", false, []string{"東", "京", "都", "に", "住", "む"}},
+		{"katakana", "カタカナ語", false, []string{"カタカナ", "語"}},
+		{"hangul", "한국어 위키백과", false, []string{"한국어", "위키백과"}},
+	}
+	for _, test := range tests {
+		tok := New(&common.WikiProfile{FoldAccents: test.fold_accents})
+		if got := tok.Tokens(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Tokens(%q) = %q, want %q", test.name, test.text, got, test.want)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tok := New(&common.WikiProfile{FoldAccents: true})
+	tests := map[string]string{
+		"Einstein's": "einstein",
+		"1,000": "1000",
+		"Łódź": "lodz",
+		"...": "",
+		"": "",
+	}
+	for word, want := range tests {
+		if got := tok.Normalize(word); got != want {
+			t.Errorf("Normalize(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestName(t *testing.T) {
+	if name := New(&common.WikiProfile{}).Name(); name != "unicode" {
+		t.Errorf("Name() = %q, want unicode", name)
+	}
+	if name := New(&common.WikiProfile{FoldAccents: true}).Name(); name != "unicode+fold-accents" {
+		t.Errorf("Name() = %q, want unicode+fold-accents", name)
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"maps"
 	"strings"
+	"net/url"
 	"wxindexer/containers"
+	"wxindexer/analyzer"
 	"wxindexer/cleaners"
 	"context"
 	"common"
@@ -15,63 +18,238 @@ var ctx = context.Background()
 func index(
 	page common.PageData,
 	cleaner cleaners.Cleaner,
-	stopwords *containers.Set[string],
-	rdb *redis.Client,
+	terms *analyzer.Analyzer,
+	record_positions bool,
 ) containers.PageTF {
-	// Clean raw text
-	data := cleaner.Clean(page.Body)
+	tf := containers.PageTF{
+		Title: page.Title,
+		URL: page.URL,
+		ID: page.ID,
+		RevisionID: page.RevisionID,
+		Timestamp: page.Timestamp,
+		Contributor: page.Contributor,
+	}
 
-	// Early return for redirects
-	if data.Redirect != nil {
-		return containers.PageTF{
-			Title: page.Title,
-			URL: page.URL,
-			Links: make([]string, 0),
-			Words: make(map[string]float32),
-			Redirect: data.Redirect,
+	// Redirects are flagged by dumps, and otherwise spotted by the cleaner
+	var data containers.Doc
+	if page.Redirect != "" {
+		redirect_link := url.PathEscape(strings.ReplaceAll(page.Redirect, " ", "_"))
+		fields := map[containers.Field]string{containers.FieldRedirects: page.Title}
+		data = containers.Doc{Fields: fields, Redirect: &redirect_link}
+	} else {
+		data = cleaner.Clean(page.Title, page.Body)
+	}
+
+	// Tokenize and index each field
+	field_counts := make(map[containers.Field]map[string]int)
+	tf.Fields = make(map[containers.Field]map[string]float32)
+	tf.FieldCounts = make(map[containers.Field]map[string]int)
+	tf.FieldLengths = make(map[containers.Field]int)
+	if record_positions {
+		tf.Positions = make(map[containers.Field]map[string]containers.Positions)
+	}
+	for field, text := range data.Fields {
+		var field_terms []string
+		if record_positions {
+			var positions []int
+			field_terms, positions = terms.Positions(text)
+			if len(field_terms) > 0 {
+				tf.Positions[field] = termPositions(field_terms, positions)
+			}
+		} else {
+			field_terms = terms.Terms(text)
+		}
+		field_counts[field] = countTerms(field_terms)
+		if len(field_counts[field]) > 0 {
+			tf.Fields[field] = termFrequencies(field_counts[field])
+			tf.FieldCounts[field] = field_counts[field]
+			tf.FieldLengths[field] = len(field_terms)
 		}
 	}
 
-	// Tokenize
-	words := strings.Split(*data.Body, " ")
+	if data.Redirect != nil {
+		tf.Links = make([]string, 0)
+		tf.Words = make(map[string]float32)
+		tf.Redirect = data.Redirect
+		return tf
+	}
 
-	// Index
+	// The page's own terms are those of its text, leaving out the title,
+	// which is counted for what it names
 	frequencies := make(map[string]int)
+	for _, field := range []containers.Field{containers.FieldHeadings, containers.FieldLead, containers.FieldBody} {
+		for term, num := range field_counts[field] {
+			frequencies[term] += num
+		}
+		tf.Length += tf.FieldLengths[field]
+	}
 
-	for _, word := range words {
-		if !stopwords.Contains(word) {
-			frequencies[word]++
+	// The text of links is counted for the pages they lead to
+	for link, text := range data.Anchors {
+		if counts := countTerms(terms.Terms(text)); len(counts) > 0 {
+			if tf.Anchors == nil {
+				tf.Anchors = make(map[string]map[string]int)
+			}
+			tf.Anchors[link] = counts
 		}
 	}
 
+	tf.Links = *data.Links
+	tf.Words = termFrequencies(frequencies)
+	tf.Counts = frequencies
+	return tf
+}
+
+func countTerms(terms []string) map[string]int {
+	counts := make(map[string]int)
+	for _, term := range terms {
+		counts[term]++
+	}
+	return counts
+}
+
+// termPositions groups positions by the term at each.
+func termPositions(terms []string, positions []int) map[string]containers.Positions {
+	grouped := make(map[string][]int)
+	for i, term := range terms {
+		grouped[term] = append(grouped[term], positions[i])
+	}
+	encoded := make(map[string]containers.Positions, len(grouped))
+	for term, term_positions := range grouped {
+		encoded[term] = containers.EncodePositions(term_positions)
+	}
+	return encoded
+}
+
+// termFrequencies computes the augmented frequency of each term, relative to
+// the most frequent one so long pages aren't favoured.
+func termFrequencies(counts map[string]int) map[string]float32 {
 	var max_term_count = 0
-	for _, num := range frequencies {
+	for _, num := range counts {
 		if num > max_term_count {
 			max_term_count = num
 		}
 	}
 
 	term_frequencies := make(map[string]float32)
-	for term, num := range frequencies {
+	for term, num := range counts {
 		term_frequencies[term] = 0.5 + 0.5 * (float32(num) / float32(max_term_count))
 	}
+	return term_frequencies
+}
 
-	flushToRedis(rdb, frequencies)
-	return containers.PageTF{
+// pageChange builds the record the writer needs to apply a deletion or move,
+// which unlike other pages need no indexing.
+func pageChange(page common.PageData) containers.PageTF {
+	tf := containers.PageTF{
 		Title: page.Title,
 		URL: page.URL,
-		Links: *data.Links,
-		Words: term_frequencies,
-		Redirect: nil,
+		ID: page.ID,
+		Timestamp: page.Timestamp,
 	}
+	if page.Op == common.OpDelete {
+		tf.Deleted = true
+	} else {
+		tf.MovedFrom = url.PathEscape(strings.ReplaceAll(page.MovedFrom, " ", "_"))
+	}
+	return tf
+}
+
+// flushToRedis counts page in the document frequencies of its terms and in
+// the total lengths, for the whole page and for each field. Redirects only
+// count in the fields. Credited fields are left out, as the pages their terms
+// are credited to are only found when inverting.
+func flushToRedis(rdb *redis.Client, page *containers.PageTF) error {
+	return countInRedis(rdb, page, 1)
 }
 
-func flushToRedis(rdb *redis.Client, wordCounts map[string]int) error {
+// retractFromRedis undoes flushToRedis for a page that is being replaced.
+func retractFromRedis(rdb *redis.Client, page *containers.PageTF) error {
+	return countInRedis(rdb, page, -1)
+}
+
+func countInRedis(rdb *redis.Client, page *containers.PageTF, delta int64) error {
 	_, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
-		for word := range wordCounts {
-			pipe.HIncrBy(ctx, "df_map", word, 1)
+		for field, frequencies := range page.Fields {
+			if field.Credited() {
+				continue
+			}
+			for word := range frequencies {
+				pipe.HIncrBy(ctx, field.DFKey(), word, delta)
+			}
+		}
+		for field, length := range page.FieldLengths {
+			if !field.Credited() {
+				pipe.IncrBy(ctx, field.LengthKey(), delta * int64(length))
+			}
+		}
+		if page.Redirect != nil {
+			return nil
+		}
+		for word := range page.Words {
+			pipe.HIncrBy(ctx, "df_map", word, delta)
+		}
+		pipe.IncrBy(ctx, "total_pages", delta)
+		if page.Length > 0 {
+			pipe.IncrBy(ctx, "total_length", delta * int64(page.Length))
+		}
+		return nil
+	})
+	return err
+}
+
+// retitle replaces the terms of the field holding the title of a moved page,
+// its redirect title if it is a redirect, with those of its new title.
+func retitle(page *containers.PageTF, terms *analyzer.Analyzer, rdb *redis.Client) error {
+	// Pages indexed before fields were have no title terms to replace
+	if len(page.Fields) == 0 {
+		return nil
+	}
+	field := containers.FieldTitle
+	if page.Redirect != nil {
+		field = containers.FieldRedirects
+	}
+	old := page.Fields[field]
+	old_length := page.FieldLengths[field]
+	title_terms, positions := terms.Positions(page.Title)
+	page.Fields = maps.Clone(page.Fields)
+	page.FieldCounts = maps.Clone(page.FieldCounts)
+	page.FieldLengths = maps.Clone(page.FieldLengths)
+	if counts := countTerms(title_terms); len(counts) > 0 {
+		page.Fields[field] = termFrequencies(counts)
+		// Pages indexed before counts were recorded don't get them for one
+		// field
+		if page.FieldCounts != nil {
+			page.FieldCounts[field] = counts
+			page.FieldLengths[field] = len(title_terms)
+		}
+	} else {
+		delete(page.Fields, field)
+		delete(page.FieldCounts, field)
+		delete(page.FieldLengths, field)
+	}
+	if page.Positions != nil {
+		page.Positions = maps.Clone(page.Positions)
+		if len(title_terms) > 0 {
+			page.Positions[field] = termPositions(title_terms, positions)
+		} else {
+			delete(page.Positions, field)
+		}
+	}
+
+	if field.Credited() {
+		return nil
+	}
+	_, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for word := range old {
+			pipe.HIncrBy(ctx, field.DFKey(), word, -1)
+		}
+		for word := range page.Fields[field] {
+			pipe.HIncrBy(ctx, field.DFKey(), word, 1)
+		}
+		if length := page.FieldLengths[field]; length != old_length {
+			pipe.IncrBy(ctx, field.LengthKey(), int64(length - old_length))
 		}
-		pipe.Incr(ctx, "total_pages")
 		return nil
 	})
 	return err
@@ -1,37 +1,201 @@
 package main
 
 import(
-	"os"
-	"bufio"
-	"encoding/json"
 	"log"
+	"time"
 
+	"wxindexer/analyzer"
 	"wxindexer/containers"
+
+	"github.com/redis/go-redis/v9"
 )
 
-func jsonWriter(tfChan <- chan containers.PageTF) {
-	err := os.MkdirAll("./localdata", 0755)
-	if err != nil {
-		panic(err)
+// jsonWriter appends indexed pages to the forward index, counting each in the
+// document frequencies as it goes. When updating an existing index, it also
+// retracts the replaced version of each page from the document frequencies
+// and sends the change in its links on to the page graph, and applies
+// deletions and moves.
+//
+// The forward index is flushed to disk every ack_interval, after which
+// flushed is called so producers can be told the pages written so far are
+// safe.
+func jsonWriter(
+	tfChan <- chan indexedPage,
+	index *forwardIndex,
+	rdb *redis.Client,
+	pg_map_chan chan <- containers.PageLinkData,
+	terms *analyzer.Analyzer,
+	update bool,
+	flushed func(),
+) {
+	ticker := time.NewTicker(ack_interval)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case item, ok := <- tfChan:
+			if !ok {
+				log.Println("wxindexer/writer: exiting")
+				running = false
+				break
+			}
+			writePage(item.tf, index, rdb, pg_map_chan, terms, update)
+			if !item.tf.Deleted && item.tf.MovedFrom == "" {
+				pending.remove(item.tf.ID, item.tf.URL)
+			}
+			item.from.done()
+		case <- ticker.C:
+			if err := index.flush(); err != nil {
+				panic(err)
+			}
+			flushed()
+		}
 	}
-	f, err := os.Create("/run/media/matthewnesbitt/Linux 1TB SSD/WikiDump/.tf_output.jsonl")
-	if err != nil {
+	if err := index.close(); err != nil {
 		panic(err)
 	}
+	flushed()
+	writer_group.Done()
+}
+
+func writePage(
+	page containers.PageTF,
+	index *forwardIndex,
+	rdb *redis.Client,
+	pg_map_chan chan <- containers.PageLinkData,
+	terms *analyzer.Analyzer,
+	update bool,
+) {
+	if page.Deleted {
+		deletePage(page, index, rdb, pg_map_chan)
+		return
+	} else if page.MovedFrom != "" {
+		movePage(page, index, rdb, pg_map_chan, terms)
+		return
+	}
+	if update {
+		replacePage(page, index, rdb, pg_map_chan)
+	} else {
+		pg_map_chan <- containers.PageLinkData{
+			URL: page.URL,
+			Links: containers.SetFromSlice(page.Links),
+			Redirect: page.Redirect,
+		}
+	}
+	// Counted as the page is written rather than as it is indexed, so only
+	// pages that reach the forward index are counted, and a page resent after
+	// a restart replaces the version written before it
+	if err := flushToRedis(rdb, &page); err != nil {
+		log.Fatalf("wxindexer/writer: failed to count page %d in document frequencies: %s", page.ID, err)
+	}
+	if err := index.append(page); err != nil {
+		log.Printf("wxindexer/writer: failed to write page %d: %s", page.ID, err)
+	}
+}
 
-	writer := bufio.NewWriter(f)
-	defer f.Close()
+// replacePage undoes the contribution of the indexed version of page, if any,
+// before the new version is written.
+func replacePage(
+	page containers.PageTF,
+	index *forwardIndex,
+	rdb *redis.Client,
+	pg_map_chan chan <- containers.PageLinkData,
+) {
+	// Pages without an ID, such as crawled ones, can't be matched up
+	old := indexedVersion(index, page.ID, "")
 
-	for {
-		if page, ok := <- tfChan; ok {
-			m_page, _ := json.Marshal(page)
-			writer.Write(m_page)
-			writer.Write([]byte("\n"))
-		} else {
-			log.Println("wxindexer/writer: exiting")
-			break
+	link_data := containers.PageLinkData{
+		URL: page.URL,
+		Links: containers.SetFromSlice(page.Links),
+		Redirect: page.Redirect,
+	}
+	if old != nil {
+		if err := retractFromRedis(rdb, old); err != nil {
+			log.Printf("wxindexer/writer: failed to update document frequencies for page %d: %s", page.ID, err)
 		}
+		link_data.Replaced = containers.SetFromSlice(old.Links)
 	}
-	writer.Flush()
-	writer_group.Done()
+	pg_map_chan <- link_data
+}
+
+// deletePage retracts an indexed page and replaces it with a tombstone.
+func deletePage(
+	page containers.PageTF,
+	index *forwardIndex,
+	rdb *redis.Client,
+	pg_map_chan chan <- containers.PageLinkData,
+) {
+	old := indexedVersion(index, page.ID, page.URL)
+	if old == nil {
+		log.Printf("wxindexer/writer: deleted page %s is not in the index", page.URL)
+		return
+	}
+
+	if err := retractFromRedis(rdb, old); err != nil {
+		log.Printf("wxindexer/writer: failed to update document frequencies for page %d: %s", old.ID, err)
+	}
+	pg_map_chan <- containers.PageLinkData{
+		URL: old.URL,
+		Replaced: containers.SetFromSlice(old.Links),
+		Deleted: true,
+	}
+
+	tombstone := containers.PageTF{
+		Title: old.Title,
+		URL: old.URL,
+		ID: old.ID,
+		Timestamp: page.Timestamp,
+		Deleted: true,
+	}
+	if err := index.append(tombstone); err != nil {
+		log.Printf("wxindexer/writer: failed to write tombstone for page %d: %s", old.ID, err)
+	}
+}
+
+// movePage rewrites an indexed page under its new title. Only the terms of
+// its title change, the rest of its document frequencies stay as they are.
+func movePage(
+	page containers.PageTF,
+	index *forwardIndex,
+	rdb *redis.Client,
+	pg_map_chan chan <- containers.PageLinkData,
+	terms *analyzer.Analyzer,
+) {
+	old := indexedVersion(index, page.ID, page.MovedFrom)
+
+	// Moving over a redirect deletes it without a log entry of its own, even
+	// if the moved page is in another shard's index
+	if target := index.resolve(page.URL); target != 0 && (old == nil || target != old.ID) {
+		deletePage(containers.PageTF{URL: page.URL, ID: target, Timestamp: page.Timestamp}, index, rdb, pg_map_chan)
+	}
+	if old == nil {
+		log.Printf("wxindexer/writer: moved page %s is not in the index", page.MovedFrom)
+		return
+	}
+
+	moved := *old
+	moved.Title = page.Title
+	moved.URL = page.URL
+	if err := retitle(&moved, terms, rdb); err != nil {
+		log.Printf("wxindexer/writer: failed to update document frequencies for page %d: %s", moved.ID, err)
+	}
+	if err := index.append(moved); err != nil {
+		log.Printf("wxindexer/writer: failed to write moved page %d: %s", moved.ID, err)
+	}
+	pg_map_chan <- containers.PageLinkData{URL: moved.URL, MovedFrom: old.URL}
+}
+
+// indexedVersion returns the latest indexed record for the page with id, or
+// if id is 0 the one with url, or nil if there is none.
+func indexedVersion(index *forwardIndex, id int64, url string) *containers.PageTF {
+	if id == 0 && url != "" {
+		id = index.resolve(url)
+	}
+	if id == 0 {
+		return nil
+	}
+	old, err := index.lookup(id)
+	if err != nil {
+		log.Printf("wxindexer/writer: failed to read indexed version of page %d: %s", id, err)
+	}
+	return old
 }
@@ -0,0 +1,124 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Checkpoint records how far through a dump wxunpacker has got, so that an
+// interrupted run can pick up where it stopped instead of at byte 0.
+type Checkpoint struct {
+	Input string
+	InputSize int64
+	// Offset is the byte offset in the dump to restart decoding from in order
+	// to reach the page after PageID: the start of its stream for multistream
+	// dumps, or the start of its <page> element for uncompressed dumps. It is
+	// -1 when the dump can't be seeked and has to be replayed from the start.
+	Offset int64
+	PageID int64
+	Title string
+	Pages int
+	Complete bool
+	Updated time.Time
+}
+
+func Load(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// Save atomically replaces the checkpoint at path, syncing it to disk before
+// returning so a crash never leaves a partially written checkpoint behind.
+func Save(path string, cp *Checkpoint) error {
+	data, err := json.MarshalIndent(cp, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp_path := path + ".tmp"
+	f, err := os.Create(tmp_path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp_path, path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Writer keeps track of the last page handed off and persists it at most once
+// per interval. It is not safe for concurrent use.
+type Writer struct {
+	path string
+	interval time.Duration
+	last_save time.Time
+	current Checkpoint
+}
+
+// NewWriter returns a Writer that continues on from base, which may be a
+// checkpoint loaded to resume from.
+func NewWriter(path string, interval time.Duration, base Checkpoint) *Writer {
+	return &Writer{path: path, interval: interval, last_save: time.Now(), current: base}
+}
+
+// Update records page as the most recent one handed off, saving the
+// checkpoint if the interval has passed since it was last saved. It reports
+// whether the checkpoint was saved.
+func (w *Writer) Update(offset int64, page_id int64, title string) (bool, error) {
+	w.current.Offset = offset
+	w.current.PageID = page_id
+	w.current.Title = title
+	w.current.Pages++
+	if time.Since(w.last_save) < w.interval {
+		return false, nil
+	}
+	return true, w.save()
+}
+
+// Current returns the position recorded by the last call to Update.
+func (w *Writer) Current() Checkpoint {
+	return w.current
+}
+
+// Save persists the current position immediately.
+func (w *Writer) Save() error {
+	return w.save()
+}
+
+// Finish saves a final checkpoint marking the dump as fully processed.
+func (w *Writer) Finish() error {
+	w.current.Complete = true
+	return w.save()
+}
+
+func (w *Writer) save() error {
+	w.last_save = time.Now()
+	w.current.Updated = w.last_save
+	return Save(w.path, &w.current)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"common"
+)
+
+const usage = `usage:
+  wxunpacker [unpack] [flags] <dump>   stream pages from a dump to wxindexer
+  wxunpacker count [flags] <dump>      count the pages a dump would produce
+  wxunpacker siteinfo [flags] <dump>   extract the wiki's siteinfo, including its namespaces
+  wxunpacker log [flags] <dump>        stream page deletions and moves from a logging dump
+
+<dump> is a pages-articles XML dump, or with -incremental a daily
+adds-changes dump, optionally bzip2 compressed (.bz2), or - to read from
+stdin. For log, <dump> is a pages-logging XML dump, optionally gzip
+compressed (.gz); apply it before the adds-changes dump covering the same
+period. Pages moved out of the included namespaces are deleted. Restores
+are ignored, as the log doesn't hold the restored text: re-send restored
+pages from a dump to index them again.
+
+Given several -addr endpoints, pages are split between the indexers, each
+building one shard, which are combined afterwards with wxindexer merge.
+Updates have to be sent to the same endpoints in the same order.
+
+-every, -fraction, -titles and -match send a repeatable sample of the
+dump, made of the pages passing all of them. With -closure the sample is
+the starting point, and the pages it links to, directly or through up to
+-closure links, are sent too, so links and PageRank stay consistent within
+small test indexes.
+`
+
+type options struct {
+	input string
+	index string
+	addrs []string
+	partition string
+	tls common.TLSFiles
+	window int
+	batch int
+	compression string
+	record string
+	workers int
+	limit int
+	namespaces map[string]bool
+	checkpoint string
+	checkpoint_interval time.Duration
+	resume bool
+	siteinfo string
+	incremental bool
+	method string
+	sample sampler
+	closure int
+}
+
+// keep reports whether page is one that should be sent on to the indexer.
+func (o *options) keep(page Page) bool {
+	return o.namespaces[page.Namespace] && page.Title != ""
+}
+
+func parseUnpackArgs(args []string) *options {
+	var opts options
+	var namespaces, addrs, titles, match string
+	flags := newFlagSet("unpack")
+	flags.StringVar(&addrs, "addr", common.DefaultEndpoint, "comma separated wxindexer endpoints, one per shard: unix:///path, tcp://host:port or tls://host:port")
+	flags.StringVar(&opts.partition, "partition", "id", "how pages are split between shards: id, or title for indexes that won't be updated")
+	opts.tls.RegisterFlags(flags)
+	flags.IntVar(&opts.window, "window", 4096, "pages to send ahead of the indexer's acknowledgements")
+	flags.IntVar(&opts.batch, "batch", 1, "pages to group into each message to the indexer")
+	flags.StringVar(&opts.compression, "compress", "none", "compression for batches of pages: none, zstd or snappy")
+	flags.StringVar(&opts.record, "record", "", "write pages to this record file for wxindexer -replay instead of sending them")
+	flags.StringVar(&opts.index, "index", "", "multistream index file, enables parallel decompression")
+	flags.IntVar(&opts.workers, "workers", runtime.NumCPU(), "number of decompression workers when using -index")
+	flags.IntVar(&opts.limit, "limit", 0, "stop after this many pages (0 for no limit)")
+	flags.StringVar(&namespaces, "namespaces", "0", "comma separated namespace keys to include")
+	flags.StringVar(&opts.checkpoint, "checkpoint", "", "file to periodically save progress to")
+	flags.DurationVar(&opts.checkpoint_interval, "checkpoint-interval", 30 * time.Second, "how often to save the checkpoint")
+	flags.BoolVar(&opts.resume, "resume", false, "continue after the page recorded in -checkpoint")
+	flags.StringVar(&opts.siteinfo, "siteinfo", "", "file to save the dump's siteinfo to, for wxindexer and wxcrawler")
+	flags.BoolVar(&opts.incremental, "incremental", false, "the dump is a daily adds-changes dump, send its pages as upserts to an existing index")
+	flags.IntVar(&opts.sample.every, "every", 1, "send only every Nth page")
+	flags.Float64Var(&opts.sample.fraction, "fraction", 1, "send only this fraction of pages, picked at random by -seed")
+	flags.Int64Var(&opts.sample.seed, "seed", 0, "seed picking the pages sent with -fraction")
+	flags.StringVar(&titles, "titles", "", "send only the pages whose titles are listed in this file, one per line")
+	flags.StringVar(&match, "match", "", "send only the pages whose titles match this regular expression")
+	flags.IntVar(&opts.closure, "closure", 0, "also send the pages linked from the pages picked, up to this many links away")
+	flags.Parse(args)
+
+	opts.input = parseInput(flags)
+	opts.namespaces = parseNamespaces(namespaces)
+	parseSampleArgs(flags, &opts, titles, match)
+	opts.addrs = strings.Split(addrs, ",")
+	if _, err := common.ParsePartitioner(opts.partition); err != nil {
+		exitUsage(flags, err.Error())
+	}
+	compression, err := common.ParseCompression(opts.compression)
+	if err != nil {
+		exitUsage(flags, err.Error())
+	}
+	opts.compression = compression
+	if opts.resume && opts.checkpoint == "" {
+		exitUsage(flags, "-resume requires -checkpoint")
+	}
+	// A record file is rewritten from scratch
+	if opts.resume && opts.record != "" {
+		exitUsage(flags, "-resume cannot be used with -record")
+	}
+	if opts.index != "" && opts.input == "-" {
+		exitUsage(flags, "-index cannot be used when reading from stdin")
+	}
+	if opts.workers < 1 {
+		exitUsage(flags, "-workers must be at least 1")
+	}
+	if opts.window < 1 {
+		exitUsage(flags, "-window must be at least 1")
+	}
+	if opts.batch < 1 || opts.batch > opts.window {
+		exitUsage(flags, "-batch must be between 1 and -window")
+	}
+	return &opts
+}
+
+func parseSampleArgs(flags *flag.FlagSet, opts *options, titles string, match string) {
+	if opts.sample.every < 1 {
+		exitUsage(flags, "-every must be at least 1")
+	}
+	if !(opts.sample.fraction > 0 && opts.sample.fraction <= 1) {
+		exitUsage(flags, "-fraction must be above 0 and at most 1")
+	}
+	if titles != "" {
+		var err error
+		if opts.sample.titles, err = loadTitles(titles); err != nil {
+			exitUsage(flags, err.Error())
+		}
+	}
+	if match != "" {
+		var err error
+		if opts.sample.pattern, err = regexp.Compile(match); err != nil {
+			exitUsage(flags, fmt.Sprintf("-match: %s", err))
+		}
+	}
+	if opts.closure < 0 {
+		exitUsage(flags, "-closure must be at least 0")
+	}
+	if opts.closure > 0 && !opts.sample.active() {
+		exitUsage(flags, "-closure needs pages to start from, picked with -titles, -match, -every or -fraction")
+	}
+	// Following links takes a pass over the dump for each level
+	if opts.closure > 0 && opts.input == "-" {
+		exitUsage(flags, "-closure cannot be used when reading from stdin")
+	}
+	// Counting restarts from the checkpoint, while the closure is always found
+	// from the start of the dump
+	if opts.sample.every > 1 && opts.closure == 0 && opts.resume {
+		exitUsage(flags, "-every cannot be used with -resume")
+	}
+}
+
+func parseCountArgs(args []string) *options {
+	var opts options
+	var namespaces string
+	flags := newFlagSet("count")
+	flags.StringVar(&opts.method, "method", "fast", "counting method: fast (line scanner) or xml (full XML decoder)")
+	flags.StringVar(&namespaces, "namespaces", "0", "comma separated namespace keys to include")
+	flags.Parse(args)
+
+	opts.input = parseInput(flags)
+	opts.namespaces = parseNamespaces(namespaces)
+	if opts.method != "fast" && opts.method != "xml" {
+		exitUsage(flags, fmt.Sprintf("unknown counting method %q", opts.method))
+	}
+	return &opts
+}
+
+func parseLogArgs(args []string) *options {
+	var opts options
+	var namespaces, addrs string
+	flags := newFlagSet("log")
+	flags.StringVar(&addrs, "addr", common.DefaultEndpoint, "comma separated wxindexer endpoints, one per shard: unix:///path, tcp://host:port or tls://host:port")
+	opts.tls.RegisterFlags(flags)
+	flags.IntVar(&opts.window, "window", 4096, "changes to send ahead of the indexer's acknowledgements")
+	flags.StringVar(&opts.record, "record", "", "write changes to this record file for wxindexer -replay instead of sending them")
+	flags.StringVar(&namespaces, "namespaces", "0", "comma separated namespace keys to include")
+	flags.Parse(args)
+
+	opts.input = parseInput(flags)
+	opts.namespaces = parseNamespaces(namespaces)
+	opts.addrs = strings.Split(addrs, ",")
+	// Deletions and moves go to every shard
+	opts.partition = "id"
+	return &opts
+}
+
+func parseSiteInfoArgs(args []string) *options {
+	var opts options
+	flags := newFlagSet("siteinfo")
+	flags.StringVar(&opts.siteinfo, "o", "", "file to save the siteinfo to instead of printing it")
+	flags.Parse(args)
+
+	opts.input = parseInput(flags)
+	return &opts
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet("wxunpacker " + name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		fmt.Fprintf(flags.Output(), "\n%s flags:\n", name)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func parseInput(flags *flag.FlagSet) string {
+	if flags.NArg() != 1 {
+		exitUsage(flags, "expected exactly one dump file")
+	}
+	return flags.Arg(0)
+}
+
+func parseNamespaces(list string) map[string]bool {
+	namespaces := make(map[string]bool)
+	for _, ns := range strings.Split(list, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces[ns] = true
+		}
+	}
+	return namespaces
+}
+
+func exitUsage(flags *flag.FlagSet, msg string) {
+	fmt.Fprintf(flags.Output(), "wxunpacker: %s\n", msg)
+	flags.Usage()
+	os.Exit(2)
+}
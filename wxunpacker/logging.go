@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"common"
+)
+
+// A logging dump lists every logged action on the wiki as <logitem> elements,
+// oldest first. Deletions and moves are the ones that change which pages
+// exist, and pages-articles and adds-changes dumps say nothing about them.
+
+type LogItem struct {
+	ID int64 `xml:"id"`
+	Timestamp time.Time `xml:"timestamp"`
+	Type string `xml:"type"`
+	Action string `xml:"action"`
+	Title string `xml:"logtitle"`
+	Params string `xml:"params"`
+}
+
+func runLog(opts *options) {
+	file, file_size, err := openInput(opts.input)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	var dump_head io.Reader = file
+	var site *common.SiteInfo
+	if opts.input == "-" {
+		site, dump_head, err = peekSiteInfo(file)
+	} else {
+		site, err = readSiteInfo(io.NewSectionReader(file, 0, file_size))
+	}
+	if err != nil {
+		log.Printf("wxunpacker: Failed to read siteinfo, every title is taken to be an article: %v\n", err)
+	}
+
+	producer, err := connectIndexer(opts, site, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	dump, _ := dumpReader(dump_head)
+	decoder := xml.NewDecoder(dump)
+
+	var deleted, moved, restored int
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			panic(err)
+		}
+
+		element, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if element.Name.Local != "logitem" {
+			continue
+		}
+
+		var item LogItem
+		if err := decoder.DecodeElement(&item, &element); err != nil {
+			panic(err)
+		}
+		if item.Type == "delete" && item.Action == "restore" {
+			restored++
+			continue
+		}
+		page, ok := logItemPage(item)
+		if !ok {
+			continue
+		}
+		page, ok = includedChange(page, opts.namespaces, site)
+		if !ok {
+			continue
+		}
+
+		message := common.MsgPage
+		if page.Op == common.OpDelete {
+			message = common.MsgDelete
+			deleted++
+		} else {
+			moved++
+		}
+		if _, err := producer.Send(message, &page); err != nil {
+			panic(err)
+		}
+	}
+	if err := producer.Close(); err != nil {
+		panic(err)
+	}
+	log.Printf("wxunpacker: Sent %d deletions and %d moves\n", deleted, moved)
+	if restored > 0 {
+		log.Printf("wxunpacker: Ignored %d restores, the log doesn't hold the restored pages' text\n", restored)
+	}
+}
+
+// includedChange limits a deletion or move to the included namespaces,
+// reporting false if it doesn't touch them. A page moved out of them is
+// deleted from the index, and one moved into them is sent as a move so any
+// redirect it replaces is deleted, though its text only arrives with the next
+// revision.
+func includedChange(page common.PageData, namespaces map[string]bool, site *common.SiteInfo) (common.PageData, bool) {
+	if page.Op != common.OpMove {
+		return page, namespaces[namespaceOf(page.Title, site)]
+	}
+	from := namespaces[namespaceOf(page.MovedFrom, site)]
+	to := namespaces[namespaceOf(page.Title, site)]
+	switch {
+	case from && !to:
+		deleted := common.PageData{Op: common.OpDelete, Title: page.MovedFrom, Timestamp: page.Timestamp}
+		deleted.URL = url.PathEscape(strings.ReplaceAll(deleted.Title, " ", "_"))
+		return deleted, true
+	case !from && !to:
+		return page, false
+	}
+	return page, true
+}
+
+// logItemPage converts a deletion or move into the message telling the indexer
+// about it, reporting false for any other kind of log item.
+func logItemPage(item LogItem) (common.PageData, bool) {
+	page := common.PageData{Timestamp: item.Timestamp}
+	switch {
+	case item.Type == "delete" && (item.Action == "delete" || item.Action == "delete_redir"):
+		page.Op = common.OpDelete
+		page.Title = item.Title
+	case item.Type == "move" && (item.Action == "move" || item.Action == "move_redir"):
+		target := moveTarget(item.Params)
+		if target == "" {
+			log.Printf("wxunpacker: Skipping move of %s with no target\n", item.Title)
+			return page, false
+		}
+		page.Op = common.OpMove
+		page.Title = target
+		page.MovedFrom = item.Title
+	default:
+		return page, false
+	}
+	page.URL = url.PathEscape(strings.ReplaceAll(page.Title, " ", "_"))
+	return page, true
+}
+
+// moveTarget returns the title a page was moved to from the params of a move
+// log item. These are a PHP serialized array, as in
+// a:2:{s:9:"4::target";s:3:"New";s:10:"5::noredir";s:1:"0";}, or in old
+// entries just the target title on the first line.
+func moveTarget(params string) string {
+	if !strings.HasPrefix(params, "a:") {
+		target, _, _ := strings.Cut(params, "\n")
+		return strings.TrimSpace(target)
+	}
+
+	const key = `"4::target";s:`
+	_, rest, found := strings.Cut(params, key)
+	if !found {
+		return ""
+	}
+	length_field, rest, found := strings.Cut(rest, `:"`)
+	if !found {
+		return ""
+	}
+	// The length is in bytes, so titles containing quotes are handled too
+	length, err := strconv.Atoi(length_field)
+	if err != nil || length > len(rest) {
+		return ""
+	}
+	return rest[:length]
+}
+
+// namespaceOf returns the key of the namespace title is in, judged by its
+// prefix. Without a siteinfo every title is taken to be in the main namespace.
+func namespaceOf(title string, site *common.SiteInfo) string {
+	prefix, _, found := strings.Cut(title, ":")
+	if !found || site == nil {
+		return "0"
+	}
+	for _, ns := range site.Namespaces {
+		if ns.Name != "" && strings.EqualFold(ns.Name, prefix) {
+			return strconv.Itoa(ns.Key)
+		}
+	}
+	return "0"
+}
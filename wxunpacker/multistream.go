@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"common"
+)
+
+// A multistream dump is a concatenation of independent bzip2 streams. The
+// first holds the <mediawiki> header and <siteinfo>, the last holds the
+// closing </mediawiki>, and every stream in between holds up to 100 <page>
+// elements. The index file lists the byte offset of the stream containing
+// each page, one "offset:page_id:title" line per page.
+
+type stream struct {
+	index int
+	offset int64
+	length int64
+}
+
+type streamResult struct {
+	index int
+	length int64
+	pages []Page
+	err error
+}
+
+// readMultistreamIndex returns the distinct stream offsets listed in the
+// index file, in ascending order.
+func readMultistreamIndex(path string) ([]int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	index, _ := dumpReader(file)
+	scanner := bufio.NewScanner(index)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	offsets := make([]int64, 0)
+	var last int64 = -1
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		field, _, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed index line: %q", line)
+		}
+		offset, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed index line: %q: %v", line, err)
+		}
+		if offset != last {
+			offsets = append(offsets, offset)
+			last = offset
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// The index is written in dump order, but don't rely on it
+	slices.Sort(offsets)
+	offsets = slices.Compact(offsets)
+	return offsets, nil
+}
+
+// unpackMultistream decompresses and decodes the page streams of a multistream
+// dump on a pool of workers. Pages kept by opts are passed to emit in dump
+// order, so the output matches a sequential run, until emit returns false.
+// done is called with the compressed size of each stream once all of its
+// pages have been emitted.
+func unpackMultistream(
+	file *os.File,
+	file_size int64,
+	offsets []int64,
+	opts *options,
+	emit func(Page) bool,
+	done func(int64),
+) error {
+	if len(offsets) == 0 {
+		return errors.New("multistream index lists no streams")
+	}
+
+	// Bound the number of decoded streams held waiting for an earlier one
+	window := opts.workers * 4
+	slots := make(chan struct{}, window)
+	jobs := make(chan stream, opts.workers)
+	results := make(chan streamResult, window)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(jobs)
+		for i, offset := range offsets {
+			// The last page stream runs into the trailing </mediawiki> stream
+			length := file_size - offset
+			if i + 1 < len(offsets) {
+				length = offsets[i + 1] - offset
+			}
+			select {
+			case slots <- struct{}{}:
+			case <- stop:
+				return
+			}
+			jobs <- stream{index: i, offset: offset, length: length}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(opts.workers)
+	for range opts.workers {
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				results <- decodeStream(file, job, opts)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := make(map[int]streamResult)
+	next := 0
+	stopped := false
+	var err error
+	for result := range results {
+		if stopped {
+			continue
+		}
+		pending[result.index] = result
+		for {
+			ready, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			if ready.err != nil {
+				err = fmt.Errorf("stream at offset %d: %w", offsets[next], ready.err)
+				stopped = true
+				close(stop)
+				break
+			}
+			more := true
+			for _, page := range ready.pages {
+				if more = emit(page); !more {
+					break
+				}
+			}
+			done(ready.length)
+			if !more {
+				stopped = true
+				close(stop)
+				break
+			}
+			next++
+			<- slots
+		}
+	}
+	return err
+}
+
+func decodeStream(file *os.File, job stream, opts *options) streamResult {
+	section := io.NewSectionReader(file, job.offset, job.length)
+	decoder := xml.NewDecoder(bzip2.NewReader(bufio.NewReaderSize(section, 256*1024)))
+
+	pages := make([]Page, 0, 100)
+	err := decodePages(decoder, -1, nil, func(page Page) bool {
+		if opts.keep(page) {
+			page.Offset = job.offset
+			pages = append(pages, page)
+		}
+		return true
+	})
+	return streamResult{index: job.index, length: job.length, pages: pages, err: err}
+}
+
+// decodePages passes every <page> element read from decoder to emit until the
+// input is exhausted or emit returns false, and the <siteinfo> element to site
+// if it is not nil. base is the file offset the decoder's input starts at, or
+// -1 if its offsets don't map onto the file.
+func decodePages(
+	decoder *xml.Decoder,
+	base int64,
+	site func(*common.SiteInfo),
+	emit func(Page) bool,
+) error {
+	for {
+		pos := decoder.InputOffset()
+		tok, err := decoder.Token()
+		if err == io.EOF || isDumpTrailer(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		element, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if element.Name.Local == "siteinfo" && site != nil {
+			var info common.SiteInfo
+			if err := decoder.DecodeElement(&info, &element); err != nil {
+				return err
+			}
+			site(&info)
+		} else if element.Name.Local == "page" {
+			var page Page
+			if err := decoder.DecodeElement(&page, &element); err != nil {
+				return err
+			}
+			page.Offset = -1
+			if base >= 0 {
+				page.Offset = base + pos
+			}
+			if !emit(page) {
+				return nil
+			}
+		}
+	}
+}
+
+// peekSiteInfo decodes the <siteinfo> element from the head of a dump that
+// can't be seeked, returning a reader that replays the dump from the start.
+func peekSiteInfo(reader io.Reader) (*common.SiteInfo, io.Reader, error) {
+	var head bytes.Buffer
+	site, err := readSiteInfo(io.TeeReader(reader, &head))
+	return site, io.MultiReader(&head, reader), err
+}
+
+// readSiteInfo decodes the <siteinfo> element from the head of a dump.
+func readSiteInfo(reader io.Reader) (*common.SiteInfo, error) {
+	dump, _ := dumpReader(reader)
+	decoder := xml.NewDecoder(dump)
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return nil, errors.New("dump has no <siteinfo> element")
+		} else if err != nil {
+			return nil, err
+		}
+
+		if element, ok := tok.(xml.StartElement); ok {
+			switch element.Name.Local {
+			case "siteinfo":
+				var site common.SiteInfo
+				if err := decoder.DecodeElement(&site, &element); err != nil {
+					return nil, err
+				}
+				return &site, nil
+			case "page":
+				return nil, errors.New("dump has no <siteinfo> element before its first <page>")
+			}
+		}
+	}
+}
+
+// isDumpTrailer reports whether err was caused by the closing </mediawiki>
+// tag, which is unmatched when a page stream is decoded on its own.
+func isDumpTrailer(err error) bool {
+	var syntax_err *xml.SyntaxError
+	return errors.As(err, &syntax_err) && syntax_err.Msg == "unexpected end element </mediawiki>"
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/xml"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"common"
+)
+
+// Sampling picks a small, repeatable subset of a dump to build test indexes
+// from. A page is sampled if it passes every filter given, and in closure
+// mode the sampled pages are seeds, sent along with the pages they link to.
+
+type sampler struct {
+	// every keeps one page in each run of every, counting in dump order
+	every int
+	seen int
+	// fraction keeps pages whose hash under seed falls below it, so the same
+	// pages are picked on every run
+	fraction float64
+	seed int64
+	titles map[string]bool
+	pattern *regexp.Regexp
+}
+
+// active reports whether any filter is set.
+func (s *sampler) active() bool {
+	return s.every > 1 || s.fraction < 1 || s.titles != nil || s.pattern != nil
+}
+
+// sample reports whether page is picked. It must be called on pages in dump
+// order, once each.
+func (s *sampler) sample(page Page) bool {
+	if s.titles != nil && !s.titles[page.Title] {
+		return false
+	}
+	if s.pattern != nil && !s.pattern.MatchString(page.Title) {
+		return false
+	}
+	if s.fraction < 1 && s.hash(page) >= s.fraction {
+		return false
+	}
+	if s.every > 1 {
+		s.seen++
+		return (s.seen - 1) % s.every == 0
+	}
+	return true
+}
+
+// hash maps page to [0, 1), by page ID so pages stay picked when they are
+// renamed.
+func (s *sampler) hash(page Page) float64 {
+	hash := fnv.New64a()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(s.seed))
+	hash.Write(buf[:])
+	if page.ID != 0 {
+		binary.BigEndian.PutUint64(buf[:], uint64(page.ID))
+		hash.Write(buf[:])
+	} else {
+		hash.Write([]byte(page.Title))
+	}
+	// FNV barely mixes its last bytes, and consecutive IDs would hash alike
+	// without the murmur3 finaliser
+	h := hash.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return float64(h >> 11) / float64(1 << 53)
+}
+
+// loadTitles reads a list of titles, one per line, ignoring blank lines and
+// ones starting with #. Underscores are read as spaces, as in URLs.
+func loadTitles(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	titles := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		titles[strings.ReplaceAll(line, "_", " ")] = true
+	}
+	return titles, scanner.Err()
+}
+
+var reWikiLink = regexp.MustCompile(`\[\[([^\[\]|{}<>\n]+?)(?:\|[^\]]*)?\]\]`)
+
+// pageLinks returns the titles page links to, normalised as MediaWiki does:
+// without any section, with spaces for underscores, and with the first
+// letter capitalised unless the wiki's titles are case-sensitive.
+func pageLinks(page Page, first_letter bool) []string {
+	matches := reWikiLink.FindAllStringSubmatch(page.Latest().Text, -1)
+	links := make([]string, 0, len(matches))
+	for _, match := range matches {
+		title, _, _ := strings.Cut(match[1], "#")
+		title = strings.Join(strings.Fields(strings.ReplaceAll(title, "_", " ")), " ")
+		title = strings.TrimPrefix(title, ":")
+		if title == "" {
+			continue
+		}
+		if first_letter {
+			r, size := utf8.DecodeRuneInString(title)
+			title = string(unicode.ToUpper(r)) + title[size:]
+		}
+		links = append(links, title)
+	}
+	return links
+}
+
+// linkClosure returns the titles of the pages sampled from the dump and of
+// those up to opts.closure links away from them, following redirects like any
+// other link. Each level takes a pass over the dump, and file is left at its
+// start for the pass sending the pages.
+func linkClosure(file *os.File, file_size int64, opts *options, site *common.SiteInfo) map[string]bool {
+	first_letter := site == nil || site.Case != "case-sensitive"
+	closure := make(map[string]bool)
+	frontier := make(map[string]bool)
+	add_links := func(page Page) {
+		for _, link := range pageLinks(page, first_letter) {
+			if !closure[link] {
+				frontier[link] = true
+			}
+		}
+	}
+
+	scanDump(file, file_size, opts, func(page Page) bool {
+		if opts.sample.sample(page) {
+			closure[page.Title] = true
+			add_links(page)
+		}
+		return true
+	})
+	log.Printf("wxunpacker/sample: Sampled %d seed pages\n", len(closure))
+
+	for level := 1; level <= opts.closure && len(frontier) > 0; level++ {
+		wanted := frontier
+		frontier = make(map[string]bool)
+		found := 0
+		scanDump(file, file_size, opts, func(page Page) bool {
+			if wanted[page.Title] && !closure[page.Title] {
+				closure[page.Title] = true
+				found++
+				// Links from the last level aren't followed
+				if level < opts.closure {
+					add_links(page)
+				}
+			}
+			return true
+		})
+		log.Printf("wxunpacker/sample: Found %d of %d pages linked at depth %d\n", found, len(wanted), level)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		panic(err)
+	}
+	return closure
+}
+
+// scanDump passes every page opts keeps to fn in dump order, decoding the
+// whole of file again.
+func scanDump(file *os.File, file_size int64, opts *options, fn func(Page) bool) {
+	var err error
+	if opts.index != "" {
+		var offsets []int64
+		if offsets, err = readMultistreamIndex(opts.index); err == nil {
+			err = unpackMultistream(file, file_size, offsets, opts, fn, func(int64) {})
+		}
+	} else if _, err = file.Seek(0, io.SeekStart); err == nil {
+		dump, _ := dumpReader(file)
+		err = decodePages(xml.NewDecoder(dump), -1, nil, func(page Page) bool {
+			if !opts.keep(page) {
+				return true
+			}
+			return fn(page)
+		})
+	}
+	if err != nil {
+		panic(err)
+	}
+}
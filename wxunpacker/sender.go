@@ -0,0 +1,197 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"common"
+	"wxunpacker/checkpoint"
+)
+
+// inFlight remembers where each page sent but not yet acknowledged by the
+// indexer came from, so the checkpoint only ever moves past pages that have
+// been durably indexed.
+type inFlight struct {
+	mu sync.Mutex
+	pages []sentPage
+	// acked is the highest sequence number acknowledged, which may be that of
+	// a page not added yet
+	acked uint64
+	// released holds acknowledged pages the checkpoint has yet to move past
+	released []sentPage
+	cp_writer *checkpoint.Writer
+	// saved is a checkpoint saved since the indexer was last told about one
+	saved *checkpoint.Checkpoint
+	wake chan struct{}
+	stop chan struct{}
+	stopped chan struct{}
+}
+
+type sentPage struct {
+	seq uint64
+	offset int64
+	id int64
+	title string
+}
+
+func newInFlight(cp_writer *checkpoint.Writer) *inFlight {
+	f := &inFlight{
+		cp_writer: cp_writer,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go f.moveCheckpoint()
+	return f
+}
+
+func (f *inFlight) add(page sentPage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pages = append(f.pages, page)
+	f.release()
+}
+
+// acknowledge is called by the producer as the indexer acknowledges pages.
+func (f *inFlight) acknowledge(seq uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.acked = max(f.acked, seq)
+	f.release()
+}
+
+// release hands the acknowledged pages over to moveCheckpoint. f.mu must be
+// held.
+func (f *inFlight) release() {
+	i := 0
+	for i < len(f.pages) && f.pages[i].seq <= f.acked {
+		i++
+	}
+	if i == 0 {
+		return
+	}
+	if f.cp_writer != nil {
+		f.released = append(f.released, f.pages[:i]...)
+	}
+	f.pages = f.pages[i:]
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// moveCheckpoint moves the checkpoint past released pages until close is
+// called. Saving it syncs to disk, so it is kept out of the producer's way.
+func (f *inFlight) moveCheckpoint() {
+	defer close(f.stopped)
+	for {
+		select {
+		case <- f.wake:
+			f.checkpointReleased()
+		case <- f.stop:
+			f.checkpointReleased()
+			return
+		}
+	}
+}
+
+func (f *inFlight) checkpointReleased() {
+	f.mu.Lock()
+	pages := f.released
+	f.released = nil
+	f.mu.Unlock()
+	for _, page := range pages {
+		saved, err := f.cp_writer.Update(page.offset, page.id, page.title)
+		if err != nil {
+			log.Printf("wxunpacker: Failed to save checkpoint: %v\n", err)
+		} else if saved {
+			cp := f.cp_writer.Current()
+			f.mu.Lock()
+			f.saved = &cp
+			f.mu.Unlock()
+		}
+	}
+}
+
+// close waits for the checkpoint to move past every page acknowledged so far,
+// after which the checkpoint writer is free to be used directly.
+func (f *inFlight) close() {
+	close(f.stop)
+	<- f.stopped
+}
+
+func (f *inFlight) takeSaved() *checkpoint.Checkpoint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	saved := f.saved
+	f.saved = nil
+	return saved
+}
+
+// pageSink is where pages go: the indexers, or a record file.
+type pageSink interface {
+	Send(t common.MessageType, v any) (uint64, error)
+	Notify(t common.MessageType, v any)
+	Close() error
+}
+
+func sendPages(in_chan <- chan queuedPage, producer pageSink, in_flight *inFlight) {
+	var diff = 0
+	var wait int64 = 0
+	for page := range in_chan {
+		start := time.Now()
+		seq, err := producer.Send(common.MsgPage, &page.data)
+		wait = time.Since(start).Microseconds() + wait
+		if err != nil {
+			panic(err)
+		}
+		in_flight.add(sentPage{seq: seq, offset: page.offset, id: page.data.ID, title: page.data.Title})
+		if cp := in_flight.takeSaved(); cp != nil {
+			producer.Notify(common.MsgCheckpoint, &common.Checkpoint{
+				Offset: cp.Offset,
+				PageID: cp.PageID,
+				Title: cp.Title,
+				Pages: int64(cp.Pages),
+			})
+		}
+		if diff >= 1000 {
+			//log.Printf("wxunpacker: Avg send wait time: %d\n", wait / 1000)
+			diff = 0
+			wait = 0
+		}
+		diff++
+	}
+	sender_group.Done()
+}
+
+// connectIndexer greets each shard's indexer, or with -record creates the
+// record file, passing on the profile of the wiki the dump is from if it is
+// known.
+func connectIndexer(opts *options, site *common.SiteInfo, on_ack func(uint64)) (pageSink, error) {
+	hello := common.Hello{Producer: "wxunpacker", Batch: opts.batch}
+	if opts.compression != common.CompressionNone {
+		hello.Compression = []string{opts.compression}
+	}
+	if site != nil {
+		hello.Profile = common.ProfileFromSiteInfo(site)
+	}
+	if opts.record != "" {
+		log.Printf("wxunpacker: Recording pages to %s\n", opts.record)
+		return common.CreateRecordFile(opts.record, hello, on_ack)
+	}
+	var dials []func() (net.Conn, error)
+	for _, addr := range opts.addrs {
+		dial, err := common.Dialer(addr, opts.tls)
+		if err != nil {
+			return nil, err
+		}
+		dials = append(dials, dial)
+	}
+	partition, err := common.ParsePartitioner(opts.partition)
+	if err != nil {
+		return nil, err
+	}
+	return common.NewFanout(dials, hello, opts.window, partition, on_ack)
+}
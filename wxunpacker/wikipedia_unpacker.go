@@ -1,170 +1,451 @@
 package main
 
 import (
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
 	"encoding/xml"
 	"log"
 	"io"
 	"os"
 	"strings"
-	"net"
 	"net/url"
+	"path/filepath"
+	"slices"
 	"time"
 	"regexp"
 	"bufio"
 	"fmt"
-
-	"github.com/vmihailenco/msgpack/v5"
+	"sync"
 
 	"common"
+	"wxunpacker/checkpoint"
 	"wxunpacker/utils"
 )
 
 type Page struct {
+	ID int64 `xml:"id"`
 	Title string `xml:"title"`
-	Text string `xml:"revision>text"`
 	Namespace string `xml:"ns"`
+	Redirect Redirect `xml:"redirect"`
+	// Revisions holds the page's latest revision in a current-version dump,
+	// and every revision since the last dump in an incremental one
+	Revisions []Revision `xml:"revision"`
+	// Offset is where decoding can restart to read this page again, see
+	// checkpoint.Checkpoint.
+	Offset int64 `xml:"-"`
+}
+
+// Latest returns the most recent of the page's revisions.
+func (p *Page) Latest() Revision {
+	var latest Revision
+	for _, revision := range p.Revisions {
+		if revision.ID > latest.ID {
+			latest = revision
+		}
+	}
+	return latest
+}
+
+type Redirect struct {
+	Title string `xml:"title,attr"`
+}
+
+type Revision struct {
+	ID int64 `xml:"id"`
+	Timestamp time.Time `xml:"timestamp"`
+	Contributor Contributor `xml:"contributor"`
+	Text string `xml:"text"`
+}
+
+// Contributor holds a username for registered editors and an IP address for
+// anonymous ones.
+type Contributor struct {
+	Username string `xml:"username"`
+	IP string `xml:"ip"`
+}
+
+func (c Contributor) Name() string {
+	if c.Username != "" {
+		return c.Username
+	}
+	return c.IP
+}
+
+// queuedPage is a page waiting to be sent, along with what is needed to
+// checkpoint it once it has been.
+type queuedPage struct {
+	data common.PageData
+	offset int64
 }
 
 const GB = 1073741824
 
+var sender_group sync.WaitGroup
+
 var reRedirect = regexp.MustCompile(`^#REDIRECT \[\[(.*?)\]\]`)
 
 func main() {
-	//num_pages, err := countPagesCustomDecoder("/run/media/matthewnesbitt/Linux 1TB SSD/WikiDump/enwiki-20250320-pages-articles-multistream.xml")
-	//if err != nil {
-	//	panic(err)
-	//}
+	args := os.Args[1:]
+	command := "unpack"
+	if len(args) > 0 && (args[0] == "unpack" || args[0] == "count" || args[0] == "siteinfo" || args[0] == "log") {
+		command = args[0]
+		args = args[1:]
+	}
+
+	switch command {
+	case "count":
+		runCount(parseCountArgs(args))
+	case "siteinfo":
+		runSiteInfo(parseSiteInfoArgs(args))
+	case "log":
+		runLog(parseLogArgs(args))
+	default:
+		runUnpack(parseUnpackArgs(args))
+	}
+}
 
+func runUnpack(opts *options) {
 	log.Println("Starting Indexing")
-	addr := "/tmp/windexIPC.sock"
-	connection, err := net.Dial("unix", addr)
+	file, file_size, err := openInput(opts.input)
 	if err != nil {
 		panic(err)
 	}
-	defer connection.Close()
+	defer file.Close()
+
+	// The indexer is told which wiki the pages are from when connecting, so
+	// <siteinfo> is read ahead of the pages.
+	var dump_head io.Reader = file
+	var site *common.SiteInfo
+	if opts.input == "-" {
+		site, dump_head, err = peekSiteInfo(file)
+	} else {
+		site, err = readSiteInfo(io.NewSectionReader(file, 0, file_size))
+	}
+	if err != nil {
+		log.Printf("wxunpacker: Failed to read siteinfo, the indexer will use its own profile: %v\n", err)
+	}
+	if site != nil && opts.siteinfo != "" {
+		if err := site.Save(opts.siteinfo); err != nil {
+			panic(err)
+		}
+		log.Printf("wxunpacker: Saved siteinfo for %s to %s\n", site.DBName, opts.siteinfo)
+	}
 
-	encoder := msgpack.NewEncoder(connection)
+	input := opts.input
+	if input != "-" {
+		input, _ = filepath.Abs(input)
+	}
+	base := checkpoint.Checkpoint{Input: input, InputSize: file_size, Offset: -1}
+	var resume_from *checkpoint.Checkpoint
+	if opts.resume {
+		resume_from, err = checkpoint.Load(opts.checkpoint)
+		if err != nil {
+			panic(err)
+		}
+		if resume_from.Input != input || resume_from.InputSize != file_size {
+			panic(fmt.Errorf("checkpoint %s was written for %s (%d bytes), not %s (%d bytes)",
+				opts.checkpoint, resume_from.Input, resume_from.InputSize, input, file_size))
+		}
+		if resume_from.Complete {
+			log.Printf("wxunpacker: Checkpoint %s marks %s as complete, nothing to do\n", opts.checkpoint, input)
+			return
+		}
+		log.Printf("wxunpacker: Resuming after page %d (%s), %d pages already sent\n",
+			resume_from.PageID, resume_from.Title, resume_from.Pages)
+		base = *resume_from
+	}
+
+	var cp_writer *checkpoint.Writer
+	if opts.checkpoint != "" {
+		cp_writer = checkpoint.NewWriter(opts.checkpoint, opts.checkpoint_interval, base)
+	}
 
-	file, err := os.Open("/run/media/matthewnesbitt/Linux 1TB SSD/WikiDump/enwiki-20250320-pages-articles-multistream.xml")
+	var closure map[string]bool
+	if opts.closure > 0 {
+		closure = linkClosure(file, file_size, opts, site)
+		log.Printf("wxunpacker: Sending %d sampled and linked pages\n", len(closure))
+	}
+
+	in_flight := newInFlight(cp_writer)
+	producer, err := connectIndexer(opts, site, in_flight.acknowledge)
 	if err != nil {
 		panic(err)
 	}
-	defer file.Close()
 
-	//bz2_reader := bzip2.NewReader(file)
-	reader := &utils.CountingReader{Reader: file}
-	decoder := xml.NewDecoder(reader)
-
-	var page Page
-	var i = 0
+	var i = base.Pages
 	var diff = 0
-	var send_chan = make(chan common.PageData, 1000)
-	var file_stats, _ = file.Stat()
-	var file_size = file_stats.Size()
+	var limited = false
+	var skipping = resume_from != nil
+	var send_chan = make(chan queuedPage, 1000)
+	var bytes_read func() int64
+
+	sender_group.Add(1)
+	go sendPages(send_chan, producer, in_flight)
 
-	go sendPages(send_chan, encoder)
+	// Pages from an incremental dump replace the ones already indexed
+	op := common.OpIndex
+	if opts.incremental {
+		op = common.OpUpsert
+	}
 
 	start := time.Now()
-	for {
-		tok, err := decoder.Token()
-		if err == io.EOF {
-			elapsed := time.Since(start).Seconds()
-			log.Printf("wxunpacker: Reached EOF, processed %d pages in %dh, %dm, %ds\n",
-			i,
-			int(elapsed) / 3600,
-			(int(elapsed) % 3600) / 60,
-			int(elapsed) % 60,
-		)
-			break
-		} else if err != nil {
+	emit := func(page Page) bool {
+		if !opts.keep(page) {
+			return true
+		}
+		if closure != nil {
+			if !closure[page.Title] {
+				return true
+			}
+		} else if !opts.sample.sample(page) {
+			return true
+		}
+		// Pages up to and including the checkpointed one were already sent
+		if skipping {
+			skipping = page.ID != resume_from.PageID
+			return true
+		}
+		if diff >= 1000 {
+			printProgress(i, bytes_read(), file_size, start)
+			diff = 0
+		}
+		diff++
+		i++
+
+		url_title := url.PathEscape(strings.ReplaceAll(page.Title, " ", "_"))
+		revision := page.Latest()
+		send_chan <- queuedPage{
+			data: common.PageData{
+				Op: op,
+				Title: page.Title,
+				URL: url_title,
+				Body: revision.Text,
+				ID: page.ID,
+				RevisionID: revision.ID,
+				Timestamp: revision.Timestamp,
+				Contributor: revision.Contributor.Name(),
+				Redirect: page.Redirect.Title,
+			},
+			offset: page.Offset,
+		}
+		limited = opts.limit != 0 && i >= opts.limit
+		return !limited
+	}
+
+	if opts.index != "" {
+		offsets, err := readMultistreamIndex(opts.index)
+		if err != nil {
 			panic(err)
 		}
 
-		switch element := tok.(type) {
-		case xml.StartElement:
-			if element.Name.Local != "page" {
-				continue
-			}
-			page = Page{}
-			decoder.DecodeElement(&page, &element)
-			if page.Namespace != "0" || page.Title == "" {
-				continue
+		first := 0
+		if resume_from != nil && resume_from.Offset >= 0 {
+			var found bool
+			first, found = slices.BinarySearch(offsets, resume_from.Offset)
+			if !found {
+				panic(fmt.Errorf("checkpoint offset %d is not the start of a stream in %s", resume_from.Offset, opts.index))
 			}
-			if diff >= 1000 {
-				elapsed := time.Since(start).Seconds()
-				completion := float64(reader.Bytes) / float64(file_size)
-				eta_s := int(float64(elapsed) / completion - float64(elapsed))
-				fmt.Printf("\r\033[Kwxunpacker: Processed: %d pages, %.1f/%.0fGB (%.2f%%), ETA: %dh, %dm, %ds, Elapsed: %dh, %dm, %ds",
-					i,
-					float64(reader.Bytes) / float64(GB),
-					float64(file_size) / float64(GB),
-					100 * completion,
-					eta_s / 3600,
-					(eta_s % 3600) / 60,
-					eta_s % 60,
-					int(elapsed) / 3600,
-					(int(elapsed) % 3600) / 60,
-					int(elapsed) % 60,
-				)
-				diff = 0
+		}
+		log.Printf("wxunpacker: Decoding %d streams on %d workers\n", len(offsets) - first, opts.workers)
+
+		var done int64 = 0
+		if first > 0 {
+			done = offsets[first]
+		}
+		bytes_read = func() int64 { return done }
+		err = unpackMultistream(file, file_size, offsets[first:], opts, emit, func(n int64) { done += n })
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		// Seek straight to the checkpoint when we can, otherwise the pages
+		// before it are decoded again and skipped.
+		var offset int64 = 0
+		if resume_from != nil && resume_from.Offset >= 0 && opts.input != "-" {
+			offset, err = file.Seek(resume_from.Offset, io.SeekStart)
+			if err != nil {
+				panic(err)
 			}
-			diff++
-			i++
+		}
+
+		// Count bytes before decompression, so progress and ETA are measured
+		// against the size of the file on disk.
+		reader := &utils.CountingReader{Reader: dump_head, Bytes: offset}
+		bytes_read = func() int64 { return reader.Bytes }
+		dump, compressed := dumpReader(reader)
+		if compressed || opts.input == "-" {
+			offset = -1
+		}
+		err = decodePages(xml.NewDecoder(dump), offset, nil, emit)
+		if err != nil {
+			panic(err)
+		}
+	}
 
-			url_title := url.PathEscape(strings.ReplaceAll(page.Title, " ", "_"))
-			send_chan <- common.PageData{Title: page.Title, URL: url_title, Body: page.Text}
-		default:
+	close(send_chan)
+	sender_group.Wait()
+
+	// Wait for the indexer to acknowledge every page, moving the checkpoint
+	// past them
+	if err := producer.Close(); err != nil {
+		panic(err)
+	}
+	in_flight.close()
+
+	if cp_writer != nil {
+		if limited {
+			err = cp_writer.Save()
+		} else {
+			err = cp_writer.Finish()
+		}
+		if err != nil {
+			log.Printf("wxunpacker: Failed to save checkpoint: %v\n", err)
 		}
 	}
+
+	elapsed := time.Since(start).Seconds()
 	fmt.Println()
+	log.Printf("wxunpacker: Reached EOF, processed %d pages in %dh, %dm, %ds\n",
+		i,
+		int(elapsed) / 3600,
+		(int(elapsed) % 3600) / 60,
+		int(elapsed) % 60,
+	)
 }
 
-func countPagesWithXMLDecoder(path string) (int, error) {
-	//return 8032054, nil
-	file, err := os.Open(path)
+func runCount(opts *options) {
+	file, _, err := openInput(opts.input)
 	if err != nil {
-		return 0, err
+		log.Fatal(err)
 	}
 	defer file.Close()
 
-	decoder := xml.NewDecoder(file)
-	var page Page
+	var count int
+	if opts.method == "xml" {
+		dump, _ := dumpReader(file)
+		count, err = countPagesWithXMLDecoder(dump, opts)
+	} else {
+		dump, _ := dumpReader(file)
+		count, err = countPagesCustomDecoder(dump, opts)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(count)
+}
 
-	count := 0
-	diff := 0
-	for {
-		tok, err := decoder.Token()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return count, err
-		}
+func runSiteInfo(opts *options) {
+	file, _, err := openInput(opts.input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
 
-		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "page" {
-			decoder.DecodeElement(&page, &se)
-			if page.Namespace == "0" && page.Title != "" {
-				if diff >= 1000 {
-					log.Println("wxunpacker: preprocessed:", count)
-					diff = 0
-				}
-				diff++
-				count++
-			}
-		}
+	site, err := readSiteInfo(file)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	return count, nil
+	if opts.siteinfo == "" {
+		data, err := json.MarshalIndent(site, "", "\t")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	if err := site.Save(opts.siteinfo); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func countPagesCustomDecoder(path string) (int, error) {
-	return 18334374, nil
+// openInput opens the dump at path, or stdin if path is "-". The returned size
+// is 0 when it is not known.
+func openInput(path string) (*os.File, int64, error) {
+	if path == "-" {
+		return os.Stdin, 0, nil
+	}
 	file, err := os.Open(path)
 	if err != nil {
-		return 0, err
+		return nil, 0, err
 	}
-	defer file.Close()
+	stats, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, stats.Size(), nil
+}
 
-	reader := bufio.NewReaderSize(file, 1024*1024)
+func printProgress(pages int, bytes int64, file_size int64, start time.Time) {
+	elapsed := time.Since(start).Seconds()
+	if file_size <= 0 {
+		fmt.Printf("\r\033[Kwxunpacker: Processed: %d pages, %.1fGB, Elapsed: %dh, %dm, %ds",
+			pages,
+			float64(bytes) / float64(GB),
+			int(elapsed) / 3600,
+			(int(elapsed) % 3600) / 60,
+			int(elapsed) % 60,
+		)
+		return
+	}
+	completion := float64(bytes) / float64(file_size)
+	eta_s := int(float64(elapsed) / completion - float64(elapsed))
+	fmt.Printf("\r\033[Kwxunpacker: Processed: %d pages, %.1f/%.0fGB (%.2f%%), ETA: %dh, %dm, %ds, Elapsed: %dh, %dm, %ds",
+		pages,
+		float64(bytes) / float64(GB),
+		float64(file_size) / float64(GB),
+		100 * completion,
+		eta_s / 3600,
+		(eta_s % 3600) / 60,
+		eta_s % 60,
+		int(elapsed) / 3600,
+		(int(elapsed) % 3600) / 60,
+		int(elapsed) % 60,
+	)
+}
+
+// dumpReader wraps the raw dump in a bzip2 decompressor if it starts with the
+// bzip2 magic, reporting whether it did. compress/bzip2 reads concatenated
+// streams, so multistream dumps decode as a single XML document.
+func dumpReader(reader io.Reader) (io.Reader, bool) {
+	buffered := bufio.NewReaderSize(reader, 1024*1024)
+	magic, _ := buffered.Peek(3)
+	if string(magic) == "BZh" {
+		return bzip2.NewReader(buffered), true
+	}
+	// Logging dumps are gzip compressed
+	if len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		if gz, err := gzip.NewReader(buffered); err == nil {
+			return gz, true
+		}
+	}
+	return buffered, false
+}
+
+func countPagesWithXMLDecoder(reader io.Reader, opts *options) (int, error) {
+	count := 0
+	diff := 0
+	err := decodePages(xml.NewDecoder(reader), -1, nil, func(page Page) bool {
+		if opts.keep(page) {
+			if diff >= 1000 {
+				log.Println("wxunpacker: preprocessed:", count)
+				diff = 0
+			}
+			diff++
+			count++
+		}
+		return true
+	})
+	return count, err
+}
+
+// countPagesCustomDecoder counts pages by scanning for tags line by line,
+// which is much faster than decoding the XML but relies on the dump's layout
+// of one tag per line.
+func countPagesCustomDecoder(reader io.Reader, opts *options) (int, error) {
+	buffered := bufio.NewReaderSize(reader, 1024*1024)
 
 	var in_page = false
 	var ns_valid = false
@@ -176,18 +457,18 @@ func countPagesCustomDecoder(path string) (int, error) {
 	var done = false
 
 	for !done {
-		line, err := reader.ReadString('\n')
+		line, err := buffered.ReadString('\n')
 		if err == io.EOF {
 			done = true
 		} else if err != nil {
-			log.Fatal(err)
+			return pages, err
 		}
 		line = strings.TrimSpace(line)
 		if in_page {
 			if ns, ok := strings.CutPrefix(line, "<ns>"); ok {
 				ns := strings.TrimSuffix(ns, "</ns>")
 				//log.Printf("Found ns %s\n", line)
-				if ns == "0" {
+				if opts.namespaces[ns] {
 					//log.Printf("ns valid")
 					ns_valid = true
 				} else {
@@ -231,29 +512,11 @@ func countPagesCustomDecoder(path string) (int, error) {
 			if strings.HasPrefix(line, "<page>") {
 				//log.Printf("Found page: %s\n", line)
 				in_page = true
+				ns_valid = false
+				title_valid = false
 				total++
 			}
 		}
 	}
 	return pages, nil
 }
-
-func sendPages(in_chan <- chan common.PageData, sock *msgpack.Encoder) {
-	var diff = 0
-	var wait int64 = 0
-	for {
-		page := <- in_chan
-		start := time.Now()
-		err := sock.Encode(page)
-		wait = time.Since(start).Microseconds() + wait
-		if err != nil {
-			panic(err)
-		}
-		if diff >= 1000 {
-			//log.Printf("wxunpacker: Avg send wait time: %d\n", wait / 1000)
-			diff = 0
-			wait = 0
-		}
-		diff++
-	}
-}